@@ -17,6 +17,7 @@ var (
 	ErrorInternalServer        = NewError(999, "系统繁忙，请稍后再试!")
 
 	InvalidParam = NewError(10005, "无效的参数")
+	InvalidSign  = NewError(10006, "签名验证失败")
 )
 
 var (
@@ -73,6 +74,7 @@ var (
 	ContextRequestUserIdKey    = "userId"
 	ContextRequestSysUserIdKey = "sysUserId"
 	ContextRequestParamKey     = "requestParam"
+	ContextRequestClientKey    = "clientKey"
 	ContextResponseDataKey     = "responseData"
 	ContextRequestStartTimeKey = "requestStartTime"
 	// ContextResponseBodyWriterKey 替换gin c.Writer
@@ -0,0 +1,48 @@
+package auth
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// DefaultNonceTTL Verifier.MaxSkew为0(不校验时间戳)时nonce的保留时间
+var DefaultNonceTTL = 24 * time.Hour
+
+// NonceStore 记录已使用的nonce，防止签名请求被重放
+type NonceStore interface {
+	// Use nonce在ttl内第一次使用时返回true，再次使用返回false
+	Use(ctx context.Context, key string, ttl time.Duration) (bool, error)
+}
+
+// MemoryNonceStore 进程内的nonce记录，只适合单实例部署，多实例使用redis.NonceStore
+type MemoryNonceStore struct {
+	mu      sync.Mutex
+	nonces  map[string]time.Time
+	inserts int
+}
+
+// NewMemoryNonceStore 创建进程内的nonce记录
+func NewMemoryNonceStore() *MemoryNonceStore {
+	return &MemoryNonceStore{nonces: make(map[string]time.Time)}
+}
+
+// Use 记录nonce，每写入1024次清理一次过期的记录
+func (s *MemoryNonceStore) Use(_ context.Context, key string, ttl time.Duration) (bool, error) {
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if expireAt, ok := s.nonces[key]; ok && now.Before(expireAt) {
+		return false, nil
+	}
+	s.nonces[key] = now.Add(ttl)
+	if s.inserts++; s.inserts >= 1024 {
+		s.inserts = 0
+		for k, expireAt := range s.nonces {
+			if !now.Before(expireAt) {
+				delete(s.nonces, k)
+			}
+		}
+	}
+	return true, nil
+}
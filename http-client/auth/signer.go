@@ -0,0 +1,263 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 签名相关请求头
+const (
+	HeaderClientKey = "X-Client-Key"
+	HeaderTimestamp = "X-Timestamp"
+	HeaderNonce     = "X-Nonce"
+	HeaderSignature = "X-Signature"
+)
+
+var (
+	ErrMissingSignature  = errors.New("auth: missing signature headers")
+	ErrInvalidTimestamp  = errors.New("auth: invalid or expired timestamp")
+	ErrSignatureMismatch = errors.New("auth: signature mismatch")
+	ErrUnknownClientKey  = errors.New("auth: unknown client key")
+	ErrReplayedNonce     = errors.New("auth: nonce already used")
+)
+
+// Signer 请求签名，签名结果写入请求头
+type Signer interface {
+	// Sign 对请求签名，timestamp和nonce由调用方生成
+	Sign(req *http.Request, credentials *Credentials, timestamp, nonce string) error
+	// Signature 计算请求的签名，用于验签
+	Signature(req *http.Request, credentials *Credentials, timestamp, nonce string) (string, error)
+}
+
+// HMACSigner HMAC-SHA256签名
+// 签名串：METHOD\nPATH\n按key排序的QUERY\nhex(sha256(BODY))\nTIMESTAMP\nNONCE
+type HMACSigner struct{}
+
+// Signature 计算HMAC-SHA256签名
+func (HMACSigner) Signature(req *http.Request, credentials *Credentials, timestamp, nonce string) (string, error) {
+	body, err := readBody(req)
+	if err != nil {
+		return "", err
+	}
+	bodyHash := sha256.Sum256(body)
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	canonical := strings.Join([]string{
+		strings.ToUpper(req.Method),
+		path,
+		sortedQuery(req.URL.Query()),
+		hex.EncodeToString(bodyHash[:]),
+		timestamp,
+		nonce,
+	}, "\n")
+	mac := hmac.New(sha256.New, []byte(credentials.ClientSecret))
+	mac.Write([]byte(canonical))
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// Sign 对请求做HMAC-SHA256签名
+func (s HMACSigner) Sign(req *http.Request, credentials *Credentials, timestamp, nonce string) error {
+	return setSignature(s, req, credentials, timestamp, nonce)
+}
+
+// MD5Signer 商户使用的MD5签名：md5(ClientKey + TIMESTAMP + NONCE + ClientSecret)
+type MD5Signer struct{}
+
+// Signature 计算MD5签名
+func (MD5Signer) Signature(req *http.Request, credentials *Credentials, timestamp, nonce string) (string, error) {
+	sum := md5.Sum([]byte(credentials.ClientKey + timestamp + nonce + credentials.ClientSecret))
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// Sign 对请求做MD5签名
+func (s MD5Signer) Sign(req *http.Request, credentials *Credentials, timestamp, nonce string) error {
+	return setSignature(s, req, credentials, timestamp, nonce)
+}
+
+func setSignature(s Signer, req *http.Request, credentials *Credentials, timestamp, nonce string) error {
+	signature, err := s.Signature(req, credentials, timestamp, nonce)
+	if err != nil {
+		return err
+	}
+	req.Header.Set(HeaderClientKey, credentials.ClientKey)
+	req.Header.Set(HeaderTimestamp, timestamp)
+	req.Header.Set(HeaderNonce, nonce)
+	req.Header.Set(HeaderSignature, signature)
+	return nil
+}
+
+// SignRequest
+// @Description: 用当前时间和随机nonce对请求签名
+// @param s
+// @param req
+// @param credentials
+// @return error
+func SignRequest(s Signer, req *http.Request, credentials *Credentials) error {
+	return s.Sign(req, credentials, strconv.FormatInt(time.Now().Unix(), 10), newNonce())
+}
+
+// Verifier 验证收到的请求签名
+type Verifier struct {
+	Signer Signer
+	// Credentials 根据ClientKey查找认证信息，找不到时返回ErrUnknownClientKey
+	Credentials func(clientKey string) (*Credentials, error)
+	// MaxSkew 允许的时间戳误差，为0时不校验时间戳
+	MaxSkew time.Duration
+	// Nonces 记录已使用的nonce，时间戳有效期内同一个nonce只能使用一次；为nil时不防重放
+	Nonces NonceStore
+}
+
+// NewVerifier
+// @Description: 创建验签对象，默认允许5分钟时间误差，使用进程内的nonce记录；多实例部署时把Nonces换成redis.NonceStore
+// @param signer
+// @param lookup
+// @return *Verifier
+func NewVerifier(signer Signer, lookup func(clientKey string) (*Credentials, error)) *Verifier {
+	return &Verifier{
+		Signer:      signer,
+		Credentials: lookup,
+		MaxSkew:     5 * time.Minute,
+		Nonces:      NewMemoryNonceStore(),
+	}
+}
+
+// Verify
+// @Description: 验证请求签名和nonce，通过时返回请求方的认证信息；请求体读取后会放回去
+// @receiver v
+// @param req
+// @return *Credentials
+// @return error
+func (v *Verifier) Verify(req *http.Request) (*Credentials, error) {
+	clientKey := req.Header.Get(HeaderClientKey)
+	timestamp := req.Header.Get(HeaderTimestamp)
+	nonce := req.Header.Get(HeaderNonce)
+	signature := req.Header.Get(HeaderSignature)
+	if clientKey == "" || timestamp == "" || nonce == "" || signature == "" {
+		return nil, ErrMissingSignature
+	}
+	if v.MaxSkew > 0 {
+		ts, err := strconv.ParseInt(timestamp, 10, 64)
+		if err != nil {
+			return nil, ErrInvalidTimestamp
+		}
+		if skew := time.Since(time.Unix(ts, 0)); skew > v.MaxSkew || skew < -v.MaxSkew {
+			return nil, ErrInvalidTimestamp
+		}
+	}
+	credentials, err := v.Credentials(clientKey)
+	if err != nil {
+		return nil, err
+	}
+	if credentials == nil {
+		return nil, ErrUnknownClientKey
+	}
+	expected, err := v.Signer.Signature(req, credentials, timestamp, nonce)
+	if err != nil {
+		return nil, err
+	}
+	if subtle.ConstantTimeCompare([]byte(strings.ToLower(signature)), []byte(expected)) != 1 {
+		return nil, ErrSignatureMismatch
+	}
+	// 签名通过后才记录nonce，避免伪造的请求占用nonce
+	if v.Nonces != nil {
+		// 时间戳在前后MaxSkew内都有效，nonce需要保留2倍MaxSkew
+		ttl := 2 * v.MaxSkew
+		if ttl <= 0 {
+			ttl = DefaultNonceTTL
+		}
+		ok, err := v.Nonces.Use(req.Context(), clientKey+":"+nonce, ttl)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, ErrReplayedNonce
+		}
+	}
+	return credentials, nil
+}
+
+// StaticCredentials
+// @Description: 根据固定的认证列表查找认证信息
+// @param list
+// @return func(clientKey string) (*Credentials, error)
+func StaticCredentials(list ...*Credentials) func(clientKey string) (*Credentials, error) {
+	m := make(map[string]*Credentials, len(list))
+	for _, c := range list {
+		m[c.ClientKey] = c
+	}
+	return func(clientKey string) (*Credentials, error) {
+		if c, ok := m[clientKey]; ok {
+			return c, nil
+		}
+		return nil, ErrUnknownClientKey
+	}
+}
+
+// sortedQuery 按key排序后的query，同一个key的多个值也排序
+func sortedQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var buf strings.Builder
+	for _, k := range keys {
+		values := append([]string(nil), query[k]...)
+		sort.Strings(values)
+		for _, v := range values {
+			if buf.Len() > 0 {
+				buf.WriteByte('&')
+			}
+			buf.WriteString(url.QueryEscape(k))
+			buf.WriteByte('=')
+			buf.WriteString(url.QueryEscape(v))
+		}
+	}
+	return buf.String()
+}
+
+// readBody 读取请求体，读取后放回去不影响后续发送或处理
+func readBody(req *http.Request) ([]byte, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil, nil
+	}
+	if req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		defer body.Close()
+		return io.ReadAll(body)
+	}
+	data, err := io.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	req.Body = io.NopCloser(bytes.NewReader(data))
+	req.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(data)), nil
+	}
+	return data, nil
+}
+
+func newNonce() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,306 @@
+package httpclient
+
+import (
+	"context"
+	"fmt"
+	"github.com/youchuangcd/gopkg"
+	"github.com/youchuangcd/gopkg/mylog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// CircuitState 熔断器状态
+type CircuitState int
+
+const (
+	CircuitClosed   CircuitState = iota // 关闭：正常放行
+	CircuitOpen                         // 打开：直接失败
+	CircuitHalfOpen                     // 半开：放行少量试探请求
+)
+
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitClosed:
+		return "closed"
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half-open"
+	}
+	return fmt.Sprintf("unknown(%d)", int(s))
+}
+
+// CircuitOpenError 熔断器打开时直接返回的错误
+type CircuitOpenError struct {
+	Host  string
+	State CircuitState
+	// RetryAfter 距离进入半开状态的剩余时间
+	RetryAfter time.Duration
+}
+
+func (e *CircuitOpenError) Error() string {
+	return fmt.Sprintf("httpclient: circuit breaker is %s for host %s, retry after %s", e.State, e.Host, e.RetryAfter)
+}
+
+// CircuitBreakerConfig 熔断器配置
+type CircuitBreakerConfig struct {
+	// Window 统计窗口时长，窗口按10个桶滚动
+	Window time.Duration
+	// MinRequests 窗口内请求数达到该值才计算失败率
+	MinRequests int
+	// FailureRateThreshold 失败率达到该值[0,1]时打开熔断器
+	FailureRateThreshold float64
+	// SlowCallDuration 耗时超过该值视为慢调用，为0时不统计慢调用
+	SlowCallDuration time.Duration
+	// SlowCallRateThreshold 慢调用比例达到该值[0,1]时打开熔断器
+	SlowCallRateThreshold float64
+	// OpenTimeout 打开状态持续多久后进入半开状态
+	OpenTimeout time.Duration
+	// HalfOpenRequests 半开状态允许的试探请求数，全部成功后关闭熔断器
+	HalfOpenRequests int
+	// IsFailure 判断一次请求是否失败，为nil时网络错误和5xx响应视为失败
+	IsFailure func(resp *http.Response, err error) bool
+	// OnStateChange 状态变化回调，为nil时记录warn日志
+	OnStateChange func(host string, from, to CircuitState)
+}
+
+// DefaultCircuitBreakerConfig
+// @Description: 默认熔断配置：10s窗口内至少20个请求且失败率达到50%时熔断30s
+// @return CircuitBreakerConfig
+func DefaultCircuitBreakerConfig() CircuitBreakerConfig {
+	return CircuitBreakerConfig{
+		Window:                10 * time.Second,
+		MinRequests:           20,
+		FailureRateThreshold:  0.5,
+		SlowCallDuration:      0,
+		SlowCallRateThreshold: 1,
+		OpenTimeout:           30 * time.Second,
+		HalfOpenRequests:      3,
+	}
+}
+
+const circuitBuckets = 10
+
+type circuitBucket struct {
+	start    time.Time
+	total    int
+	failures int
+	slow     int
+}
+
+// hostCircuit 单个host的熔断状态
+type hostCircuit struct {
+	state    CircuitState
+	openedAt time.Time
+	buckets  [circuitBuckets]circuitBucket
+	// 半开状态下已放行和已成功的试探请求数
+	halfOpenInFlight int
+	halfOpenSuccess  int
+}
+
+// CircuitBreaker 按host统计失败率和慢调用比例的熔断器
+type CircuitBreaker struct {
+	config CircuitBreakerConfig
+	mu     sync.Mutex
+	hosts  map[string]*hostCircuit
+	now    func() time.Time
+}
+
+// NewCircuitBreaker
+// @Description: 创建熔断器，未配置的项使用默认值
+// @param config
+// @return *CircuitBreaker
+func NewCircuitBreaker(config CircuitBreakerConfig) *CircuitBreaker {
+	def := DefaultCircuitBreakerConfig()
+	if config.Window <= 0 {
+		config.Window = def.Window
+	}
+	if config.MinRequests <= 0 {
+		config.MinRequests = def.MinRequests
+	}
+	if config.FailureRateThreshold <= 0 {
+		config.FailureRateThreshold = def.FailureRateThreshold
+	}
+	if config.SlowCallRateThreshold <= 0 {
+		config.SlowCallRateThreshold = def.SlowCallRateThreshold
+	}
+	if config.OpenTimeout <= 0 {
+		config.OpenTimeout = def.OpenTimeout
+	}
+	if config.HalfOpenRequests <= 0 {
+		config.HalfOpenRequests = def.HalfOpenRequests
+	}
+	if config.IsFailure == nil {
+		config.IsFailure = defaultIsFailure
+	}
+	if config.OnStateChange == nil {
+		config.OnStateChange = logCircuitStateChange
+	}
+	return &CircuitBreaker{
+		config: config,
+		hosts:  make(map[string]*hostCircuit),
+		now:    time.Now,
+	}
+}
+
+func defaultIsFailure(resp *http.Response, err error) bool {
+	return err != nil || resp.StatusCode >= http.StatusInternalServerError
+}
+
+func logCircuitStateChange(host string, from, to CircuitState) {
+	mylog.WithWarn(context.Background(), gopkg.LogHttp, map[string]interface{}{
+		"host": host,
+		"from": from.String(),
+		"to":   to.String(),
+	}, "http熔断器状态变化")
+}
+
+// State
+// @Description: 获取host当前的熔断状态
+// @receiver b
+// @param host
+// @return CircuitState
+func (b *CircuitBreaker) State(host string) CircuitState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	hc, ok := b.hosts[host]
+	if !ok {
+		return CircuitClosed
+	}
+	// 打开超时后对外表现为半开
+	if hc.state == CircuitOpen && b.now().Sub(hc.openedAt) >= b.config.OpenTimeout {
+		return CircuitHalfOpen
+	}
+	return hc.state
+}
+
+// allow 判断请求是否放行
+func (b *CircuitBreaker) allow(host string) (err error) {
+	var from, to CircuitState
+	b.mu.Lock()
+	hc, ok := b.hosts[host]
+	if !ok {
+		hc = &hostCircuit{}
+		b.hosts[host] = hc
+	}
+	from = hc.state
+	now := b.now()
+	switch hc.state {
+	case CircuitOpen:
+		if elapsed := now.Sub(hc.openedAt); elapsed < b.config.OpenTimeout {
+			err = &CircuitOpenError{Host: host, State: CircuitOpen, RetryAfter: b.config.OpenTimeout - elapsed}
+			break
+		}
+		b.setState(hc, CircuitHalfOpen, now)
+		hc.halfOpenInFlight++
+	case CircuitHalfOpen:
+		if hc.halfOpenInFlight >= b.config.HalfOpenRequests {
+			err = &CircuitOpenError{Host: host, State: CircuitHalfOpen}
+			break
+		}
+		hc.halfOpenInFlight++
+	}
+	to = hc.state
+	b.mu.Unlock()
+	if from != to {
+		b.config.OnStateChange(host, from, to)
+	}
+	return
+}
+
+// done 记录请求结果
+func (b *CircuitBreaker) done(host string, failure, slow bool) {
+	var from, to CircuitState
+	b.mu.Lock()
+	hc := b.hosts[host]
+	from = hc.state
+	now := b.now()
+	switch hc.state {
+	case CircuitHalfOpen:
+		if failure || slow {
+			b.setState(hc, CircuitOpen, now)
+			break
+		}
+		hc.halfOpenSuccess++
+		if hc.halfOpenSuccess >= b.config.HalfOpenRequests {
+			b.setState(hc, CircuitClosed, now)
+		}
+	case CircuitClosed:
+		bucket := hc.currentBucket(now, b.config.Window)
+		bucket.total++
+		if failure {
+			bucket.failures++
+		}
+		if slow {
+			bucket.slow++
+		}
+		total, failures, slows := hc.sum(now, b.config.Window)
+		if total >= b.config.MinRequests &&
+			(float64(failures)/float64(total) >= b.config.FailureRateThreshold ||
+				(b.config.SlowCallDuration > 0 && float64(slows)/float64(total) >= b.config.SlowCallRateThreshold)) {
+			b.setState(hc, CircuitOpen, now)
+		}
+	}
+	to = hc.state
+	b.mu.Unlock()
+	if from != to {
+		b.config.OnStateChange(host, from, to)
+	}
+}
+
+// setState 切换状态并重置统计，调用方需持有锁
+func (b *CircuitBreaker) setState(hc *hostCircuit, state CircuitState, now time.Time) {
+	hc.state = state
+	hc.halfOpenInFlight = 0
+	hc.halfOpenSuccess = 0
+	hc.buckets = [circuitBuckets]circuitBucket{}
+	if state == CircuitOpen {
+		hc.openedAt = now
+	}
+}
+
+// currentBucket 获取当前时间所在的桶，过期的桶会被重置
+func (hc *hostCircuit) currentBucket(now time.Time, window time.Duration) *circuitBucket {
+	width := window / circuitBuckets
+	start := now.Truncate(width)
+	bucket := &hc.buckets[(start.UnixNano()/int64(width))%circuitBuckets]
+	if !bucket.start.Equal(start) {
+		*bucket = circuitBucket{start: start}
+	}
+	return bucket
+}
+
+// sum 汇总窗口内的统计
+func (hc *hostCircuit) sum(now time.Time, window time.Duration) (total, failures, slows int) {
+	for _, bucket := range hc.buckets {
+		if now.Sub(bucket.start) < window {
+			total += bucket.total
+			failures += bucket.failures
+			slows += bucket.slow
+		}
+	}
+	return
+}
+
+// roundTrip 经过熔断器发送请求
+func (b *CircuitBreaker) roundTrip(next http.RoundTripper, req *http.Request) (resp *http.Response, err error) {
+	host := req.URL.Host
+	if err = b.allow(host); err != nil {
+		return nil, err
+	}
+	startTime := time.Now()
+	resp, err = next.RoundTrip(req)
+	// 调用方主动取消的请求不计入统计，但要归还半开状态的试探名额
+	if err != nil && req.Context().Err() == context.Canceled {
+		b.mu.Lock()
+		if hc := b.hosts[host]; hc.state == CircuitHalfOpen && hc.halfOpenInFlight > 0 {
+			hc.halfOpenInFlight--
+		}
+		b.mu.Unlock()
+		return
+	}
+	slow := b.config.SlowCallDuration > 0 && time.Since(startTime) >= b.config.SlowCallDuration
+	b.done(host, b.config.IsFailure(resp, err), slow)
+	return
+}
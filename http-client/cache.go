@@ -0,0 +1,507 @@
+package httpclient
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/youchuangcd/gopkg"
+	"github.com/youchuangcd/gopkg/http-client/auth"
+	"github.com/youchuangcd/gopkg/http-client/client"
+	"github.com/youchuangcd/gopkg/mylog"
+	"github.com/youchuangcd/gopkg/redis"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CacheHeader 响应头，标记响应来自缓存的情况：HIT、MISS、REVALIDATED
+const CacheHeader = "X-Cache"
+
+var (
+	// DefaultCacheKeepStale 过期的响应有ETag或Last-Modified时继续保留的时长，用于协商缓存
+	DefaultCacheKeepStale = time.Hour
+	// DefaultCacheMaxBodySize 超过该长度的响应不缓存
+	DefaultCacheMaxBodySize int64 = 1 << 20
+)
+
+// credentialHeaders 携带身份的请求头，请求带有这些头时按其值区分缓存，且只缓存public的响应
+var credentialHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", auth.HeaderClientKey, auth.HeaderSignature}
+
+// cacheableStatus 可以缓存的状态码
+var cacheableStatus = map[int]bool{
+	http.StatusOK:                   true,
+	http.StatusNonAuthoritativeInfo: true,
+	http.StatusMultipleChoices:      true,
+	http.StatusMovedPermanently:     true,
+	http.StatusNotFound:             true,
+	http.StatusGone:                 true,
+}
+
+type cacheRefreshKey struct{}
+
+// WithCacheRefresh 本次请求跳过缓存直接请求服务端，并用新的响应更新缓存
+func WithCacheRefresh(ctx context.Context) context.Context {
+	return context.WithValue(ctx, cacheRefreshKey{}, true)
+}
+
+// CacheStorage 缓存存储
+type CacheStorage interface {
+	Get(ctx context.Context, key string) ([]byte, bool, error)
+	Set(ctx context.Context, key string, value []byte, ttl time.Duration) error
+	Delete(ctx context.Context, key string) error
+}
+
+// MemoryCacheStorage 进程内缓存，超过容量时淘汰最早过期的条目
+type MemoryCacheStorage struct {
+	mu         sync.Mutex
+	maxEntries int
+	entries    map[string]memoryCacheEntry
+}
+
+type memoryCacheEntry struct {
+	value    []byte
+	expireAt time.Time
+}
+
+// NewMemoryCacheStorage
+// @Description: 创建进程内缓存
+// @param maxEntries 最大条目数，小于1时不限制
+// @return *MemoryCacheStorage
+func NewMemoryCacheStorage(maxEntries int) *MemoryCacheStorage {
+	return &MemoryCacheStorage{maxEntries: maxEntries, entries: make(map[string]memoryCacheEntry)}
+}
+
+// Get 获取缓存
+func (s *MemoryCacheStorage) Get(ctx context.Context, key string) ([]byte, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry, ok := s.entries[key]
+	if !ok {
+		return nil, false, nil
+	}
+	if time.Now().After(entry.expireAt) {
+		delete(s.entries, key)
+		return nil, false, nil
+	}
+	return entry.value, true, nil
+}
+
+// Set 设置缓存
+func (s *MemoryCacheStorage) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.entries[key]; !ok && s.maxEntries > 0 && len(s.entries) >= s.maxEntries {
+		s.evict()
+	}
+	s.entries[key] = memoryCacheEntry{value: value, expireAt: time.Now().Add(ttl)}
+	return nil
+}
+
+// Delete 删除缓存
+func (s *MemoryCacheStorage) Delete(ctx context.Context, key string) error {
+	s.mu.Lock()
+	delete(s.entries, key)
+	s.mu.Unlock()
+	return nil
+}
+
+// evict 删除已过期的条目，没有过期的条目时删除最早过期的一个
+func (s *MemoryCacheStorage) evict() {
+	now := time.Now()
+	var (
+		oldestKey string
+		oldest    time.Time
+	)
+	for key, entry := range s.entries {
+		if now.After(entry.expireAt) {
+			delete(s.entries, key)
+			continue
+		}
+		if oldestKey == "" || entry.expireAt.Before(oldest) {
+			oldestKey, oldest = key, entry.expireAt
+		}
+	}
+	if len(s.entries) >= s.maxEntries && oldestKey != "" {
+		delete(s.entries, oldestKey)
+	}
+}
+
+// RedisCacheStorage redis缓存，使用ctx选择的redis实例
+type RedisCacheStorage struct {
+	// Prefix key前缀，默认 http_cache:
+	Prefix string
+}
+
+// Get 获取缓存
+func (s RedisCacheStorage) Get(ctx context.Context, key string) ([]byte, bool, error) {
+	value, err := redis.Get(ctx, s.key(key)).Bytes()
+	if err == redis.ErrNil {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return value, true, nil
+}
+
+// Set 设置缓存，ttl按秒向上取整
+func (s RedisCacheStorage) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	seconds := int64((ttl + time.Second - 1) / time.Second)
+	return redis.Set(ctx, s.key(key), value, seconds).Error()
+}
+
+// Delete 删除缓存
+func (s RedisCacheStorage) Delete(ctx context.Context, key string) error {
+	return redis.Del(ctx, s.key(key)).Error()
+}
+
+func (s RedisCacheStorage) key(key string) string {
+	if s.Prefix == "" {
+		return "http_cache:" + key
+	}
+	return s.Prefix + key
+}
+
+// CacheTransport 按Cache-Control缓存GET响应的RoundTripper，作为NewManagerV2的tr参数使用；
+// 不缓存private的响应，带Authorization、Cookie或签名的请求只缓存public的响应，并按身份区分缓存
+//
+//	tr := httpclient.NewCacheTransport(httpclient.NewMemoryCacheStorage(1000), nil)
+//	m := httpclient.NewManagerV2(nil, timeout, tr)
+type CacheTransport struct {
+	// Transport 实际发送请求的RoundTripper，默认gopkg.HttpClientDefaultTransport
+	Transport http.RoundTripper
+	Storage   CacheStorage
+	// KeepStale 过期的响应有ETag或Last-Modified时继续保留的时长，默认DefaultCacheKeepStale
+	KeepStale time.Duration
+	// MaxBodySize 超过该长度的响应不缓存，默认DefaultCacheMaxBodySize
+	MaxBodySize int64
+}
+
+// NewCacheTransport
+// @Description: 创建缓存RoundTripper
+// @param storage 缓存存储，NewMemoryCacheStorage 或 RedisCacheStorage
+// @param tr 实际发送请求的RoundTripper，为nil时使用gopkg.HttpClientDefaultTransport
+// @return *CacheTransport
+func NewCacheTransport(storage CacheStorage, tr http.RoundTripper) *CacheTransport {
+	if tr == nil {
+		tr = gopkg.HttpClientDefaultTransport
+	}
+	return &CacheTransport{
+		Transport:   tr,
+		Storage:     storage,
+		KeepStale:   DefaultCacheKeepStale,
+		MaxBodySize: DefaultCacheMaxBodySize,
+	}
+}
+
+// cachedResponse 缓存的响应；响应有Vary时，地址对应的key只保存VaryHeaders，响应按Vary请求头的值另外保存
+type cachedResponse struct {
+	StatusCode  int               `json:"status_code"`
+	Header      http.Header       `json:"header"`
+	Body        []byte            `json:"body"`
+	ExpireAt    time.Time         `json:"expire_at"`
+	Vary        map[string]string `json:"vary,omitempty"`
+	VaryHeaders []string          `json:"vary_headers,omitempty"`
+}
+
+// RoundTrip 命中未过期的缓存时直接返回，过期时携带ETag、Last-Modified协商
+func (t *CacheTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	key := cacheKey(req)
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		// 修改资源的请求使缓存失效，包括匿名请求的缓存
+		if req.Method != http.MethodOptions && req.Method != http.MethodTrace {
+			t.Storage.Delete(ctx, key)
+			if anonymous := req.URL.String(); anonymous != key {
+				t.Storage.Delete(ctx, anonymous)
+			}
+		}
+		return t.Transport.RoundTrip(req)
+	}
+	if req.Method == http.MethodHead {
+		return t.Transport.RoundTrip(req)
+	}
+	reqCacheControl := parseCacheControl(req.Header.Get("Cache-Control"))
+	if _, ok := reqCacheControl["no-store"]; ok {
+		return t.Transport.RoundTrip(req)
+	}
+	// 强制刷新时不使用缓存；请求头no-cache时不直接使用缓存，但可以协商
+	refresh, _ := ctx.Value(cacheRefreshKey{}).(bool)
+	_, noCache := reqCacheControl["no-cache"]
+
+	cached := t.load(ctx, key, req)
+	if cached != nil && !refresh && !noCache && time.Now().Before(cached.ExpireAt) {
+		t.log(ctx, req, "HIT")
+		return cached.response(req, "HIT"), nil
+	}
+	sendReq := req
+	if cached != nil && !refresh && req.Header.Get("If-None-Match") == "" && req.Header.Get("If-Modified-Since") == "" {
+		etag, lastModified := cached.Header.Get("ETag"), cached.Header.Get("Last-Modified")
+		if etag != "" || lastModified != "" {
+			sendReq = req.Clone(ctx)
+			if etag != "" {
+				sendReq.Header.Set("If-None-Match", etag)
+			}
+			if lastModified != "" {
+				sendReq.Header.Set("If-Modified-Since", lastModified)
+			}
+		}
+	}
+	resp, err := t.Transport.RoundTrip(sendReq)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotModified && sendReq != req {
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		// 使用304响应的头更新缓存的有效期
+		for _, h := range []string{"Cache-Control", "Expires", "Date", "ETag", "Last-Modified"} {
+			if v := resp.Header.Get(h); v != "" {
+				cached.Header.Set(h, v)
+			}
+		}
+		cached.ExpireAt = time.Now().Add(freshness(cached.Header))
+		t.store(ctx, key, cached)
+		t.log(ctx, req, "REVALIDATED")
+		return cached.response(req, "REVALIDATED"), nil
+	}
+	t.log(ctx, req, "MISS")
+	resp.Header.Set(CacheHeader, "MISS")
+	if !cacheableStatus[resp.StatusCode] {
+		return resp, nil
+	}
+	respCacheControl := parseCacheControl(resp.Header.Get("Cache-Control"))
+	if _, ok := respCacheControl["no-store"]; ok {
+		t.Storage.Delete(ctx, key)
+		return resp, nil
+	}
+	if _, ok := respCacheControl["private"]; ok {
+		return resp, nil
+	}
+	if _, ok := respCacheControl["public"]; !ok && hasCredentials(req.Header) {
+		return resp, nil
+	}
+	entry := &cachedResponse{
+		StatusCode: resp.StatusCode,
+		Header:     resp.Header.Clone(),
+		ExpireAt:   time.Now().Add(freshness(resp.Header)),
+		Vary:       varyValues(resp.Header, req.Header),
+	}
+	entry.Header.Del(CacheHeader)
+	if _, ok := entry.Vary["*"]; ok {
+		return resp, nil
+	}
+	if time.Now().After(entry.ExpireAt) && entry.Header.Get("ETag") == "" && entry.Header.Get("Last-Modified") == "" {
+		return resp, nil
+	}
+	// 读取响应体，超过长度限制时不缓存，已读取的部分放回去
+	body, err := io.ReadAll(io.LimitReader(resp.Body, t.MaxBodySize+1))
+	if err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	if int64(len(body)) > t.MaxBodySize {
+		resp.Body = readCloser{io.MultiReader(bytes.NewReader(body), resp.Body), resp.Body}
+		return resp, nil
+	}
+	resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	entry.Body = body
+	t.store(ctx, key, entry)
+	return resp, nil
+}
+
+func (t *CacheTransport) load(ctx context.Context, key string, req *http.Request) *cachedResponse {
+	value, ok, err := t.Storage.Get(ctx, key)
+	if err != nil {
+		mylog.WithWarn(ctx, gopkg.LogHttp, map[string]interface{}{
+			"req_url": key,
+			"err":     err.Error(),
+		}, "读取http缓存失败")
+		return nil
+	}
+	if !ok {
+		return nil
+	}
+	cached := &cachedResponse{}
+	if err = json.Unmarshal(value, cached); err != nil {
+		return nil
+	}
+	if len(cached.VaryHeaders) > 0 {
+		vary := make(map[string]string, len(cached.VaryHeaders))
+		for _, h := range cached.VaryHeaders {
+			vary[h] = req.Header.Get(h)
+		}
+		return t.load(ctx, variantKey(key, vary), req)
+	}
+	// Vary指定的请求头不一致时不使用缓存
+	for h, v := range cached.Vary {
+		if req.Header.Get(h) != v {
+			return nil
+		}
+	}
+	return cached
+}
+
+func (t *CacheTransport) store(ctx context.Context, key string, cached *cachedResponse) {
+	ttl := time.Until(cached.ExpireAt)
+	if cached.Header.Get("ETag") != "" || cached.Header.Get("Last-Modified") != "" {
+		ttl += t.KeepStale
+	}
+	if ttl <= 0 {
+		return
+	}
+	value, err := json.Marshal(cached)
+	if err == nil && len(cached.Vary) > 0 {
+		// 地址对应的key记录Vary的请求头，读取时按请求头的值找到对应的响应
+		headers := make([]string, 0, len(cached.Vary))
+		for h := range cached.Vary {
+			headers = append(headers, h)
+		}
+		sort.Strings(headers)
+		var index []byte
+		if index, err = json.Marshal(&cachedResponse{ExpireAt: cached.ExpireAt, VaryHeaders: headers}); err == nil {
+			if err = t.Storage.Set(ctx, variantKey(key, cached.Vary), value, ttl); err == nil {
+				err = t.Storage.Set(ctx, key, index, ttl)
+			}
+		}
+	} else if err == nil {
+		err = t.Storage.Set(ctx, key, value, ttl)
+	}
+	if err != nil {
+		mylog.WithWarn(ctx, gopkg.LogHttp, map[string]interface{}{
+			"req_url": key,
+			"err":     err.Error(),
+		}, "写入http缓存失败")
+	}
+}
+
+// log 使用发起请求的Manager的调试日志配置记录缓存结果
+func (t *CacheTransport) log(ctx context.Context, req *http.Request, result string) {
+	client.ContextDebugLogger(ctx).LogEvent(ctx, req, map[string]interface{}{
+		"cache": result,
+	}, fmt.Sprintf("http缓存%s", result))
+}
+
+// cacheKey 缓存key为请求地址，带身份的请求追加身份请求头的摘要，不同身份的缓存互相隔离
+func cacheKey(req *http.Request) string {
+	key := req.URL.String()
+	if !hasCredentials(req.Header) {
+		return key
+	}
+	h := sha256.New()
+	for _, name := range credentialHeaders {
+		// 签名每次请求都不同，只用来判断是否带身份
+		if name == auth.HeaderSignature {
+			continue
+		}
+		h.Write([]byte(name + ":" + strings.Join(req.Header.Values(name), ",") + "\n"))
+	}
+	return key + "#" + hex.EncodeToString(h.Sum(nil))
+}
+
+// variantKey Vary请求头的值对应的缓存key
+func variantKey(key string, vary map[string]string) string {
+	values := make(url.Values, len(vary))
+	for h, v := range vary {
+		values.Set(h, v)
+	}
+	return key + "|" + values.Encode()
+}
+
+func hasCredentials(header http.Header) bool {
+	for _, name := range credentialHeaders {
+		if header.Get(name) != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// response 根据缓存构造响应
+func (c *cachedResponse) response(req *http.Request, result string) *http.Response {
+	header := c.Header.Clone()
+	header.Set(CacheHeader, result)
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", c.StatusCode, http.StatusText(c.StatusCode)),
+		StatusCode:    c.StatusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(c.Body)),
+		ContentLength: int64(len(c.Body)),
+		Request:       req,
+	}
+}
+
+// freshness 响应的有效期，优先使用max-age，其次Expires；no-cache时为0
+func freshness(header http.Header) time.Duration {
+	cc := parseCacheControl(header.Get("Cache-Control"))
+	if _, ok := cc["no-cache"]; ok {
+		return 0
+	}
+	if v, ok := cc["max-age"]; ok {
+		seconds, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return 0
+		}
+		age, _ := strconv.ParseInt(header.Get("Age"), 10, 64)
+		return time.Duration(seconds-age) * time.Second
+	}
+	if expires := header.Get("Expires"); expires != "" {
+		expireAt, err := http.ParseTime(expires)
+		if err != nil {
+			return 0
+		}
+		date := time.Now()
+		if d, dErr := http.ParseTime(header.Get("Date")); dErr == nil {
+			date = d
+		}
+		return expireAt.Sub(date)
+	}
+	return 0
+}
+
+// parseCacheControl 解析Cache-Control，指令名转为小写
+func parseCacheControl(s string) map[string]string {
+	cc := make(map[string]string)
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		name, value, _ := strings.Cut(part, "=")
+		cc[strings.ToLower(strings.TrimSpace(name))] = strings.Trim(strings.TrimSpace(value), `"`)
+	}
+	return cc
+}
+
+// varyValues 记录Vary指定的请求头的值
+func varyValues(respHeader, reqHeader http.Header) map[string]string {
+	vary := respHeader.Values("Vary")
+	if len(vary) == 0 {
+		return nil
+	}
+	values := make(map[string]string)
+	for _, v := range vary {
+		for _, h := range strings.Split(v, ",") {
+			if h = strings.TrimSpace(h); h != "" {
+				values[http.CanonicalHeaderKey(h)] = reqHeader.Get(h)
+			}
+		}
+	}
+	return values
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
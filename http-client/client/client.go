@@ -6,11 +6,8 @@ import (
 	jsoniter "github.com/json-iterator/go"
 	"github.com/youchuangcd/gopkg"
 	"github.com/youchuangcd/gopkg/common/utils"
-	"github.com/youchuangcd/gopkg/mylog"
 	"io"
 	"net/http"
-	"net/http/httptrace"
-	"net/http/httputil"
 	"net/url"
 	"strings"
 	"time"
@@ -20,24 +17,21 @@ var (
 	// UserAgent UA
 	UserAgent = "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/109.0.0.0 Safari/537.36"
 	// DefaultClient 默认Client
-	DefaultClient = Client{&http.Client{Transport: http.DefaultTransport}}
-	// DebugMode 用来打印调试信息
+	DefaultClient = Client{Client: &http.Client{Transport: http.DefaultTransport}}
+	// DebugMode 用来打印调试信息，Client.Debug为nil时生效
 	DebugMode = gopkg.HttpClientDebugMode
-	// DeepDebugInfo 调试信息
-	DeepDebugInfo      = gopkg.HttpClientDeepDebugInfo
-	insReqStartTimeKey = reqStartTimeKey{}
-	insReqUrlKey       = reqUrlKey{}
-	json               = jsoniter.ConfigCompatibleWithStandardLibrary
+	// DeepDebugInfo 调试信息是否包含请求头和请求体，Client.Debug为nil时生效
+	DeepDebugInfo = gopkg.HttpClientDeepDebugInfo
+	json          = jsoniter.ConfigCompatibleWithStandardLibrary
 )
 
-type reqStartTimeKey struct{}
-type reqUrlKey struct{}
-
 // --------------------------------------------------------------------
 
 // Client 负责发送HTTP请求
 type Client struct {
 	*http.Client
+	// Debug 调试日志配置，为nil时按DebugMode
+	Debug *DebugLogger
 }
 
 // WithTraceId 把traceId加入context中
@@ -161,27 +155,21 @@ func (r Client) Do(ctx context.Context, req *http.Request) (resp *http.Response,
 			req.Header.Set(key, val)
 		}
 	}
-	//var newCtx = ctx
-	//// http请求的话，要提取request里面的上下文才可以获取到b3请求头
-	//if ginCtx, ok := ctx.Value(gin.ContextKey).(*gin.Context); ok {
-	//	newCtx = ginCtx.Request.Context()
-	//}
-	// 把上游传递过来的追踪参数从上下文中提取出来注入到请求中
-	//otel.GetTextMapPropagator().Inject(newCtx, propagation.HeaderCarrier(req.Header))
-	if DebugMode {
-		trace := &httptrace.ClientTrace{
-			//GotConn: func(connInfo httptrace.GotConnInfo) {
-			//	remoteAddr := connInfo.Conn.RemoteAddr()
-			//	mylog.Info(ctx, LogCategoryHttp, fmt.Sprintf("Network: %s, Remote ip:%s, URL: %s", remoteAddr.Network(), remoteAddr.String(), req.URL))
-			//},
-		}
-		req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
-		bs, bErr := httputil.DumpRequest(req, DeepDebugInfo)
-		if bErr != nil {
-			err = bErr
-			return
-		}
-		mylog.Info(ctx, gopkg.LogHttp, string(bs))
+	// 创建客户端span，把追踪参数注入到请求中
+	span := startSpan(ctx, req)
+	defer func() {
+		endSpan(span, resp, err)
+	}()
+	var (
+		startTime time.Time
+		reqBody   []byte
+	)
+	debug := r.debugLogger()
+	// Transport中间件通过ContextDebugLogger使用同一个调试日志配置
+	req = req.WithContext(context.WithValue(req.Context(), debugLoggerKey{}, debug))
+	if debug != nil {
+		startTime = time.Now()
+		reqBody = debug.requestBody(req)
 	}
 
 	transport := r.Transport // don't change r.Transport
@@ -214,6 +202,13 @@ func (r Client) Do(ctx context.Context, req *http.Request) (resp *http.Response,
 	} else {
 		resp, err = r.Client.Do(req)
 	}
+	if debug != nil {
+		if err != nil {
+			debug.log(ctx, req, reqBody, nil, nil, 0, startTime, err)
+		} else {
+			debug.wrapResponse(ctx, req, reqBody, resp, startTime)
+		}
+	}
 	return
 }
 
@@ -282,29 +277,6 @@ func CallRet(ctx context.Context, ret interface{}, resp *http.Response) (err err
 		resp.Body.Close()
 	}()
 
-	if DebugMode {
-		var (
-			latencyTime time.Duration
-			reqUrl      string
-		)
-		if startTime, ok := ctx.Value(insReqStartTimeKey).(time.Time); ok {
-			// 执行时间
-			latencyTime = time.Since(startTime)
-		}
-		if url, ok := ctx.Value(insReqUrlKey).(string); ok {
-			reqUrl = url
-		}
-		bs, dErr := httputil.DumpResponse(resp, DeepDebugInfo)
-		if dErr != nil {
-			err = dErr
-			return
-		}
-		mylog.WithInfo(ctx, gopkg.LogHttp, map[string]interface{}{
-			"latency_time_str": latencyTime.String(),
-			"latency_time":     float64(latencyTime.Nanoseconds()) / 1e6,
-			"req_url":          reqUrl,
-		}, string(bs))
-	}
 	if resp.StatusCode/100 == 2 {
 		if ret != nil && resp.ContentLength != 0 {
 			err = json.NewDecoder(resp.Body).Decode(ret)
@@ -325,29 +297,6 @@ func CallRetResp(ctx context.Context, retBuf *bytes.Buffer, resp *http.Response)
 		io.Copy(io.Discard, resp.Body)
 		resp.Body.Close()
 	}()
-	if DebugMode {
-		var (
-			latencyTime time.Duration
-			reqUrl      string
-		)
-		if startTime, ok := ctx.Value(insReqStartTimeKey).(time.Time); ok {
-			// 执行时间
-			latencyTime = time.Since(startTime)
-		}
-		if url, ok := ctx.Value(insReqUrlKey).(string); ok {
-			reqUrl = url
-		}
-		bs, dErr := httputil.DumpResponse(resp, DeepDebugInfo)
-		if dErr != nil {
-			err = dErr
-			return
-		}
-		mylog.WithInfo(ctx, gopkg.LogHttp, map[string]interface{}{
-			"latency_time_str": latencyTime.String(),
-			"latency_time":     float64(latencyTime.Nanoseconds()) / 1e6,
-			"req_url":          reqUrl,
-		}, string(bs))
-	}
 	if resp.StatusCode/100 == 2 {
 		if retBuf != nil && resp.ContentLength != 0 {
 			_, err = io.Copy(retBuf, resp.Body)
@@ -365,10 +314,6 @@ func CallRetResp(ctx context.Context, retBuf *bytes.Buffer, resp *http.Response)
 // CallWithJson JSON请求
 func (r Client) CallWithJson(ctx context.Context, ret interface{}, method, reqUrl string, headers http.Header,
 	param interface{}) (err error) {
-	if DebugMode {
-		ctx = context.WithValue(ctx, insReqStartTimeKey, time.Now())
-		ctx = context.WithValue(ctx, insReqUrlKey, reqUrl)
-	}
 	resp, err := r.DoRequestWithJson(ctx, method, reqUrl, headers, param)
 	if err != nil {
 		return err
@@ -379,10 +324,6 @@ func (r Client) CallWithJson(ctx context.Context, ret interface{}, method, reqUr
 // CallWithForm Form请求
 func (r Client) CallWithForm(ctx context.Context, ret interface{}, method, reqUrl string, headers http.Header,
 	param interface{}) (err error) {
-	if DebugMode {
-		ctx = context.WithValue(ctx, insReqStartTimeKey, time.Now())
-		ctx = context.WithValue(ctx, insReqUrlKey, reqUrl)
-	}
 	resp, err := r.DoRequestWithForm(ctx, method, reqUrl, headers, param)
 	if err != nil {
 		return err
@@ -393,10 +334,6 @@ func (r Client) CallWithForm(ctx context.Context, ret interface{}, method, reqUr
 // CallWithJsonReturnResp JSON请求返回resp
 func (r Client) CallWithJsonReturnResp(ctx context.Context, retBuf *bytes.Buffer, method, reqUrl string, headers http.Header,
 	param interface{}) (err error) {
-	if DebugMode {
-		ctx = context.WithValue(ctx, insReqStartTimeKey, time.Now())
-		ctx = context.WithValue(ctx, insReqUrlKey, reqUrl)
-	}
 	resp, err := r.DoRequestWithJson(ctx, method, reqUrl, headers, param)
 	if err != nil {
 		return err
@@ -419,10 +356,6 @@ func (r Client) DoRequestWith64(ctx context.Context, method, reqUrl string, head
 // CallWith64 请求
 func (r Client) CallWith64(ctx context.Context, ret interface{}, method, reqUrl string, headers http.Header, body io.Reader,
 	bodyLength int64) (err error) {
-	if DebugMode {
-		ctx = context.WithValue(ctx, insReqStartTimeKey, time.Now())
-		ctx = context.WithValue(ctx, insReqUrlKey, reqUrl)
-	}
 	resp, err := r.DoRequestWith64(ctx, method, reqUrl, headers, body, bodyLength)
 	if err != nil {
 		return err
@@ -0,0 +1,335 @@
+package client
+
+import (
+	"context"
+	"github.com/youchuangcd/gopkg"
+	"github.com/youchuangcd/gopkg/mylog"
+	"go.opentelemetry.io/contrib/propagators/b3"
+	"go.opentelemetry.io/otel"
+	tracesdk "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	mylog.InitLog()
+	os.Exit(m.Run())
+}
+
+func TestDoSpan(t *testing.T) {
+	var header http.Header
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header.Clone()
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer srv.Close()
+
+	// 未初始化TracerProvider时保持原有的请求头透传
+	ctx := context.WithValue(context.Background(), gopkg.RequestB3HeaderTraceIdKey, "463ac35c9f6413ad48485a3953bb6124")
+	ctx = context.WithValue(ctx, gopkg.RequestB3HeaderSpanIdKey, "a2fb4a1d1a96d312")
+	ctx = context.WithValue(ctx, gopkg.RequestB3HeaderSampledKey, "1")
+	ctx = WithTraceId(ctx, "trace-1")
+	if err := DefaultClient.CallWithJson(ctx, nil, http.MethodGet, srv.URL, nil, nil); err == nil {
+		t.Fatal("404应该返回错误")
+	}
+	if header.Get(gopkg.RequestB3HeaderSpanIdKey) != "a2fb4a1d1a96d312" || header.Get(gopkg.RequestHeaderTraceIdKey) != "trace-1" {
+		t.Errorf("应该透传上下文里的请求头，实际%v", header)
+	}
+
+	exporter := tracetest.NewInMemoryExporter()
+	tp := tracesdk.NewTracerProvider(tracesdk.WithSyncer(exporter))
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(b3.New(b3.WithInjectEncoding(b3.B3MultipleHeader)))
+	defer otel.SetTracerProvider(trace.NewNoopTracerProvider())
+
+	DefaultClient.CallWithJson(ctx, nil, http.MethodGet, srv.URL, nil, nil)
+	spans := exporter.GetSpans()
+	if len(spans) != 1 {
+		t.Fatalf("应该记录1个span，实际%d", len(spans))
+	}
+	span := spans[0]
+	if span.SpanKind != trace.SpanKindClient || span.Parent.SpanID().String() != "a2fb4a1d1a96d312" {
+		t.Errorf("span应该是上游B3 span的子span，实际parent %s", span.Parent.SpanID())
+	}
+	if header.Get(gopkg.RequestB3HeaderTraceIdKey) != "463ac35c9f6413ad48485a3953bb6124" ||
+		header.Get(gopkg.RequestB3HeaderSpanIdKey) != span.SpanContext.SpanID().String() {
+		t.Errorf("请求头应该注入新span，实际%v", header)
+	}
+	if span.Status.Code.String() != "Error" {
+		t.Errorf("404应该标记为错误，实际%s", span.Status.Code)
+	}
+}
+
+func TestCallJson(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"id":1,"name":"a"}`))
+	}))
+	defer srv.Close()
+
+	type item struct {
+		Id   int    `json:"id"`
+		Name string `json:"name"`
+	}
+	ctx := context.Background()
+	ret, err := CallJson[item](ctx, DefaultClient, http.MethodGet, srv.URL, nil, nil)
+	if err != nil || ret.Id != 1 || ret.Name != "a" {
+		t.Errorf("解析结果%+v，err %v", ret, err)
+	}
+	ptr, err := CallForm[*item](ctx, DefaultClient, http.MethodGet, srv.URL, nil, map[string]any{"id": 1})
+	if err != nil || ptr == nil || ptr.Id != 1 {
+		t.Errorf("解析结果%+v，err %v", ptr, err)
+	}
+	bs, err := CallJsonBytes(ctx, DefaultClient, http.MethodPost, srv.URL, nil, nil)
+	if err != nil || string(bs) != `{"id":1,"name":"a"}` {
+		t.Errorf("原始响应%s，err %v", bs, err)
+	}
+}
+
+func TestCallJsonEnvelope(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/ok":
+			w.Write([]byte(`{"code":0,"msg":"","data":{"id":1}}`))
+		case "/fail":
+			w.Write([]byte(`{"code":10005,"msg":"无效的参数","data":{}}`))
+		case "/merchant":
+			w.Write([]byte(`{"code":1,"success":false,"message":"商户不存在","serial_no":"x","data":{},"timestamp":1}`))
+		}
+	}))
+	defer srv.Close()
+
+	ctx := context.Background()
+	ret, err := CallJsonEnvelope[map[string]int](ctx, DefaultClient, EnvelopeToJson, http.MethodGet, srv.URL+"/ok", nil, nil)
+	if err != nil || ret["id"] != 1 {
+		t.Errorf("解析data失败%v，err %v", ret, err)
+	}
+	_, err = CallJsonEnvelope[map[string]int](ctx, DefaultClient, EnvelopeToJson, http.MethodGet, srv.URL+"/fail", nil, nil)
+	if e, ok := err.(*gopkg.Error); !ok || e.GetCode() != 10005 || e.GetMsg() != "无效的参数" {
+		t.Errorf("业务错误应该转为*gopkg.Error，实际%#v", err)
+	}
+	err = DefaultClient.CallWithJsonEnvelope(ctx, EnvelopeMerchantResJson, nil, http.MethodGet, srv.URL+"/merchant", nil, nil)
+	if e, ok := err.(*gopkg.Error); !ok || e.GetCode() != 1 || e.GetMsg() != "商户不存在" {
+		t.Errorf("商户响应错误应该转为*gopkg.Error，实际%#v", err)
+	}
+}
+
+func TestDebugLoggerRedact(t *testing.T) {
+	l := NewDebugLogger(true)
+	l.BodyLimit = 60
+	req := httptest.NewRequest(http.MethodPost, "https://api.example.com/x?access_token=abc&id=1", nil)
+	req.Header.Set("Authorization", "Bearer abc")
+	if u := l.redactUrl(req.URL); strings.Contains(u, "abc") || !strings.Contains(u, "id=1") {
+		t.Errorf("url参数应该脱敏: %s", u)
+	}
+	if h := l.redactHeader(req.Header); h.Get("Authorization") != RedactedValue || req.Header.Get("Authorization") != "Bearer abc" {
+		t.Errorf("请求头应该脱敏且不修改原请求: %v", h)
+	}
+	body := l.formatBody("application/json", []byte(`{"user":{"name":"a","Password":"abc"}}`))
+	if strings.Contains(body, "abc") || !strings.Contains(body, `"name":"a"`) {
+		t.Errorf("JSON字段应该脱敏: %s", body)
+	}
+	body = l.formatBody("application/x-www-form-urlencoded", []byte("sign=abc&data="+strings.Repeat("x", 100)))
+	if strings.Contains(body, "abc") || len(body) > 80 {
+		t.Errorf("form参数应该脱敏并截断: %s", body)
+	}
+
+	// 单独关闭调试日志
+	if (Client{Client: http.DefaultClient, Debug: NewDebugLogger(false)}).debugLogger() != nil {
+		t.Error("Debug.Enable为false时不应该记录日志")
+	}
+}
+
+func TestCallWithMultipart(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseMultipartForm(1 << 20); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		f, header, err := r.FormFile("file")
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		content, _ := io.ReadAll(f)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"type":           r.FormValue("type"),
+			"filename":       header.Filename,
+			"content":        string(content),
+			"content_length": r.ContentLength,
+		})
+	}))
+	defer srv.Close()
+
+	m := NewMultipart().AddField("type", "export").AddFile("file", "a.csv", strings.NewReader("id,name\n1,a\n"))
+	var ret map[string]interface{}
+	if err := DefaultClient.CallWithMultipart(context.Background(), &ret, http.MethodPost, srv.URL, nil, m); err != nil {
+		t.Fatal(err)
+	}
+	if ret["type"] != "export" || ret["filename"] != "a.csv" || ret["content"] != "id,name\n1,a\n" ||
+		ret["content_length"] != float64(m.ContentLength()) {
+		t.Errorf("multipart内容不一致: %v", ret)
+	}
+}
+
+func TestDownloadResume(t *testing.T) {
+	content := strings.Repeat("0123456789", 10000)
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// 第一次请求只返回一半内容后断开
+		if atomic.AddInt32(&requests, 1) == 1 {
+			w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+			w.Write([]byte(content[:len(content)/2]))
+			w.(http.Flusher).Flush()
+			panic(http.ErrAbortHandler)
+		}
+		w.Header().Set("ETag", `"v1"`)
+		http.ServeContent(w, r, "a.txt", time.Time{}, strings.NewReader(content))
+	}))
+	defer srv.Close()
+
+	var lastWritten, lastTotal int64
+	path := filepath.Join(t.TempDir(), "a.txt")
+	written, err := DefaultClient.DownloadFile(context.Background(), srv.URL, path, func(option DownloadOption) DownloadOption {
+		option.ResumeDelay = time.Millisecond
+		option.Progress = func(written, total int64) {
+			lastWritten, lastTotal = written, total
+		}
+		return option
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := os.ReadFile(path)
+	if written != int64(len(content)) || string(data) != content || requests != 2 {
+		t.Errorf("续传后内容不一致，写入%d，请求%d次", written, requests)
+	}
+	if lastWritten != written || lastTotal != written {
+		t.Errorf("进度回调不正确 %d/%d", lastWritten, lastTotal)
+	}
+}
+
+func TestDownloadFileStalePart(t *testing.T) {
+	content := strings.Repeat("abcdefghij", 1000)
+	var ranges []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ranges = append(ranges, r.Header.Get("Range"))
+		w.Header().Set("ETag", `"v2"`)
+		http.ServeContent(w, r, "a.txt", time.Time{}, strings.NewReader(content))
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	cases := []struct {
+		name string
+		part string
+		meta string
+	}{
+		// 上次下载后文件已变化，If-Range不一致返回完整内容
+		{name: "changed", part: strings.Repeat("0", 5000), meta: `"v1"`},
+		// 没有保存的validator，不使用Range
+		{name: "no_meta", part: strings.Repeat("0", 5000)},
+		// 已下载的内容比服务端的文件还长，返回416后重新下载
+		{name: "too_long", part: strings.Repeat("0", 20000), meta: `"v2"`},
+	}
+	for _, c := range cases {
+		ranges = nil
+		path := filepath.Join(dir, c.name)
+		os.WriteFile(path+".part", []byte(c.part), 0644)
+		if c.meta != "" {
+			os.WriteFile(path+".part.meta", []byte(c.meta), 0644)
+		}
+		written, err := DefaultClient.DownloadFile(context.Background(), srv.URL, path)
+		data, _ := os.ReadFile(path)
+		if err != nil || written != int64(len(content)) || string(data) != content {
+			t.Errorf("%s: 应该下载完整的新内容，写入%d err %v", c.name, written, err)
+		}
+		if c.meta == "" && (len(ranges) != 1 || ranges[0] != "") {
+			t.Errorf("%s: 没有validator时不应该续传 %v", c.name, ranges)
+		}
+		if _, err = os.Stat(path + ".part.meta"); !os.IsNotExist(err) {
+			t.Errorf("%s: 下载完成后应该删除meta文件", c.name)
+		}
+	}
+}
+
+func TestStreamSSE(t *testing.T) {
+	var lastEventIds []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lastEventIds = append(lastEventIds, r.Header.Get("Last-Event-ID"))
+		w.Header().Set("Content-Type", "text/event-stream")
+		if r.Header.Get("Last-Event-ID") == "" {
+			io.WriteString(w, ": ping\n\nid: 1\ndata: a\n\nid: 2\nevent: progress\ndata: b\ndata: c\n\n")
+			w.(http.Flusher).Flush()
+			// 不再发送数据，触发心跳超时
+			<-r.Context().Done()
+			return
+		}
+		io.WriteString(w, "id: 3\ndata: {\"done\":true}\n\n")
+	}))
+	defer srv.Close()
+
+	s, err := DefaultClient.Stream(context.Background(), http.MethodGet, srv.URL, nil, nil, func(option StreamOption) StreamOption {
+		option.HeartbeatTimeout = 50 * time.Millisecond
+		option.ReconnectDelay = time.Millisecond
+		return option
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	var events []Event
+	for s.Next() {
+		events = append(events, s.Event())
+	}
+	if s.Err() != nil {
+		t.Fatal(s.Err())
+	}
+	if len(events) != 3 || events[1].Event != "progress" || events[1].Data != "b\nc" || events[2].Id != "3" {
+		t.Fatalf("消息不一致 %+v", events)
+	}
+	var ret map[string]bool
+	if err = s.Decode(&ret); err != nil || !ret["done"] {
+		t.Errorf("解析消息失败 %v %v", ret, err)
+	}
+	if len(lastEventIds) != 2 || lastEventIds[1] != "2" {
+		t.Errorf("重连应该携带Last-Event-ID %v", lastEventIds)
+	}
+}
+
+func TestStreamNDJSON(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		io.WriteString(w, "{\"n\":1}\n\n{\"n\":2}\r\n{\"n\":3}")
+	}))
+	defer srv.Close()
+
+	s, err := DefaultClient.Stream(context.Background(), http.MethodPost, srv.URL, nil, map[string]string{"q": "x"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	sum := 0
+	for s.Next() {
+		var v map[string]int
+		if err = s.Decode(&v); err != nil {
+			t.Fatal(err)
+		}
+		sum += v["n"]
+	}
+	if s.Err() != nil || sum != 6 {
+		t.Errorf("NDJSON读取不一致 sum %d err %v", sum, s.Err())
+	}
+}
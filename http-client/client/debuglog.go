@@ -0,0 +1,285 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"github.com/youchuangcd/gopkg"
+	"github.com/youchuangcd/gopkg/common/utils"
+	"github.com/youchuangcd/gopkg/mylog"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RedactedValue 脱敏后的内容
+const RedactedValue = "[REDACTED]"
+
+// maxCaptureBodySize 调试日志最多读取的请求体、响应体长度，超过的部分不参与脱敏直接截断
+const maxCaptureBodySize = 1 << 20
+
+var (
+	// DefaultRedactHeaders 默认脱敏的请求头和响应头
+	DefaultRedactHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie", "X-Signature"}
+	// DefaultRedactQueryParams 默认脱敏的url参数和form参数
+	DefaultRedactQueryParams = []string{"access_token", "token", "secret", "client_secret", "password", "sign"}
+	// DefaultRedactJsonFields 默认脱敏的JSON字段，任意层级匹配
+	DefaultRedactJsonFields = []string{"password", "secret", "client_secret", "access_token", "refresh_token", "token"}
+)
+
+// DebugLogger 请求调试日志，记录请求方法、地址、状态码、耗时、大小以及截断脱敏后的请求头和请求体
+type DebugLogger struct {
+	// Enable 是否记录调试日志
+	Enable bool
+	// LogBody 是否记录请求头和请求体、响应头和响应体
+	LogBody bool
+	// BodyLimit 请求体、响应体截断长度，默认gopkg.LogLimitContentLength
+	BodyLimit uint
+	// RedactHeaders 脱敏的请求头和响应头，不区分大小写
+	RedactHeaders []string
+	// RedactQueryParams 脱敏的url参数和form参数，不区分大小写
+	RedactQueryParams []string
+	// RedactJsonFields 脱敏的JSON字段，不区分大小写
+	RedactJsonFields []string
+}
+
+// NewDebugLogger
+// @Description: 创建调试日志，使用默认的脱敏配置
+// @param enable
+// @return *DebugLogger
+func NewDebugLogger(enable bool) *DebugLogger {
+	return &DebugLogger{
+		Enable:            enable,
+		LogBody:           true,
+		RedactHeaders:     DefaultRedactHeaders,
+		RedactQueryParams: DefaultRedactQueryParams,
+		RedactJsonFields:  DefaultRedactJsonFields,
+	}
+}
+
+type debugLoggerKey struct{}
+
+// ContextDebugLogger
+// @Description: 获取发起请求的Client使用的调试日志，供Transport中间件记录日志；不是通过Client发起的请求按DebugMode
+// @param ctx 请求的context
+// @return *DebugLogger 为nil时不记录
+func ContextDebugLogger(ctx context.Context) *DebugLogger {
+	if l, ok := ctx.Value(debugLoggerKey{}).(*DebugLogger); ok {
+		return l
+	}
+	return Client{}.debugLogger()
+}
+
+// LogEvent
+// @Description: 记录请求过程中的调试事件，地址按配置脱敏
+// @receiver l
+// @param ctx
+// @param req
+// @param fields 额外的日志字段
+// @param msg
+func (l *DebugLogger) LogEvent(ctx context.Context, req *http.Request, fields map[string]interface{}, msg string) {
+	if l == nil || !l.Enable {
+		return
+	}
+	logFields := map[string]interface{}{
+		"method":  req.Method,
+		"req_url": l.redactUrl(req.URL),
+	}
+	for k, v := range fields {
+		logFields[k] = v
+	}
+	mylog.WithInfo(ctx, gopkg.LogHttp, logFields, msg)
+}
+
+// debugLogger 优先使用Client的配置，未配置时按DebugMode、DeepDebugInfo
+func (r Client) debugLogger() *DebugLogger {
+	if r.Debug != nil {
+		if !r.Debug.Enable {
+			return nil
+		}
+		return r.Debug
+	}
+	if !DebugMode {
+		return nil
+	}
+	l := NewDebugLogger(true)
+	l.LogBody = DeepDebugInfo
+	return l
+}
+
+// requestBody 通过GetBody读取请求体副本，不影响发送
+func (l *DebugLogger) requestBody(req *http.Request) []byte {
+	if !l.LogBody || req.GetBody == nil {
+		return nil
+	}
+	body, err := req.GetBody()
+	if err != nil {
+		return nil
+	}
+	defer body.Close()
+	b, _ := io.ReadAll(io.LimitReader(body, maxCaptureBodySize))
+	return b
+}
+
+// log 记录一次请求，resp为nil时表示请求失败
+func (l *DebugLogger) log(ctx context.Context, req *http.Request, reqBody []byte, resp *http.Response, respBody []byte,
+	respSize int64, startTime time.Time, err error) {
+	latencyTime := time.Since(startTime)
+	fields := map[string]interface{}{
+		"method":           req.Method,
+		"req_url":          l.redactUrl(req.URL),
+		"req_size":         req.ContentLength,
+		"latency_time_str": latencyTime.String(),
+		"latency_time":     float64(latencyTime.Nanoseconds()) / 1e6,
+	}
+	if l.LogBody {
+		fields["req_header"] = l.redactHeader(req.Header)
+		fields["req_body"] = l.formatBody(req.Header.Get("Content-Type"), reqBody)
+	}
+	if resp != nil {
+		fields["status"] = resp.StatusCode
+		fields["resp_size"] = respSize
+		if l.LogBody {
+			fields["resp_header"] = l.redactHeader(resp.Header)
+			fields["resp_body"] = l.formatBody(resp.Header.Get("Content-Type"), respBody)
+		}
+	}
+	if err != nil {
+		fields["err"] = err.Error()
+		mylog.WithWarn(ctx, gopkg.LogHttp, fields, "http请求失败")
+		return
+	}
+	mylog.WithInfo(ctx, gopkg.LogHttp, fields, "http请求")
+}
+
+func (l *DebugLogger) redactUrl(u *url.URL) string {
+	if u.RawQuery == "" {
+		return u.String()
+	}
+	c := *u
+	c.RawQuery = l.redactValues(u.RawQuery)
+	return c.String()
+}
+
+// redactValues 脱敏url编码的参数，无法解析时原样返回
+func (l *DebugLogger) redactValues(raw string) string {
+	values, err := url.ParseQuery(raw)
+	if err != nil {
+		return raw
+	}
+	changed := false
+	for key := range values {
+		if containsFold(l.RedactQueryParams, key) {
+			values[key] = []string{RedactedValue}
+			changed = true
+		}
+	}
+	if !changed {
+		return raw
+	}
+	return values.Encode()
+}
+
+func (l *DebugLogger) redactHeader(header http.Header) http.Header {
+	header = header.Clone()
+	for key := range header {
+		if containsFold(l.RedactHeaders, key) {
+			header[key] = []string{RedactedValue}
+		}
+	}
+	return header
+}
+
+// formatBody 按内容类型脱敏后截断
+func (l *DebugLogger) formatBody(contentType string, body []byte) string {
+	if len(body) == 0 {
+		return ""
+	}
+	s := string(body)
+	switch {
+	case strings.Contains(contentType, "json"):
+		var v interface{}
+		if json.Unmarshal(body, &v) == nil {
+			if b, err := json.Marshal(l.redactJson(v)); err == nil {
+				s = string(b)
+			}
+		}
+	case strings.HasPrefix(contentType, "application/x-www-form-urlencoded"):
+		s = l.redactValues(s)
+	}
+	limit := l.BodyLimit
+	if limit == 0 {
+		limit = gopkg.LogLimitContentLength
+	}
+	return utils.CutStr(s, limit, gopkg.LogLimitContentReplaceWord)
+}
+
+func (l *DebugLogger) redactJson(v interface{}) interface{} {
+	switch val := v.(type) {
+	case map[string]interface{}:
+		for key, item := range val {
+			if containsFold(l.RedactJsonFields, key) {
+				val[key] = RedactedValue
+			} else {
+				val[key] = l.redactJson(item)
+			}
+		}
+	case []interface{}:
+		for i, item := range val {
+			val[i] = l.redactJson(item)
+		}
+	}
+	return v
+}
+
+func containsFold(list []string, s string) bool {
+	for _, v := range list {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// debugBody 读取响应体时保留前maxCaptureBodySize字节，关闭时记录日志
+type debugBody struct {
+	io.ReadCloser
+	capture bool
+	once    sync.Once
+	buf     bytes.Buffer
+	size    int64
+	onClose func(body []byte, size int64)
+}
+
+func (b *debugBody) Read(p []byte) (n int, err error) {
+	n, err = b.ReadCloser.Read(p)
+	b.size += int64(n)
+	if remain := maxCaptureBodySize - b.buf.Len(); b.capture && remain > 0 {
+		if n < remain {
+			remain = n
+		}
+		b.buf.Write(p[:remain])
+	}
+	return
+}
+
+func (b *debugBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(func() {
+		b.onClose(b.buf.Bytes(), b.size)
+	})
+	return err
+}
+
+// wrapResponse 响应体关闭时记录日志，不会提前读取响应体，流式响应同样适用
+func (l *DebugLogger) wrapResponse(ctx context.Context, req *http.Request, reqBody []byte, resp *http.Response, startTime time.Time) {
+	resp.Body = &debugBody{
+		ReadCloser: resp.Body,
+		capture:    l.LogBody,
+		onClose: func(body []byte, size int64) {
+			l.log(ctx, req, reqBody, resp, body, size, startTime, nil)
+		},
+	}
+}
@@ -0,0 +1,329 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/youchuangcd/gopkg"
+	"github.com/youchuangcd/gopkg/mylog"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrRangeNotSupported 服务端不支持Range请求，写入io.Writer的下载无法续传
+	ErrRangeNotSupported = errors.New("httpclient: server does not support range requests")
+	// ErrUnexpectedContentRange 服务端返回的Content-Range与已下载的长度不一致
+	ErrUnexpectedContentRange = errors.New("httpclient: unexpected content range")
+)
+
+// DownloadOption 下载配置
+type DownloadOption struct {
+	// Headers 请求头
+	Headers http.Header
+	// Timeout 整个下载的超时时间，默认0不限制，由ctx控制；Client本身的超时对下载不生效
+	Timeout time.Duration
+	// MaxResumes 下载中断后最多续传的次数
+	MaxResumes int
+	// ResumeDelay 续传前等待的时间
+	ResumeDelay time.Duration
+	// Progress 进度回调，total未知时为-1
+	Progress func(written, total int64)
+}
+
+// SetDownloadOptionFunc 设置下载配置的方法
+type SetDownloadOptionFunc func(option DownloadOption) DownloadOption
+
+func newDownloadOption(optionFuncs []SetDownloadOptionFunc) DownloadOption {
+	option := DownloadOption{
+		MaxResumes:  3,
+		ResumeDelay: time.Second,
+	}
+	for _, optionFunc := range optionFuncs {
+		option = optionFunc(option)
+	}
+	return option
+}
+
+// Download
+// @Description: GET下载并流式写入w，中断后使用Range续传；服务端不支持Range时返回ErrRangeNotSupported
+// @receiver r
+// @param ctx
+// @param reqUrl
+// @param w
+// @param optionFuncs
+// @return written 写入的字节数
+// @return err
+func (r Client) Download(ctx context.Context, reqUrl string, w io.Writer, optionFuncs ...SetDownloadOptionFunc) (written int64, err error) {
+	return r.download(ctx, reqUrl, w, 0, nil, newDownloadOption(optionFuncs))
+}
+
+// downloadFile 续传本地文件需要的状态
+type downloadFile struct {
+	// validator 上次下载时保存的ETag或Last-Modified，续传时作为If-Range
+	validator string
+	// reset 服务端返回完整内容或已下载的内容无效时，清空后从头写入
+	reset func() error
+	// saveValidator 得到新的validator时保存，下次续传使用
+	saveValidator func(validator string) error
+}
+
+// DownloadFile
+// @Description: 下载到本地文件，先写入 path.part，完成后重命名；path.part 已存在时使用 path.part.meta 中保存的
+// ETag或Last-Modified作为If-Range从已下载的位置继续，没有保存的validator时从头下载
+// @receiver r
+// @param ctx
+// @param reqUrl
+// @param path
+// @param optionFuncs
+// @return written 文件大小
+// @return err
+func (r Client) DownloadFile(ctx context.Context, reqUrl, path string, optionFuncs ...SetDownloadOptionFunc) (written int64, err error) {
+	partPath := path + ".part"
+	metaPath := partPath + ".meta"
+	f, err := os.OpenFile(partPath, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return
+	}
+	offset, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		f.Close()
+		return
+	}
+	file := &downloadFile{
+		// 服务端不支持Range、文件已变化或已下载的内容无效时从头下载
+		reset: func() error {
+			if err := f.Truncate(0); err != nil {
+				return err
+			}
+			if _, err := f.Seek(0, io.SeekStart); err != nil {
+				return err
+			}
+			if err := os.Remove(metaPath); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			return nil
+		},
+		saveValidator: func(validator string) error {
+			if validator == "" {
+				if err := os.Remove(metaPath); err != nil && !os.IsNotExist(err) {
+					return err
+				}
+				return nil
+			}
+			return os.WriteFile(metaPath, []byte(validator), 0644)
+		},
+	}
+	if offset > 0 {
+		// 没有保存的validator无法确认文件没有变化，从头下载
+		if meta, rErr := os.ReadFile(metaPath); rErr == nil {
+			file.validator = strings.TrimSpace(string(meta))
+		}
+		if file.validator == "" {
+			if err = file.reset(); err != nil {
+				f.Close()
+				return
+			}
+			offset = 0
+		}
+	}
+	written, err = r.download(ctx, reqUrl, f, offset, file, newDownloadOption(optionFuncs))
+	if cErr := f.Close(); err == nil {
+		err = cErr
+	}
+	if err != nil {
+		return
+	}
+	if err = os.Rename(partPath, path); err != nil {
+		return
+	}
+	if rErr := os.Remove(metaPath); rErr != nil && !os.IsNotExist(rErr) {
+		err = rErr
+	}
+	return
+}
+
+// download 从offset开始下载，file不为nil时服务端返回完整内容可以从头写入，validator变化时保存
+func (r Client) download(ctx context.Context, reqUrl string, w io.Writer, offset int64, file *downloadFile,
+	option DownloadOption) (written int64, err error) {
+	// 下载不受Client超时限制
+	dl := r.withTimeout(option.Timeout)
+
+	written = offset
+	var (
+		total     int64 = -1
+		validator string
+	)
+	if file != nil {
+		validator = file.validator
+	}
+	for resumes := 0; ; resumes++ {
+		headers := option.Headers.Clone()
+		if headers == nil {
+			headers = http.Header{}
+		}
+		if written > 0 {
+			headers.Set("Range", fmt.Sprintf("bytes=%d-", written))
+			if validator != "" {
+				headers.Set("If-Range", validator)
+			}
+		}
+		var (
+			resp   *http.Response
+			n      int64
+			done   bool
+			rErr   error
+			wErr   error
+			status int
+		)
+		resp, rErr = dl.DoRequestWith(ctx, http.MethodGet, reqUrl, headers, nil, 0)
+		if rErr == nil {
+			status = resp.StatusCode
+			switch {
+			case status == http.StatusPartialContent:
+				var start int64
+				start, total, err = parseContentRange(resp.Header.Get("Content-Range"))
+				if err == nil && start != written {
+					err = ErrUnexpectedContentRange
+				}
+			case status == http.StatusOK:
+				if written > 0 {
+					if file == nil {
+						err = ErrRangeNotSupported
+					} else if err = file.reset(); err == nil {
+						written = 0
+					}
+				}
+				total = resp.ContentLength
+				// 完整内容，使用新的validator
+				validator = responseValidator(resp)
+				if err == nil && file != nil {
+					err = file.saveValidator(validator)
+				}
+			case status == http.StatusRequestedRangeNotSatisfiable && written > 0:
+				// 已经下载完整
+				if _, size, pErr := parseContentRange(resp.Header.Get("Content-Range")); pErr == nil && size == written {
+					done = true
+				} else if file == nil {
+					err = ErrUnexpectedContentRange
+				} else if err = file.reset(); err == nil {
+					// 已下载的内容比服务端的文件还长，清空后重新下载
+					resp.Body.Close()
+					written, validator = 0, ""
+					continue
+				}
+			default:
+				err = ResponseError(resp)
+			}
+			if err != nil || done {
+				resp.Body.Close()
+				return
+			}
+			if validator == "" {
+				validator = responseValidator(resp)
+			}
+			n, rErr, wErr = copyWithProgress(w, resp.Body, written, total, option.Progress)
+			resp.Body.Close()
+			written += n
+			if wErr != nil {
+				return written, wErr
+			}
+			if rErr == nil {
+				if total < 0 || written >= total {
+					return
+				}
+				rErr = io.ErrUnexpectedEOF
+			}
+		}
+		if ctx.Err() != nil {
+			return written, ctx.Err()
+		}
+		if resumes >= option.MaxResumes {
+			return written, rErr
+		}
+		mylog.WithWarn(ctx, gopkg.LogHttp, map[string]interface{}{
+			"req_url": reqUrl,
+			"written": written,
+			"total":   total,
+			"resumes": resumes + 1,
+			"err":     rErr.Error(),
+		}, "下载中断，断点续传")
+		timer := time.NewTimer(option.ResumeDelay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return written, ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// responseValidator 续传使用的validator，优先使用强ETag
+func responseValidator(resp *http.Response) string {
+	if etag := resp.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		return etag
+	}
+	return resp.Header.Get("Last-Modified")
+}
+
+// withTimeout 复制一份使用指定超时时间的Client，共用Transport
+func (r Client) withTimeout(timeout time.Duration) Client {
+	hc := *r.Client
+	hc.Timeout = timeout
+	r.Client = &hc
+	return r
+}
+
+// copyWithProgress 复制并回调进度，分别返回读错误和写错误
+func copyWithProgress(w io.Writer, r io.Reader, offset, total int64, progress func(written, total int64)) (n int64, rErr, wErr error) {
+	buf := make([]byte, 32*1024)
+	for {
+		nr, err := r.Read(buf)
+		if nr > 0 {
+			nw, err := w.Write(buf[:nr])
+			n += int64(nw)
+			if err == nil && nw < nr {
+				err = io.ErrShortWrite
+			}
+			if err != nil {
+				return n, nil, err
+			}
+			if progress != nil {
+				progress(offset+n, total)
+			}
+		}
+		if err == io.EOF {
+			return n, nil, nil
+		}
+		if err != nil {
+			return n, err, nil
+		}
+	}
+}
+
+// parseContentRange 解析 bytes 0-99/200 或 bytes */200，总长度未知时为-1
+func parseContentRange(s string) (start, total int64, err error) {
+	if !strings.HasPrefix(s, "bytes ") {
+		return 0, 0, ErrUnexpectedContentRange
+	}
+	s = strings.TrimPrefix(s, "bytes ")
+	rangePart, totalPart, ok := strings.Cut(s, "/")
+	if !ok {
+		return 0, 0, ErrUnexpectedContentRange
+	}
+	total = -1
+	if totalPart != "*" {
+		if _, err = fmt.Sscanf(totalPart, "%d", &total); err != nil {
+			return 0, 0, ErrUnexpectedContentRange
+		}
+	}
+	if rangePart != "*" {
+		if _, err = fmt.Sscanf(rangePart, "%d-", &start); err != nil {
+			return 0, 0, ErrUnexpectedContentRange
+		}
+	}
+	return start, total, nil
+}
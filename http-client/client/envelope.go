@@ -0,0 +1,112 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	jsoniter "github.com/json-iterator/go"
+	"github.com/youchuangcd/gopkg"
+	"net/http"
+	"strconv"
+)
+
+// Envelope 业务响应的外层结构，code不等于SuccessCode时转为*gopkg.Error
+type Envelope struct {
+	CodeField   string
+	MsgField    string
+	DataField   string
+	SuccessCode int
+}
+
+var (
+	// EnvelopeToJson utils.ToJson的响应结构 {code,msg,data}
+	EnvelopeToJson = Envelope{CodeField: "code", MsgField: "msg", DataField: "data"}
+	// EnvelopeRetJson utils.RetJson的响应结构 {code,success,message,service_time,serial_no,data}
+	EnvelopeRetJson = Envelope{CodeField: "code", MsgField: "message", DataField: "data"}
+	// EnvelopeMerchantResJson utils.MerchantResJson的响应结构 {code,success,message,serial_no,data,timestamp}，失败时code固定为1
+	EnvelopeMerchantResJson = Envelope{CodeField: "code", MsgField: "message", DataField: "data"}
+)
+
+// Decode
+// @Description: 解析响应结构，data解析到ret；业务失败时返回带远端code和msg的*gopkg.Error
+// @receiver e
+// @param body
+// @param ret
+// @return error
+func (e Envelope) Decode(body []byte, ret interface{}) error {
+	var m map[string]jsoniter.RawMessage
+	if err := json.Unmarshal(body, &m); err != nil {
+		return err
+	}
+	rawCode, ok := m[e.CodeField]
+	if !ok {
+		return fmt.Errorf("httpclient: response envelope missing field %q: %s", e.CodeField, body)
+	}
+	code, err := strconv.Atoi(string(bytes.Trim(rawCode, `"`)))
+	if err != nil {
+		return fmt.Errorf("httpclient: invalid envelope code %s", rawCode)
+	}
+	if code != e.SuccessCode {
+		var msg string
+		if rawMsg, ok := m[e.MsgField]; ok {
+			json.Unmarshal(rawMsg, &msg)
+		}
+		return gopkg.NewError(code, msg)
+	}
+	if data, ok := m[e.DataField]; ok && ret != nil && !bytes.Equal(data, []byte("null")) {
+		return json.Unmarshal(data, ret)
+	}
+	return nil
+}
+
+// CallRetEnvelope
+// @Description: 按响应结构解析响应，http状态码非200时同CallRet返回ResponseError
+// @param ctx
+// @param envelope
+// @param ret data解析的目标
+// @param resp
+// @return err
+func CallRetEnvelope(ctx context.Context, envelope Envelope, ret interface{}, resp *http.Response) (err error) {
+	var body jsoniter.RawMessage
+	if err = CallRet(ctx, &body, resp); err != nil {
+		return
+	}
+	return envelope.Decode(body, ret)
+}
+
+// CallWithJsonEnvelope JSON请求，按响应结构解析响应
+func (r Client) CallWithJsonEnvelope(ctx context.Context, envelope Envelope, ret interface{}, method, reqUrl string,
+	headers http.Header, param interface{}) (err error) {
+	resp, err := r.DoRequestWithJson(ctx, method, reqUrl, headers, param)
+	if err != nil {
+		return err
+	}
+	return CallRetEnvelope(ctx, envelope, ret, resp)
+}
+
+// CallWithFormEnvelope Form请求，按响应结构解析响应
+func (r Client) CallWithFormEnvelope(ctx context.Context, envelope Envelope, ret interface{}, method, reqUrl string,
+	headers http.Header, param interface{}) (err error) {
+	resp, err := r.DoRequestWithForm(ctx, method, reqUrl, headers, param)
+	if err != nil {
+		return err
+	}
+	return CallRetEnvelope(ctx, envelope, ret, resp)
+}
+
+// CallJsonEnvelope
+// @Description: JSON请求，按响应结构把data解析为T
+// @param ctx
+// @param r
+// @param envelope
+// @param method
+// @param reqUrl
+// @param headers
+// @param param
+// @return ret
+// @return err
+func CallJsonEnvelope[T any](ctx context.Context, r Client, envelope Envelope, method, reqUrl string, headers http.Header,
+	param interface{}) (ret T, err error) {
+	err = r.CallWithJsonEnvelope(ctx, envelope, &ret, method, reqUrl, headers, param)
+	return
+}
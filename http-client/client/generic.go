@@ -0,0 +1,57 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+)
+
+// 方法不支持类型参数，泛型请求以包级函数的形式提供，第二个参数传要使用的Client
+
+// CallJson
+// @Description: JSON请求，响应解析为T
+// @param ctx
+// @param r
+// @param method
+// @param reqUrl
+// @param headers
+// @param param
+// @return ret
+// @return err
+func CallJson[T any](ctx context.Context, r Client, method, reqUrl string, headers http.Header, param interface{}) (ret T, err error) {
+	err = r.CallWithJson(ctx, &ret, method, reqUrl, headers, param)
+	return
+}
+
+// CallForm
+// @Description: Form请求，响应解析为T
+// @param ctx
+// @param r
+// @param method
+// @param reqUrl
+// @param headers
+// @param param
+// @return ret
+// @return err
+func CallForm[T any](ctx context.Context, r Client, method, reqUrl string, headers http.Header, param interface{}) (ret T, err error) {
+	err = r.CallWithForm(ctx, &ret, method, reqUrl, headers, param)
+	return
+}
+
+// CallJsonBytes
+// @Description: JSON请求，返回原始响应内容
+// @param ctx
+// @param r
+// @param method
+// @param reqUrl
+// @param headers
+// @param param
+// @return []byte
+// @return error
+func CallJsonBytes(ctx context.Context, r Client, method, reqUrl string, headers http.Header, param interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := r.CallWithJsonReturnResp(ctx, &buf, method, reqUrl, headers, param); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,212 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Multipart multipart/form-data 请求体，文件内容在发送时从io.Reader流式读取，不会整体读入内存
+//
+//	m := client.NewMultipart().AddField("type", "export").AddFilePath("file", "/tmp/export.csv")
+//	err := c.CallWithMultipart(ctx, &ret, http.MethodPost, reqUrl, nil, m)
+type Multipart struct {
+	parts    []multipartPart
+	boundary string
+}
+
+type multipartPart struct {
+	fieldName   string
+	fileName    string
+	contentType string
+	value       string
+	reader      io.Reader
+	path        string
+	// size 文件大小，-1表示未知
+	size int64
+}
+
+// NewMultipart
+// @Description: 创建multipart/form-data请求体
+// @return *Multipart
+func NewMultipart() *Multipart {
+	return &Multipart{boundary: multipart.NewWriter(nil).Boundary()}
+}
+
+// AddField 添加普通字段
+func (m *Multipart) AddField(name, value string) *Multipart {
+	m.parts = append(m.parts, multipartPart{fieldName: name, value: value})
+	return m
+}
+
+// AddFile 添加文件，内容类型为application/octet-stream
+func (m *Multipart) AddFile(fieldName, fileName string, r io.Reader) *Multipart {
+	return m.AddFileWithContentType(fieldName, fileName, "application/octet-stream", r)
+}
+
+// AddFileWithContentType 添加文件并指定内容类型；r为*os.File、*bytes.Reader、*strings.Reader等可以获取大小时会设置Content-Length
+func (m *Multipart) AddFileWithContentType(fieldName, fileName, contentType string, r io.Reader) *Multipart {
+	m.parts = append(m.parts, multipartPart{
+		fieldName:   fieldName,
+		fileName:    fileName,
+		contentType: contentType,
+		reader:      r,
+		size:        readerSize(r),
+	})
+	return m
+}
+
+// AddFilePath 添加本地文件，发送时才打开文件，发送结束后关闭
+func (m *Multipart) AddFilePath(fieldName, path string) *Multipart {
+	var size int64 = -1
+	if info, err := os.Stat(path); err == nil {
+		size = info.Size()
+	}
+	m.parts = append(m.parts, multipartPart{
+		fieldName:   fieldName,
+		fileName:    filepath.Base(path),
+		contentType: "application/octet-stream",
+		path:        path,
+		size:        size,
+	})
+	return m
+}
+
+// ContentType 请求头Content-Type
+func (m *Multipart) ContentType() string {
+	return "multipart/form-data; boundary=" + m.boundary
+}
+
+// ContentLength 请求体长度，有文件大小未知时返回-1
+func (m *Multipart) ContentLength() int64 {
+	// 文件内容置空后的长度就是分隔符和字段头的长度
+	var buf bytes.Buffer
+	w := multipart.NewWriter(&buf)
+	w.SetBoundary(m.boundary)
+	var length int64
+	for _, part := range m.parts {
+		if part.isFile() {
+			if part.size < 0 {
+				return -1
+			}
+			length += part.size
+			w.CreatePart(part.header())
+			continue
+		}
+		w.WriteField(part.fieldName, part.value)
+	}
+	w.Close()
+	return length + int64(buf.Len())
+}
+
+// Reader 返回流式的请求体，在读取时依次写入各个字段
+func (m *Multipart) Reader() io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(m.writeTo(pw))
+	}()
+	return pr
+}
+
+func (m *Multipart) writeTo(dst io.Writer) error {
+	w := multipart.NewWriter(dst)
+	w.SetBoundary(m.boundary)
+	for _, part := range m.parts {
+		if !part.isFile() {
+			if err := w.WriteField(part.fieldName, part.value); err != nil {
+				return err
+			}
+			continue
+		}
+		pw, err := w.CreatePart(part.header())
+		if err != nil {
+			return err
+		}
+		if err = part.copyTo(pw); err != nil {
+			return err
+		}
+	}
+	return w.Close()
+}
+
+func (p multipartPart) isFile() bool {
+	return p.reader != nil || p.path != ""
+}
+
+func (p multipartPart) header() textproto.MIMEHeader {
+	h := make(textproto.MIMEHeader)
+	h.Set("Content-Disposition", `form-data; name="`+escapeQuotes(p.fieldName)+`"; filename="`+escapeQuotes(p.fileName)+`"`)
+	h.Set("Content-Type", p.contentType)
+	return h
+}
+
+func (p multipartPart) copyTo(w io.Writer) error {
+	r := p.reader
+	if p.path != "" {
+		f, err := os.Open(p.path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+	_, err := io.Copy(w, r)
+	return err
+}
+
+var quoteEscaper = strings.NewReplacer("\\", "\\\\", `"`, "\\\"")
+
+func escapeQuotes(s string) string {
+	return quoteEscaper.Replace(s)
+}
+
+// readerSize 获取剩余可读的长度，无法获取时返回-1
+func readerSize(r io.Reader) int64 {
+	switch v := r.(type) {
+	case interface{ Len() int }:
+		return int64(v.Len())
+	case *os.File:
+		info, err := v.Stat()
+		if err != nil || !info.Mode().IsRegular() {
+			return -1
+		}
+		offset, err := v.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return -1
+		}
+		return info.Size() - offset
+	}
+	return -1
+}
+
+// DoRequestWithMultipart multipart/form-data请求，请求体不能重放，不会被重试
+func (r Client) DoRequestWithMultipart(ctx context.Context, method, reqUrl string, headers http.Header,
+	m *Multipart) (resp *http.Response, err error) {
+	if headers == nil {
+		headers = http.Header{}
+	}
+	headers.Set("Content-Type", m.ContentType())
+	body := m.Reader()
+	resp, err = r.DoRequestWith64(ctx, method, reqUrl, headers, body, m.ContentLength())
+	if err != nil {
+		// 请求未发出时关闭管道，结束写入的协程
+		body.Close()
+	}
+	return
+}
+
+// CallWithMultipart multipart/form-data请求，JSON解析响应
+func (r Client) CallWithMultipart(ctx context.Context, ret interface{}, method, reqUrl string, headers http.Header,
+	m *Multipart) (err error) {
+	resp, err := r.DoRequestWithMultipart(ctx, method, reqUrl, headers, m)
+	if err != nil {
+		return err
+	}
+	return CallRet(ctx, ret, resp)
+}
@@ -0,0 +1,370 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"github.com/youchuangcd/gopkg"
+	"github.com/youchuangcd/gopkg/mylog"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrHeartbeatTimeout 超过心跳时间没有收到任何数据
+var ErrHeartbeatTimeout = errors.New("httpclient: stream heartbeat timeout")
+
+// Event 流式响应中的一条消息；NDJSON每行是一条消息，内容在Data中
+type Event struct {
+	Id    string
+	Event string
+	Data  string
+	// Retry 服务端建议的重连间隔
+	Retry time.Duration
+}
+
+// StreamOption 流式请求配置
+type StreamOption struct {
+	// HeartbeatTimeout 超过该时间没有收到任何数据(包括SSE注释)时断开重连，0表示不检测
+	HeartbeatTimeout time.Duration
+	// MaxReconnects SSE连续重连的最大次数，收到消息后重新计数
+	MaxReconnects int
+	// ReconnectDelay 重连间隔，服务端通过retry字段指定时以服务端为准
+	ReconnectDelay time.Duration
+	// ReconnectOnEOF 服务端正常结束SSE连接后是否重连，默认false表示结束读取
+	ReconnectOnEOF bool
+}
+
+// SetStreamOptionFunc 设置流式请求配置的方法
+type SetStreamOptionFunc func(option StreamOption) StreamOption
+
+// Stream 流式响应迭代器
+//
+//	s, err := c.Stream(ctx, http.MethodPost, reqUrl, nil, param)
+//	defer s.Close()
+//	for s.Next() {
+//		ev := s.Event()
+//	}
+//	err = s.Err()
+type Stream struct {
+	ctx         context.Context
+	cancel      context.CancelFunc
+	client      Client
+	method      string
+	reqUrl      string
+	headers     http.Header
+	body        []byte
+	option      StreamOption
+	lastEventId string
+	reconnects  int
+
+	mu         sync.Mutex
+	resp       *http.Response
+	reader     *bufio.Reader
+	sse        bool
+	connCancel context.CancelFunc
+	heartbeat  *time.Timer
+	timedOut   atomic.Bool
+
+	event Event
+	err   error
+	done  bool
+}
+
+// Stream
+// @Description: 发送流式请求，text/event-stream按SSE解析，其他按行解析(NDJSON)；param不为nil时按JSON发送
+// @receiver r
+// @param ctx
+// @param method
+// @param reqUrl
+// @param headers
+// @param param
+// @param optionFuncs
+// @return *Stream
+// @return error 首次连接失败或服务端返回非2xx
+func (r Client) Stream(ctx context.Context, method, reqUrl string, headers http.Header, param interface{},
+	optionFuncs ...SetStreamOptionFunc) (*Stream, error) {
+	option := StreamOption{
+		MaxReconnects:  3,
+		ReconnectDelay: time.Second,
+	}
+	for _, optionFunc := range optionFuncs {
+		option = optionFunc(option)
+	}
+	if headers == nil {
+		headers = http.Header{}
+	}
+	var body []byte
+	if param != nil {
+		var err error
+		if v, ok := param.([]byte); ok {
+			body = v
+		} else if body, err = json.Marshal(param); err != nil {
+			return nil, err
+		}
+		if headers.Get("Content-Type") == "" {
+			headers.Set("Content-Type", "application/json")
+		}
+	}
+	if headers.Get("Accept") == "" {
+		headers.Set("Accept", "text/event-stream, application/x-ndjson")
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	s := &Stream{
+		ctx:     ctx,
+		cancel:  cancel,
+		client:  r.withTimeout(0),
+		method:  method,
+		reqUrl:  reqUrl,
+		headers: headers,
+		body:    body,
+		option:  option,
+	}
+	if err := s.connect(); err != nil {
+		cancel()
+		return nil, err
+	}
+	return s, nil
+}
+
+// Next 读取下一条消息，返回false时读取结束，通过Err获取错误
+func (s *Stream) Next() bool {
+	for {
+		if s.err != nil || s.done {
+			return false
+		}
+		s.mu.Lock()
+		reader := s.reader
+		s.mu.Unlock()
+		if reader == nil {
+			if err := s.connect(); err != nil {
+				if !s.retry(err) {
+					return false
+				}
+			}
+			continue
+		}
+		ev, err := s.read(reader)
+		if err == nil {
+			s.event = ev
+			s.reconnects = 0
+			return true
+		}
+		s.closeConn()
+		if err == io.EOF && !(s.sse && s.option.ReconnectOnEOF) {
+			s.done = true
+			return false
+		}
+		if !s.retry(err) {
+			return false
+		}
+	}
+}
+
+// Event 当前消息
+func (s *Stream) Event() Event {
+	return s.event
+}
+
+// Decode 把当前消息的内容按JSON解析到v
+func (s *Stream) Decode(v interface{}) error {
+	return json.Unmarshal([]byte(s.event.Data), v)
+}
+
+// LastEventId 最后收到的SSE消息id
+func (s *Stream) LastEventId() string {
+	return s.lastEventId
+}
+
+// Err 读取结束的原因，服务端正常结束时为nil
+func (s *Stream) Err() error {
+	return s.err
+}
+
+// Close 关闭连接，可以在其他协程中调用以结束阻塞的Next
+func (s *Stream) Close() error {
+	s.cancel()
+	s.closeConn()
+	return nil
+}
+
+// retry 判断是否重连并等待，不重连时记录错误
+func (s *Stream) retry(err error) bool {
+	if s.ctx.Err() != nil {
+		s.err = s.ctx.Err()
+		return false
+	}
+	var e *ErrorInfo
+	if !s.sse || s.reconnects >= s.option.MaxReconnects || (errors.As(err, &e) && e.Code < 500) {
+		s.err = err
+		return false
+	}
+	s.reconnects++
+	mylog.WithWarn(s.ctx, gopkg.LogHttp, map[string]interface{}{
+		"req_url":       s.reqUrl,
+		"last_event_id": s.lastEventId,
+		"reconnects":    s.reconnects,
+		"err":           err.Error(),
+	}, "流式响应中断，重新连接")
+	timer := time.NewTimer(s.option.ReconnectDelay)
+	select {
+	case <-s.ctx.Done():
+		timer.Stop()
+		s.err = s.ctx.Err()
+		return false
+	case <-timer.C:
+	}
+	return true
+}
+
+func (s *Stream) connect() error {
+	headers := s.headers.Clone()
+	if s.lastEventId != "" {
+		headers.Set("Last-Event-ID", s.lastEventId)
+	}
+	connCtx, connCancel := context.WithCancel(s.ctx)
+	resp, err := s.client.DoRequestWith(connCtx, s.method, s.reqUrl, headers, bytes.NewReader(s.body), len(s.body))
+	if err == nil && resp.StatusCode/100 != 2 {
+		err = ResponseError(resp)
+		resp.Body.Close()
+	}
+	if err != nil {
+		connCancel()
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.resp = resp
+	s.connCancel = connCancel
+	s.sse = strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream")
+	s.timedOut.Store(false)
+	body := io.Reader(resp.Body)
+	if s.option.HeartbeatTimeout > 0 {
+		s.heartbeat = time.AfterFunc(s.option.HeartbeatTimeout, func() {
+			s.timedOut.Store(true)
+			connCancel()
+		})
+		body = &heartbeatReader{Reader: resp.Body, timer: s.heartbeat, timeout: s.option.HeartbeatTimeout}
+	}
+	s.reader = bufio.NewReader(body)
+	return nil
+}
+
+func (s *Stream) closeConn() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.heartbeat != nil {
+		s.heartbeat.Stop()
+		s.heartbeat = nil
+	}
+	if s.resp != nil {
+		s.resp.Body.Close()
+		s.resp = nil
+	}
+	if s.connCancel != nil {
+		s.connCancel()
+		s.connCancel = nil
+	}
+	s.reader = nil
+}
+
+// read 读取一条消息
+func (s *Stream) read(reader *bufio.Reader) (Event, error) {
+	ev, err := s.readEvent(reader)
+	if err != nil && err != io.EOF && s.timedOut.Load() {
+		err = ErrHeartbeatTimeout
+	}
+	return ev, err
+}
+
+func (s *Stream) readEvent(reader *bufio.Reader) (ev Event, err error) {
+	if !s.sse {
+		for {
+			line, err := s.readLine(reader)
+			if err != nil {
+				return ev, err
+			}
+			if strings.TrimSpace(line) != "" {
+				return Event{Data: line}, nil
+			}
+		}
+	}
+	var (
+		data    strings.Builder
+		hasData bool
+	)
+	for {
+		line, err := s.readLine(reader)
+		if err != nil {
+			// 未以空行结束的消息不完整，丢弃
+			return Event{}, err
+		}
+		if line == "" {
+			if ev.Id != "" {
+				s.lastEventId = ev.Id
+			}
+			if !hasData {
+				ev = Event{}
+				continue
+			}
+			ev.Data = data.String()
+			return ev, nil
+		}
+		if strings.HasPrefix(line, ":") {
+			continue
+		}
+		field, value, _ := strings.Cut(line, ":")
+		value = strings.TrimPrefix(value, " ")
+		switch field {
+		case "data":
+			if hasData {
+				data.WriteByte('\n')
+			}
+			data.WriteString(value)
+			hasData = true
+		case "event":
+			ev.Event = value
+		case "id":
+			if !strings.Contains(value, "\x00") {
+				ev.Id = value
+			}
+		case "retry":
+			if ms, pErr := strconv.ParseInt(value, 10, 64); pErr == nil {
+				ev.Retry = time.Duration(ms) * time.Millisecond
+				s.option.ReconnectDelay = ev.Retry
+			}
+		}
+	}
+}
+
+// readLine 读取一行，去掉行尾的\r\n
+func (s *Stream) readLine(reader *bufio.Reader) (string, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		if err == io.EOF && line != "" && !s.sse {
+			return strings.TrimRight(line, "\r"), nil
+		}
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// heartbeatReader 每次读到数据时重置心跳计时
+type heartbeatReader struct {
+	io.Reader
+	timer   *time.Timer
+	timeout time.Duration
+}
+
+func (r *heartbeatReader) Read(p []byte) (n int, err error) {
+	n, err = r.Reader.Read(p)
+	if n > 0 {
+		r.timer.Reset(r.timeout)
+	}
+	return
+}
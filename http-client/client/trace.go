@@ -0,0 +1,52 @@
+package client
+
+import (
+	"context"
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/semconv/v1.17.0/httpconv"
+	"go.opentelemetry.io/otel/trace"
+	"net/http"
+)
+
+// TracerName 客户端span使用的tracer名称
+const TracerName = "github.com/youchuangcd/gopkg/http-client"
+
+// startSpan
+// @Description: 为请求创建客户端span并把追踪信息注入请求头；未初始化TracerProvider时span不会被记录，
+// 请求头也只保留从上下文复制的B3请求头
+// @param ctx
+// @param req 请求头里已经带上了从上下文复制的B3请求头
+// @return trace.Span
+func startSpan(ctx context.Context, req *http.Request) trace.Span {
+	parentCtx := ctx
+	// http请求的话，要提取request里面的上下文才可以获取到span
+	if ginCtx, ok := ctx.Value(gin.ContextKey).(*gin.Context); ok && ginCtx.Request != nil {
+		parentCtx = ginCtx.Request.Context()
+	}
+	propagator := otel.GetTextMapPropagator()
+	// 上下文里没有span时，把上游传递过来的B3请求头作为父span，保证链路不断
+	if !trace.SpanContextFromContext(parentCtx).IsValid() {
+		parentCtx = propagator.Extract(parentCtx, propagation.HeaderCarrier(req.Header))
+	}
+	spanCtx, span := otel.Tracer(TracerName).Start(parentCtx, "HTTP "+req.Method,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(httpconv.ClientRequest(req)...),
+	)
+	propagator.Inject(spanCtx, propagation.HeaderCarrier(req.Header))
+	return span
+}
+
+// endSpan 记录响应状态和错误并结束span
+func endSpan(span trace.Span, resp *http.Response, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	} else if resp != nil {
+		span.SetAttributes(httpconv.ClientResponse(resp)...)
+		span.SetStatus(httpconv.ClientStatus(resp.StatusCode))
+	}
+	span.End()
+}
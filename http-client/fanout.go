@@ -0,0 +1,195 @@
+package httpclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/panjf2000/ants/v2"
+	"github.com/youchuangcd/gopkg/common/utils"
+	"github.com/youchuangcd/gopkg/http-client/client"
+	"net/http"
+	"sync"
+)
+
+// ErrFanOutSkipped 快速失败模式下，其他请求失败后未发送的请求；调用方取消ctx时未发送的请求返回ctx的错误
+var ErrFanOutSkipped = errors.New("httpclient: fan-out call skipped after earlier failure")
+
+// DefaultFanOutConcurrency 默认并发数
+var DefaultFanOutConcurrency = 10
+
+// FanOutMode 批量请求的失败处理方式
+type FanOutMode int
+
+const (
+	// FanOutCollectAll 所有请求都执行完，收集每个请求的错误
+	FanOutCollectAll FanOutMode = iota
+	// FanOutFailFast 任意请求失败后取消进行中的请求，未发送的请求返回ErrFanOutSkipped
+	FanOutFailFast
+)
+
+// CallSpec 批量请求中的一个请求
+type CallSpec struct {
+	Method  string
+	Url     string
+	Headers http.Header
+	Param   interface{}
+	// Form true时按Form发送，默认JSON
+	Form bool
+	// Envelope 不为nil时按响应结构解析，业务失败返回*gopkg.Error
+	Envelope *client.Envelope
+	// Ret 响应解析的目标，为nil时不解析
+	Ret interface{}
+}
+
+// FanOutOption 批量请求配置
+type FanOutOption struct {
+	// Concurrency 最大并发数，默认DefaultFanOutConcurrency
+	Concurrency int
+	// Mode 失败处理方式，默认FanOutCollectAll
+	Mode FanOutMode
+	// Pool 使用已有的协程池，为nil时创建临时协程池，结束后释放
+	Pool *ants.Pool
+}
+
+// SetFanOutOptionFunc 设置批量请求配置的方法
+type SetFanOutOptionFunc func(option FanOutOption) FanOutOption
+
+// FanOut
+// @Description: 并发发送一批请求，errs与specs按下标一一对应
+// @receiver m
+// @param ctx
+// @param specs
+// @param optionFuncs
+// @return errs 每个请求的错误
+// @return err 快速失败模式下第一个失败的错误(调用方取消时为ctx的错误)，收集模式下下标最小的错误；全部成功时为nil
+func (m *Manager) FanOut(ctx context.Context, specs []CallSpec, optionFuncs ...SetFanOutOptionFunc) (errs []error, err error) {
+	option := FanOutOption{Concurrency: DefaultFanOutConcurrency}
+	for _, optionFunc := range optionFuncs {
+		option = optionFunc(option)
+	}
+	if option.Concurrency < 1 {
+		option.Concurrency = 1
+	}
+	errs = make([]error, len(specs))
+	if len(specs) == 0 {
+		return
+	}
+	pool := option.Pool
+	if pool == nil {
+		if pool, err = utils.NewPool(option.Concurrency); err != nil {
+			return
+		}
+		defer pool.Release()
+	}
+
+	callCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+		sem      = make(chan struct{}, option.Concurrency)
+	)
+	fail := func(e error) {
+		mu.Lock()
+		if firstErr == nil {
+			firstErr = e
+		}
+		mu.Unlock()
+		cancel()
+	}
+	for i := range specs {
+		select {
+		case sem <- struct{}{}:
+		case <-callCtx.Done():
+		}
+		if callCtx.Err() != nil {
+			for j := i; j < len(specs); j++ {
+				errs[j] = skippedErr(ctx)
+			}
+			if option.Mode == FanOutFailFast {
+				fail(errs[i])
+			}
+			break
+		}
+		i := i
+		wg.Add(1)
+		task := func() {
+			defer func() {
+				if r := recover(); r != nil {
+					errs[i] = fmt.Errorf("httpclient: fan-out call panic: %v", r)
+				}
+				if errs[i] != nil && option.Mode == FanOutFailFast {
+					fail(errs[i])
+				}
+				<-sem
+				wg.Done()
+			}()
+			if callCtx.Err() != nil {
+				errs[i] = skippedErr(ctx)
+				return
+			}
+			errs[i] = m.call(callCtx, specs[i])
+		}
+		if sErr := pool.Submit(task); sErr != nil {
+			errs[i] = sErr
+			<-sem
+			wg.Done()
+			if option.Mode == FanOutFailFast {
+				fail(sErr)
+			}
+		}
+	}
+	wg.Wait()
+
+	if option.Mode == FanOutFailFast {
+		return errs, firstErr
+	}
+	for _, e := range errs {
+		if e != nil {
+			return errs, e
+		}
+	}
+	return errs, nil
+}
+
+// skippedErr 未发送的请求，调用方取消时返回调用方ctx的错误，否则是快速失败时其他请求已失败，返回ErrFanOutSkipped
+func skippedErr(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return ErrFanOutSkipped
+}
+
+func (m *Manager) call(ctx context.Context, spec CallSpec) error {
+	switch {
+	case spec.Envelope != nil && spec.Form:
+		return m.Client.CallWithFormEnvelope(ctx, *spec.Envelope, spec.Ret, spec.Method, spec.Url, spec.Headers, spec.Param)
+	case spec.Envelope != nil:
+		return m.Client.CallWithJsonEnvelope(ctx, *spec.Envelope, spec.Ret, spec.Method, spec.Url, spec.Headers, spec.Param)
+	case spec.Form:
+		return m.Client.CallWithForm(ctx, spec.Ret, spec.Method, spec.Url, spec.Headers, spec.Param)
+	default:
+		return m.Client.CallWithJson(ctx, spec.Ret, spec.Method, spec.Url, spec.Headers, spec.Param)
+	}
+}
+
+// FanOutJson
+// @Description: 并发发送一批请求，响应解析为T，结果与specs按下标一一对应；specs中的Ret会被忽略
+// @param ctx
+// @param m
+// @param specs
+// @param optionFuncs
+// @return rets
+// @return errs
+// @return err
+func FanOutJson[T any](ctx context.Context, m *Manager, specs []CallSpec, optionFuncs ...SetFanOutOptionFunc) (rets []T, errs []error, err error) {
+	rets = make([]T, len(specs))
+	calls := make([]CallSpec, len(specs))
+	for i, spec := range specs {
+		spec.Ret = &rets[i]
+		calls[i] = spec
+	}
+	errs, err = m.FanOut(ctx, calls, optionFuncs...)
+	return
+}
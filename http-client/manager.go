@@ -3,6 +3,7 @@ package httpclient
 import (
 	"bytes"
 	"context"
+	jsoniter "github.com/json-iterator/go"
 	"github.com/youchuangcd/gopkg"
 	"github.com/youchuangcd/gopkg/http-client/auth"
 	"github.com/youchuangcd/gopkg/http-client/client"
@@ -16,13 +17,38 @@ var (
 	defaultManager *Manager
 	once           sync.Once
 	DefaultTimeout = gopkg.HttpClientTimeout // 客户端默认超时
+	json           = jsoniter.ConfigCompatibleWithStandardLibrary
 )
 
 type Manager struct {
 	Client      *client.Client
 	Credentials *auth.Credentials
+	option      ManagerOption
 }
 
+// ManagerOption Manager的可选配置
+type ManagerOption struct {
+	// RetryPolicy 重试策略，为nil时每个请求只发送一次
+	RetryPolicy *RetryPolicy
+	// CircuitBreaker 按host熔断，为nil时不熔断；多个Manager可共用一个熔断器
+	CircuitBreaker *CircuitBreaker
+	// Signer 请求签名，Credentials不为nil时生效，每次重试都会重新签名
+	Signer auth.Signer
+	// Resolver 服务发现，配置后可以使用 service://服务名/路径 形式的地址
+	Resolver Resolver
+	// InstanceFailureCooldown 服务实例请求失败后被跳过的时长，默认DefaultInstanceFailureCooldown
+	InstanceFailureCooldown time.Duration
+	// RateLimiter 按host或地址前缀限流，每次重试也会消耗令牌
+	RateLimiter *RateLimiter
+	// TokenSource 访问令牌，每个请求携带Authorization请求头，401时刷新令牌重试一次
+	TokenSource TokenSource
+	// Debug 调试日志，为nil时按client.DebugMode；client.NewDebugLogger(false)可以单独关闭
+	Debug *client.DebugLogger
+}
+
+// SetManagerOptionFunc 设置Manager可选配置的方法
+type SetManagerOptionFunc func(option ManagerOption) ManagerOption
+
 // NewCredentials 获取认证
 func NewCredentials(clientKey, clientSecret string) *auth.Credentials {
 	return auth.New(clientKey, clientSecret)
@@ -39,36 +65,107 @@ func DefaultManager() *Manager {
 }
 
 func NewManager(credentials *auth.Credentials) *Manager {
-	c := client.DefaultClient
 	//credentials := newCredentials(key, secret)
-	c.Transport = newTransport(credentials, nil)
-	c.Timeout = DefaultTimeout
-	return &Manager{
-		Client:      &c,
-		Credentials: credentials,
-	}
+	return NewManagerV2(credentials, DefaultTimeout, nil)
 }
 
-func NewManagerV2(credentials *auth.Credentials, timeout time.Duration, tr http.RoundTripper) *Manager {
-	c := client.DefaultClient
-	c.Transport = newTransport(credentials, tr)
-	c.Timeout = timeout
+// NewManagerV2
+// @Description: 创建http管理对象
+// @param credentials
+// @param timeout 客户端超时时间，开启重试时包含所有重试的耗时
+// @param tr 底层RoundTripper，为nil时使用gopkg.HttpClientDefaultTransport
+// @param optionFuncs 可选配置
+// @return *Manager
+func NewManagerV2(credentials *auth.Credentials, timeout time.Duration, tr http.RoundTripper, optionFuncs ...SetManagerOptionFunc) *Manager {
+	var option ManagerOption
+	for _, optionFunc := range optionFuncs {
+		option = optionFunc(option)
+	}
+	// 每个Manager使用独立的http.Client，client.DefaultClient复制后仍共享同一个*http.Client
+	c := client.Client{
+		Client: &http.Client{
+			Transport: newTransport(credentials, tr, option),
+			Timeout:   timeout,
+		},
+		Debug: option.Debug,
+	}
 	return &Manager{
 		Client:      &c,
 		Credentials: credentials,
+		option:      option,
 	}
 }
 
 type transport struct {
 	http.RoundTripper
 	credentials *auth.Credentials
+	option      ManagerOption
+	balancer    *serviceBalancer
 }
 
-func newTransport(credentials *auth.Credentials, tr http.RoundTripper) *transport {
+func newTransport(credentials *auth.Credentials, tr http.RoundTripper, option ManagerOption) *transport {
 	if tr == nil {
 		tr = gopkg.HttpClientDefaultTransport
 	}
-	return &transport{tr, credentials}
+	t := &transport{
+		RoundTripper: tr,
+		credentials:  credentials,
+		option:       option,
+	}
+	if option.Resolver != nil {
+		t.balancer = newServiceBalancer(option.Resolver, option.InstanceFailureCooldown)
+	}
+	return t
+}
+
+// RoundTrip 发送请求，配置了重试策略时按策略重试
+func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.option.RetryPolicy != nil {
+		return t.option.RetryPolicy.roundTrip(roundTripperFunc(t.roundTripOnce), req)
+	}
+	return t.roundTripOnce(req)
+}
+
+// roundTripOnce 发送一次请求，每次重试都会重新经过这里
+func (t *transport) roundTripOnce(req *http.Request) (*http.Response, error) {
+	if t.option.RateLimiter != nil {
+		if err := t.option.RateLimiter.Wait(req.Context(), req); err != nil {
+			return nil, err
+		}
+	}
+	var next http.RoundTripper = roundTripperFunc(t.send)
+	if t.option.TokenSource != nil {
+		send := next
+		next = roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			return tokenRoundTrip(t.option.TokenSource, send, req)
+		})
+	}
+	if t.balancer != nil && req.URL.Scheme == ServiceScheme {
+		return t.balancer.roundTrip(next, req)
+	}
+	return next.RoundTrip(req)
+}
+
+// send 签名后经过熔断器发送请求
+func (t *transport) send(req *http.Request) (*http.Response, error) {
+	if t.option.Signer != nil && t.credentials != nil {
+		// RoundTripper不能修改调用方的请求，复制一份再签名
+		req = req.Clone(req.Context())
+		if err := auth.SignRequest(t.option.Signer, req, t.credentials); err != nil {
+			return nil, err
+		}
+	}
+	if t.option.CircuitBreaker != nil {
+		return t.option.CircuitBreaker.roundTrip(t.RoundTripper, req)
+	}
+	return t.RoundTripper.RoundTrip(req)
+}
+
+// roundTripperFunc 把方法适配为http.RoundTripper
+type roundTripperFunc func(req *http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
 }
 
 func CallWithJson(ctx context.Context, ret interface{}, method, reqUrl string, headers http.Header, param interface{}) (err error) {
@@ -91,3 +188,48 @@ func DoRequestWith64(ctx context.Context, method, reqUrl string, headers http.He
 func CallWith64(ctx context.Context, ret interface{}, method, reqUrl string, headers http.Header, body io.Reader, bodyLength int64) (err error) {
 	return DefaultManager().Client.CallWith64(ctx, ret, method, reqUrl, headers, body, bodyLength)
 }
+
+// CallJson 使用默认Manager发送JSON请求，响应解析为T
+func CallJson[T any](ctx context.Context, method, reqUrl string, headers http.Header, param interface{}) (T, error) {
+	return client.CallJson[T](ctx, *DefaultManager().Client, method, reqUrl, headers, param)
+}
+
+// CallForm 使用默认Manager发送Form请求，响应解析为T
+func CallForm[T any](ctx context.Context, method, reqUrl string, headers http.Header, param interface{}) (T, error) {
+	return client.CallForm[T](ctx, *DefaultManager().Client, method, reqUrl, headers, param)
+}
+
+// CallJsonBytes 使用默认Manager发送JSON请求，返回原始响应内容
+func CallJsonBytes(ctx context.Context, method, reqUrl string, headers http.Header, param interface{}) ([]byte, error) {
+	return client.CallJsonBytes(ctx, *DefaultManager().Client, method, reqUrl, headers, param)
+}
+
+// CallWithJsonEnvelope 使用默认Manager发送JSON请求，按响应结构把data解析到ret，业务失败返回*gopkg.Error
+func CallWithJsonEnvelope(ctx context.Context, envelope client.Envelope, ret interface{}, method, reqUrl string, headers http.Header, param interface{}) (err error) {
+	return DefaultManager().Client.CallWithJsonEnvelope(ctx, envelope, ret, method, reqUrl, headers, param)
+}
+
+// CallWithFormEnvelope 使用默认Manager发送Form请求，按响应结构把data解析到ret，业务失败返回*gopkg.Error
+func CallWithFormEnvelope(ctx context.Context, envelope client.Envelope, ret interface{}, method, reqUrl string, headers http.Header, param interface{}) (err error) {
+	return DefaultManager().Client.CallWithFormEnvelope(ctx, envelope, ret, method, reqUrl, headers, param)
+}
+
+// CallWithMultipart 使用默认Manager发送multipart/form-data请求，文件内容流式发送
+func CallWithMultipart(ctx context.Context, ret interface{}, method, reqUrl string, headers http.Header, m *client.Multipart) (err error) {
+	return DefaultManager().Client.CallWithMultipart(ctx, ret, method, reqUrl, headers, m)
+}
+
+// Download 使用默认Manager下载并写入w，中断后使用Range续传
+func Download(ctx context.Context, reqUrl string, w io.Writer, optionFuncs ...client.SetDownloadOptionFunc) (written int64, err error) {
+	return DefaultManager().Client.Download(ctx, reqUrl, w, optionFuncs...)
+}
+
+// DownloadFile 使用默认Manager下载到本地文件，中断后使用Range续传
+func DownloadFile(ctx context.Context, reqUrl, path string, optionFuncs ...client.SetDownloadOptionFunc) (written int64, err error) {
+	return DefaultManager().Client.DownloadFile(ctx, reqUrl, path, optionFuncs...)
+}
+
+// Stream 使用默认Manager发送流式请求，按SSE或NDJSON逐条读取响应
+func Stream(ctx context.Context, method, reqUrl string, headers http.Header, param interface{}, optionFuncs ...client.SetStreamOptionFunc) (*client.Stream, error) {
+	return DefaultManager().Client.Stream(ctx, method, reqUrl, headers, param, optionFuncs...)
+}
@@ -0,0 +1,588 @@
+package httpclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/nacos-group/nacos-sdk-go/model"
+	"github.com/youchuangcd/gopkg/http-client/auth"
+	"github.com/youchuangcd/gopkg/mylog"
+	"github.com/youchuangcd/gopkg/nacos"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	mylog.InitLog()
+	os.Exit(m.Run())
+}
+
+func newRetryManager(policy *RetryPolicy) *Manager {
+	return NewManagerV2(nil, 5*time.Second, nil, func(option ManagerOption) ManagerOption {
+		option.RetryPolicy = policy
+		return option
+	})
+}
+
+func TestRetryPolicy(t *testing.T) {
+	var count int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if atomic.AddInt32(&count, 1) < 3 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(body)
+	}))
+	defer srv.Close()
+
+	policy := DefaultRetryPolicy()
+	policy.BaseDelay = time.Millisecond
+	m := newRetryManager(policy)
+
+	var ret map[string]int
+	err := m.Client.CallWithJson(context.Background(), &ret, http.MethodPut, srv.URL, nil, map[string]int{"id": 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 3 || ret["id"] != 1 {
+		t.Errorf("重试后请求体应该一致，请求次数%d，响应%v", count, ret)
+	}
+
+	// POST默认不重试
+	atomic.StoreInt32(&count, 0)
+	err = m.Client.CallWithJson(context.Background(), &ret, http.MethodPost, srv.URL, nil, map[string]int{"id": 1})
+	if err == nil || count != 1 {
+		t.Errorf("POST不应该重试，请求次数%d，err %v", count, err)
+	}
+
+	// 显式允许非幂等请求重试
+	atomic.StoreInt32(&count, 0)
+	policy.RetryNonIdempotent = true
+	err = m.Client.CallWithJson(context.Background(), &ret, http.MethodPost, srv.URL, nil, map[string]int{"id": 2})
+	if err != nil || count != 3 || ret["id"] != 2 {
+		t.Errorf("POST应该重试成功，请求次数%d，err %v", count, err)
+	}
+}
+
+func TestRetryPolicyContextCancel(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	policy := DefaultRetryPolicy()
+	policy.MaxAttempts = 10
+	policy.BaseDelay = time.Second
+	m := newRetryManager(policy)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	startTime := time.Now()
+	err := m.Client.CallWithJson(ctx, nil, http.MethodGet, srv.URL, nil, nil)
+	if err == nil {
+		t.Fatal("应该返回错误")
+	}
+	if time.Since(startTime) > time.Second {
+		t.Errorf("上下文取消后应该停止重试，耗时%s", time.Since(startTime))
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	var fail int32 = 1
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&fail) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	var changes []CircuitState
+	breaker := NewCircuitBreaker(CircuitBreakerConfig{
+		MinRequests:      4,
+		OpenTimeout:      50 * time.Millisecond,
+		HalfOpenRequests: 2,
+		OnStateChange: func(host string, from, to CircuitState) {
+			changes = append(changes, to)
+		},
+	})
+	m := NewManagerV2(nil, 5*time.Second, nil, func(option ManagerOption) ManagerOption {
+		option.CircuitBreaker = breaker
+		return option
+	})
+	ctx := context.Background()
+	for i := 0; i < 4; i++ {
+		m.Client.CallWithJson(ctx, nil, http.MethodGet, srv.URL, nil, nil)
+	}
+	host := srv.Listener.Addr().String()
+	if breaker.State(host) != CircuitOpen {
+		t.Fatalf("熔断器应该打开，当前%s", breaker.State(host))
+	}
+	err := m.Client.CallWithJson(ctx, nil, http.MethodGet, srv.URL, nil, nil)
+	var openErr *CircuitOpenError
+	if !errors.As(err, &openErr) {
+		t.Fatalf("熔断器打开时应该返回CircuitOpenError，实际%v", err)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	atomic.StoreInt32(&fail, 0)
+	for i := 0; i < 2; i++ {
+		if err = m.Client.CallWithJson(ctx, nil, http.MethodGet, srv.URL, nil, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if breaker.State(host) != CircuitClosed {
+		t.Fatalf("试探成功后熔断器应该关闭，当前%s", breaker.State(host))
+	}
+	want := []CircuitState{CircuitOpen, CircuitHalfOpen, CircuitClosed}
+	if fmt.Sprint(changes) != fmt.Sprint(want) {
+		t.Errorf("状态变化%v，期望%v", changes, want)
+	}
+}
+
+func TestSigner(t *testing.T) {
+	credentials := NewCredentials("client", "secret")
+	for _, signer := range []auth.Signer{auth.HMACSigner{}, auth.MD5Signer{}} {
+		verifier := auth.NewVerifier(signer, auth.StaticCredentials(credentials))
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if _, err := verifier.Verify(r); err != nil {
+				w.WriteHeader(http.StatusUnauthorized)
+				w.Write([]byte(err.Error()))
+				return
+			}
+			body, _ := io.ReadAll(r.Body)
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(body)
+		}))
+
+		m := NewManagerV2(credentials, 5*time.Second, nil, func(option ManagerOption) ManagerOption {
+			option.Signer = signer
+			return option
+		})
+		var ret map[string]int
+		err := m.Client.CallWithJson(context.Background(), &ret, http.MethodPost, srv.URL+"/api/x?b=2&a=1", nil, map[string]int{"id": 1})
+		if err != nil || ret["id"] != 1 {
+			t.Errorf("%T 验签应该通过，err %v", signer, err)
+		}
+
+		// 未签名的请求应该被拒绝
+		err = NewManagerV2(nil, 5*time.Second, nil).Client.CallWithJson(context.Background(), &ret, http.MethodPost, srv.URL, nil, nil)
+		if err == nil {
+			t.Errorf("%T 未签名请求应该验签失败", signer)
+		}
+
+		// 同一个签名请求重放应该被拒绝
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+"/api/x?a=1", nil)
+		if err = auth.SignRequest(signer, req, credentials); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = verifier.Verify(req); err != nil {
+			t.Errorf("%T 第一次验签应该通过，err %v", signer, err)
+		}
+		if _, err = verifier.Verify(req); err != auth.ErrReplayedNonce {
+			t.Errorf("%T 重放请求应该返回ErrReplayedNonce，实际%v", signer, err)
+		}
+		req.Header.Del(auth.HeaderNonce)
+		if _, err = verifier.Verify(req); err != auth.ErrMissingSignature {
+			t.Errorf("%T 缺少nonce应该返回ErrMissingSignature，实际%v", signer, err)
+		}
+		srv.Close()
+	}
+}
+
+func TestServiceResolver(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"path":"` + r.URL.Path + `"}`))
+	}))
+	defer srv.Close()
+	// 已关闭的端口，请求会失败
+	dead := httptest.NewServer(http.NotFoundHandler())
+	dead.Close()
+
+	instance := func(addr string) ServiceInstance {
+		host, port, _ := net.SplitHostPort(addr)
+		p, _ := strconv.ParseUint(port, 10, 64)
+		return ServiceInstance{Ip: host, Port: p, Weight: 1, Healthy: true, Enable: true}
+	}
+	policy := DefaultRetryPolicy()
+	policy.BaseDelay = time.Millisecond
+	m := NewManagerV2(nil, 5*time.Second, nil, func(option ManagerOption) ManagerOption {
+		option.RetryPolicy = policy
+		option.Resolver = StaticResolver{
+			"order-service": {instance(dead.Listener.Addr().String()), instance(srv.Listener.Addr().String())},
+		}
+		return option
+	})
+	for i := 0; i < 10; i++ {
+		var ret map[string]string
+		err := m.Client.CallWithJson(context.Background(), &ret, http.MethodGet, "service://order-service/api/x", nil, nil)
+		if err != nil || ret["path"] != "/api/x" {
+			t.Fatalf("第%d次请求应该成功，响应%v，err %v", i, ret, err)
+		}
+	}
+	err := m.Client.CallWithJson(context.Background(), nil, http.MethodGet, "service://user-service/api/x", nil, nil)
+	if !errors.Is(err, ErrNoAvailableInstance) {
+		t.Errorf("未知服务应该返回ErrNoAvailableInstance，实际%v", err)
+	}
+}
+
+// syncNaming 订阅时同步执行回调，推送的列表比拉取的新
+type syncNaming struct {
+	selects int32
+}
+
+func (n *syncNaming) SelectInstances(serviceName string, groupName string, clusters []string, healthyOnly bool) ([]model.Instance, error) {
+	atomic.AddInt32(&n.selects, 1)
+	return []model.Instance{{Ip: "10.0.0.1", Port: 80, Weight: 1, Healthy: true, Enable: true}}, nil
+}
+
+func (n *syncNaming) Subscribe(param *nacos.SubscribeParam) error {
+	param.SubscribeCallback([]nacos.SubscribeService{{Ip: "10.0.0.2", Port: 80, Weight: 1, Healthy: true, Valid: true, Enable: true}}, nil)
+	return nil
+}
+
+func TestNacosResolverSyncCallback(t *testing.T) {
+	naming := &syncNaming{}
+	r := NewNacosResolver(naming, "", nil)
+	done := make(chan struct{})
+	var ips [10]string
+	go func() {
+		defer close(done)
+		var wg sync.WaitGroup
+		for i := range ips {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				if instances, err := r.Instances("order-service"); err == nil && len(instances) == 1 {
+					ips[i] = instances[0].Ip
+				}
+			}(i)
+		}
+		wg.Wait()
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("回调同步执行时订阅死锁")
+	}
+	for i, ip := range ips {
+		if ip != "10.0.0.2" {
+			t.Errorf("第%d次获取应该返回回调推送的列表，实际%q", i, ip)
+		}
+	}
+	if n := atomic.LoadInt32(&naming.selects); n != 1 {
+		t.Errorf("同一个服务只应订阅一次，实际拉取%d次", n)
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	newManager := func(wait bool) *Manager {
+		limiter, err := NewRateLimiter(RateLimitRule{Prefix: srv.URL + "/limited", Rate: 20, Burst: 2, Wait: wait})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return NewManagerV2(nil, 5*time.Second, nil, func(option ManagerOption) ManagerOption {
+			option.RateLimiter = limiter
+			return option
+		})
+	}
+	ctx := context.Background()
+	m := newManager(false)
+	for i := 0; i < 2; i++ {
+		if err := m.Client.CallWithJson(ctx, nil, http.MethodGet, srv.URL+"/limited", nil, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := m.Client.CallWithJson(ctx, nil, http.MethodGet, srv.URL+"/limited", nil, nil)
+	var limitErr *RateLimitError
+	if !errors.As(err, &limitErr) || limitErr.RetryAfter <= 0 {
+		t.Fatalf("令牌用完应该返回RateLimitError，实际%v", err)
+	}
+	// 不匹配的地址不限流
+	if err = m.Client.CallWithJson(ctx, nil, http.MethodGet, srv.URL+"/other", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	m = newManager(true)
+	startTime := time.Now()
+	for i := 0; i < 4; i++ {
+		if err = m.Client.CallWithJson(ctx, nil, http.MethodGet, srv.URL+"/limited", nil, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(startTime); elapsed < 80*time.Millisecond {
+		t.Errorf("阻塞模式应该等待令牌，耗时%s", elapsed)
+	}
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if err = m.Client.CallWithJson(ctx, nil, http.MethodGet, srv.URL+"/limited", nil, nil); err == nil {
+		t.Error("等待令牌时ctx超时应该返回错误")
+	}
+}
+
+func TestNewRateLimiterInvalidRate(t *testing.T) {
+	_, err := NewRateLimiter(RateLimitRule{Host: "example.com"})
+	var ruleErr *InvalidRateLimitRuleError
+	if !errors.As(err, &ruleErr) || ruleErr.Key != "example.com" {
+		t.Errorf("Rate为0应该返回InvalidRateLimitRuleError，实际%v", err)
+	}
+}
+
+func TestTokenSource(t *testing.T) {
+	var fetchCount int32
+	tokenSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key, secret, _ := r.BasicAuth()
+		r.ParseForm()
+		if key != "key" || secret != "secret" || r.PostForm.Get("grant_type") != "client_credentials" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		n := atomic.AddInt32(&fetchCount, 1)
+		time.Sleep(20 * time.Millisecond)
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"access_token":"token-%d","token_type":"bearer","expires_in":7200}`, n)
+	}))
+	defer tokenSrv.Close()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// 第一个令牌已被服务端吊销
+		if r.Header.Get("Authorization") != "Bearer token-2" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(body)
+	}))
+	defer srv.Close()
+
+	source := NewClientCredentialsTokenSource(ClientCredentialsConfig{
+		TokenUrl:    tokenSrv.URL,
+		Credentials: NewCredentials("key", "secret"),
+	})
+	m := NewManagerV2(nil, 5*time.Second, nil, func(option ManagerOption) ManagerOption {
+		option.TokenSource = source
+		return option
+	})
+
+	// 并发获取只请求一次令牌接口
+	done := make(chan *Token, 5)
+	for i := 0; i < 5; i++ {
+		go func() {
+			token, _ := source.Token(context.Background())
+			done <- token
+		}()
+	}
+	for i := 0; i < 5; i++ {
+		if token := <-done; token == nil || token.AccessToken != "token-1" {
+			t.Fatalf("令牌不一致 %v", token)
+		}
+	}
+	if fetchCount != 1 {
+		t.Fatalf("并发刷新应该只请求一次，实际%d", fetchCount)
+	}
+
+	var ret map[string]int
+	err := m.Client.CallWithJson(context.Background(), &ret, http.MethodPost, srv.URL, nil, map[string]int{"id": 1})
+	if err != nil || ret["id"] != 1 {
+		t.Fatalf("401后应该刷新令牌重试成功，ret %v err %v", ret, err)
+	}
+	if fetchCount != 2 {
+		t.Errorf("401后应该刷新一次令牌，实际请求%d次", fetchCount)
+	}
+}
+
+func TestFanOut(t *testing.T) {
+	var running, maxRunning int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&running, 1)
+		defer atomic.AddInt32(&running, -1)
+		for {
+			m := atomic.LoadInt32(&maxRunning)
+			if n <= m || atomic.CompareAndSwapInt32(&maxRunning, m, n) {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+		id := r.URL.Query().Get("id")
+		if id == "3" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"id":%s}`, id)
+	}))
+	defer srv.Close()
+
+	m := NewManagerV2(nil, 5*time.Second, nil)
+	specs := make([]CallSpec, 20)
+	for i := range specs {
+		specs[i] = CallSpec{Method: http.MethodGet, Url: srv.URL + "?id=" + strconv.Itoa(i)}
+	}
+	rets, errs, err := FanOutJson[map[string]int](context.Background(), m, specs, func(option FanOutOption) FanOutOption {
+		option.Concurrency = 4
+		return option
+	})
+	if err == nil || errs[3] == nil || maxRunning > 4 {
+		t.Fatalf("第3个请求应该失败且并发不超过4，err %v，最大并发%d", err, maxRunning)
+	}
+	for i, ret := range rets {
+		if i != 3 && (errs[i] != nil || ret["id"] != i) {
+			t.Errorf("第%d个结果不一致 %v %v", i, ret, errs[i])
+		}
+	}
+
+	errs, err = m.FanOut(context.Background(), specs, func(option FanOutOption) FanOutOption {
+		option.Concurrency = 2
+		option.Mode = FanOutFailFast
+		return option
+	})
+	if err == nil || !errors.Is(errs[len(errs)-1], ErrFanOutSkipped) {
+		t.Errorf("快速失败后剩余请求应该跳过，err %v，最后一个%v", err, errs[len(errs)-1])
+	}
+
+	// 调用方已取消，返回ctx的错误而不是ErrFanOutSkipped
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	errs, err = m.FanOut(ctx, specs, func(option FanOutOption) FanOutOption {
+		option.Mode = FanOutFailFast
+		return option
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("ctx已取消应该返回context.Canceled，实际%v", err)
+	}
+	for i, e := range errs {
+		if !errors.Is(e, context.Canceled) {
+			t.Errorf("第%d个请求应该返回context.Canceled，实际%v", i, e)
+		}
+	}
+}
+
+func TestCacheTransport(t *testing.T) {
+	var requests, notModified int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		switch r.URL.Path {
+		case "/max-age":
+			w.Header().Set("Cache-Control", "max-age=60")
+		case "/etag":
+			w.Header().Set("Cache-Control", "no-cache")
+			w.Header().Set("ETag", `"v1"`)
+			if r.Header.Get("If-None-Match") == `"v1"` {
+				atomic.AddInt32(&notModified, 1)
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+		case "/no-store":
+			w.Header().Set("Cache-Control", "no-store")
+		case "/private":
+			w.Header().Set("Cache-Control", "private, max-age=60")
+		case "/public":
+			w.Header().Set("Cache-Control", "public, max-age=60")
+		case "/vary":
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.Header().Set("Vary", "Accept-Language")
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"path":%q,"user":%q,"lang":%q}`, r.URL.Path, r.Header.Get("Authorization"), r.Header.Get("Accept-Language"))
+	}))
+	defer srv.Close()
+
+	m := NewManagerV2(nil, 5*time.Second, NewCacheTransport(NewMemoryCacheStorage(100), nil))
+	ctx := context.Background()
+	getWith := func(ctx context.Context, path string, headers http.Header) map[string]string {
+		var ret map[string]string
+		if err := m.Client.CallWithJson(ctx, &ret, http.MethodGet, srv.URL+path, headers, nil); err != nil {
+			t.Fatal(err)
+		}
+		return ret
+	}
+	get := func(ctx context.Context, path string) string {
+		return getWith(ctx, path, nil)["path"]
+	}
+
+	for i := 0; i < 3; i++ {
+		if get(ctx, "/max-age") != "/max-age" {
+			t.Fatal("缓存的响应不一致")
+		}
+	}
+	if requests != 1 {
+		t.Errorf("max-age内应该命中缓存，请求%d次", requests)
+	}
+	get(WithCacheRefresh(ctx), "/max-age")
+	if requests != 2 {
+		t.Errorf("强制刷新应该请求服务端，请求%d次", requests)
+	}
+
+	atomic.StoreInt32(&requests, 0)
+	for i := 0; i < 3; i++ {
+		if get(ctx, "/etag") != "/etag" {
+			t.Fatal("协商缓存的响应不一致")
+		}
+	}
+	if requests != 3 || notModified != 2 {
+		t.Errorf("no-cache应该每次协商，请求%d次，304 %d次", requests, notModified)
+	}
+
+	atomic.StoreInt32(&requests, 0)
+	get(ctx, "/no-store")
+	get(ctx, "/no-store")
+	if requests != 2 {
+		t.Errorf("no-store不应该缓存，请求%d次", requests)
+	}
+
+	atomic.StoreInt32(&requests, 0)
+	get(ctx, "/private")
+	get(ctx, "/private")
+	if requests != 2 {
+		t.Errorf("private不应该缓存，请求%d次", requests)
+	}
+
+	// 带身份的请求只缓存public的响应，且不同身份互不命中
+	userA := http.Header{"Authorization": {"Bearer a"}}
+	userB := http.Header{"Authorization": {"Bearer b"}}
+	atomic.StoreInt32(&requests, 0)
+	getWith(ctx, "/max-age?auth=1", userA)
+	getWith(ctx, "/max-age?auth=1", userA)
+	if requests != 2 {
+		t.Errorf("带身份的请求不应该缓存非public的响应，请求%d次", requests)
+	}
+	atomic.StoreInt32(&requests, 0)
+	getWith(ctx, "/public", userA)
+	if ret := getWith(ctx, "/public", userB); ret["user"] != "Bearer b" {
+		t.Errorf("不同身份不应该命中同一个缓存: %v", ret)
+	}
+	getWith(ctx, "/public", userA)
+	if requests != 2 {
+		t.Errorf("public的响应应该按身份缓存，请求%d次", requests)
+	}
+
+	// Vary的请求头不同的响应分别缓存
+	atomic.StoreInt32(&requests, 0)
+	for i := 0; i < 2; i++ {
+		for _, lang := range []string{"zh", "en"} {
+			if ret := getWith(ctx, "/vary", http.Header{"Accept-Language": {lang}}); ret["lang"] != lang {
+				t.Errorf("Vary请求头不同应该返回对应的响应: %v", ret)
+			}
+		}
+	}
+	if requests != 2 {
+		t.Errorf("Vary的每个取值应该各请求一次，请求%d次", requests)
+	}
+}
@@ -0,0 +1,344 @@
+package httpclient
+
+import (
+	"context"
+	"errors"
+	"github.com/youchuangcd/gopkg"
+	"github.com/youchuangcd/gopkg/common/utils"
+	"github.com/youchuangcd/gopkg/http-client/auth"
+	"github.com/youchuangcd/gopkg/http-client/client"
+	"github.com/youchuangcd/gopkg/mylog"
+	"github.com/youchuangcd/gopkg/redis"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrEmptyAccessToken 令牌接口没有返回access_token
+	ErrEmptyAccessToken = errors.New("httpclient: token endpoint returned empty access_token")
+	// DefaultTokenRefreshBefore 令牌过期前多久开始刷新
+	DefaultTokenRefreshBefore = 5 * time.Minute
+	// DefaultTokenLockWait 等待其他进程刷新令牌的最长时间，超时后自己获取
+	DefaultTokenLockWait = 3 * time.Second
+)
+
+// Token 访问令牌
+type Token struct {
+	AccessToken string    `json:"access_token"`
+	TokenType   string    `json:"token_type,omitempty"`
+	Expiry      time.Time `json:"expiry"`
+	// raw redis中保存的内容，用于比较删除
+	raw string
+}
+
+// valid 令牌在early之后仍然有效
+func (t *Token) valid(early time.Duration) bool {
+	return t != nil && t.AccessToken != "" && time.Now().Add(early).Before(t.Expiry)
+}
+
+// authorization Authorization请求头
+func (t *Token) authorization() string {
+	tokenType := t.TokenType
+	if tokenType == "" || strings.EqualFold(tokenType, "bearer") {
+		tokenType = "Bearer"
+	}
+	return tokenType + " " + t.AccessToken
+}
+
+// TokenSource 令牌来源，配置到ManagerOption.TokenSource后每个请求都会携带Authorization请求头
+type TokenSource interface {
+	// Token 获取有效的令牌
+	Token(ctx context.Context) (*Token, error)
+	// Invalidate 令牌被服务端拒绝(401)时调用，之后的Token需要重新获取
+	Invalidate(ctx context.Context, token *Token)
+}
+
+// ClientCredentialsConfig OAuth2 client_credentials 配置
+type ClientCredentialsConfig struct {
+	// TokenUrl 令牌接口地址
+	TokenUrl string
+	// Credentials ClientKey作为client_id，ClientSecret作为client_secret
+	Credentials *auth.Credentials
+	// Scopes 申请的权限范围
+	Scopes []string
+	// EndpointParams 令牌接口的其他参数
+	EndpointParams url.Values
+	// AuthInParams true时client_id、client_secret放在表单参数中，false时使用Basic认证
+	AuthInParams bool
+	// FetchToken 自定义获取令牌，对接非标准的令牌接口时使用，配置后忽略TokenUrl等参数
+	FetchToken func(ctx context.Context, credentials *auth.Credentials) (*Token, error)
+	// Client 请求令牌接口使用的客户端，默认client.DefaultClient
+	Client *client.Client
+	// RefreshBefore 令牌过期前多久开始刷新，默认DefaultTokenRefreshBefore
+	RefreshBefore time.Duration
+	// Redis 是否把令牌缓存到redis，多个副本共用一个令牌；使用ctx选择的redis实例
+	Redis bool
+	// RedisKey 令牌缓存的key，默认 http_oauth2_token:ClientKey
+	RedisKey string
+	// LockWait 等待其他进程刷新令牌的最长时间，默认DefaultTokenLockWait
+	LockWait time.Duration
+}
+
+// ClientCredentialsTokenSource OAuth2 client_credentials 令牌，内存缓存，可选redis缓存
+type ClientCredentialsTokenSource struct {
+	config   ClientCredentialsConfig
+	mu       sync.Mutex
+	token    *Token
+	rejected string // 被服务端拒绝的令牌，redis中读到时忽略
+	call     *tokenCall
+}
+
+// tokenCall 正在进行的刷新，并发刷新只会请求一次
+type tokenCall struct {
+	done  chan struct{}
+	token *Token
+	err   error
+}
+
+// NewClientCredentialsTokenSource
+// @Description: 创建OAuth2 client_credentials 令牌来源
+// @param config
+// @return *ClientCredentialsTokenSource
+func NewClientCredentialsTokenSource(config ClientCredentialsConfig) *ClientCredentialsTokenSource {
+	if config.Client == nil {
+		config.Client = &client.DefaultClient
+	}
+	if config.RefreshBefore <= 0 {
+		config.RefreshBefore = DefaultTokenRefreshBefore
+	}
+	if config.LockWait <= 0 {
+		config.LockWait = DefaultTokenLockWait
+	}
+	if config.RedisKey == "" && config.Credentials != nil {
+		config.RedisKey = "http_oauth2_token:" + config.Credentials.ClientKey
+	}
+	return &ClientCredentialsTokenSource{config: config}
+}
+
+// Token
+// @Description: 获取令牌，快过期时刷新；刷新失败但令牌还未过期时继续使用旧令牌
+// @receiver s
+// @param ctx
+// @return *Token
+// @return error
+func (s *ClientCredentialsTokenSource) Token(ctx context.Context) (*Token, error) {
+	s.mu.Lock()
+	if s.token.valid(s.config.RefreshBefore) {
+		token := s.token
+		s.mu.Unlock()
+		return token, nil
+	}
+	call := s.call
+	if call == nil {
+		call = &tokenCall{done: make(chan struct{})}
+		s.call = call
+		s.mu.Unlock()
+		call.token, call.err = s.refresh(ctx)
+		s.mu.Lock()
+		if call.err == nil {
+			s.token = call.token
+		}
+		s.call = nil
+		s.mu.Unlock()
+		close(call.done)
+	} else {
+		s.mu.Unlock()
+		select {
+		case <-call.done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	if call.err != nil {
+		s.mu.Lock()
+		token := s.token
+		s.mu.Unlock()
+		if token.valid(0) {
+			mylog.WithWarn(ctx, gopkg.LogHttp, map[string]interface{}{
+				"err": call.err.Error(),
+			}, "刷新令牌失败，继续使用未过期的令牌")
+			return token, nil
+		}
+		return nil, call.err
+	}
+	return call.token, nil
+}
+
+// Invalidate 丢弃被服务端拒绝的令牌，redis中的令牌一致时一起删除
+func (s *ClientCredentialsTokenSource) Invalidate(ctx context.Context, token *Token) {
+	if token == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.token != nil && s.token.AccessToken == token.AccessToken {
+		s.token = nil
+	}
+	s.rejected = token.AccessToken
+	s.mu.Unlock()
+	if s.config.Redis && token.raw != "" {
+		if err := redis.UnLock(ctx, s.config.RedisKey, token.raw); err != nil {
+			mylog.WithWarn(ctx, gopkg.LogHttp, map[string]interface{}{
+				"key": s.config.RedisKey,
+				"err": err.Error(),
+			}, "删除redis中的令牌失败")
+		}
+	}
+}
+
+// refresh 获取新令牌；使用redis时先读缓存，在分布式锁内获取并写入缓存
+func (s *ClientCredentialsTokenSource) refresh(ctx context.Context) (*Token, error) {
+	if !s.config.Redis {
+		return s.fetch(ctx)
+	}
+	if token := s.loadRedis(ctx); token != nil {
+		return token, nil
+	}
+	lockKey := s.config.RedisKey + ":lock"
+	lockValue := utils.GenUniqueId()
+	lockExpire := int64(s.config.LockWait/time.Second) + 10
+	locked, local, err := redis.LockLocalTimeout(ctx, lockKey, lockValue, lockExpire, s.config.LockWait, 50*time.Millisecond)
+	if err != nil {
+		mylog.WithWarn(ctx, gopkg.LogHttp, map[string]interface{}{
+			"key": lockKey,
+			"err": err.Error(),
+		}, "获取令牌刷新锁失败，直接获取令牌")
+	} else if locked && !local {
+		defer redis.UnLock(ctx, lockKey, lockValue)
+	}
+	// 等锁期间其他进程可能已经刷新
+	if token := s.loadRedis(ctx); token != nil {
+		return token, nil
+	}
+	token, err := s.fetch(ctx)
+	if err != nil {
+		return nil, err
+	}
+	s.storeRedis(ctx, token)
+	return token, nil
+}
+
+func (s *ClientCredentialsTokenSource) loadRedis(ctx context.Context) *Token {
+	raw, err := redis.Get(ctx, s.config.RedisKey).String()
+	if err != nil {
+		return nil
+	}
+	token := &Token{}
+	if err = json.Unmarshal([]byte(raw), token); err != nil || !token.valid(s.config.RefreshBefore) {
+		return nil
+	}
+	s.mu.Lock()
+	rejected := s.rejected
+	s.mu.Unlock()
+	if token.AccessToken == rejected {
+		return nil
+	}
+	token.raw = raw
+	return token
+}
+
+func (s *ClientCredentialsTokenSource) storeRedis(ctx context.Context, token *Token) {
+	expire := int64(time.Until(token.Expiry) / time.Second)
+	if expire < 1 {
+		return
+	}
+	b, err := json.Marshal(token)
+	if err == nil {
+		err = redis.Set(ctx, s.config.RedisKey, string(b), expire).Error()
+	}
+	if err != nil {
+		mylog.WithWarn(ctx, gopkg.LogHttp, map[string]interface{}{
+			"key": s.config.RedisKey,
+			"err": err.Error(),
+		}, "令牌写入redis失败")
+		return
+	}
+	token.raw = string(b)
+}
+
+// fetch 请求令牌接口
+func (s *ClientCredentialsTokenSource) fetch(ctx context.Context) (*Token, error) {
+	if s.config.FetchToken != nil {
+		return s.config.FetchToken(ctx, s.config.Credentials)
+	}
+	params := url.Values{"grant_type": {"client_credentials"}}
+	if len(s.config.Scopes) > 0 {
+		params.Set("scope", strings.Join(s.config.Scopes, " "))
+	}
+	for k, v := range s.config.EndpointParams {
+		params[k] = v
+	}
+	headers := http.Header{}
+	if s.config.AuthInParams {
+		params.Set("client_id", s.config.Credentials.ClientKey)
+		params.Set("client_secret", s.config.Credentials.ClientSecret)
+	} else {
+		headers.Set("Authorization", "Basic "+basicAuth(s.config.Credentials))
+	}
+	var ret struct {
+		AccessToken string `json:"access_token"`
+		TokenType   string `json:"token_type"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	if err := s.config.Client.CallWithForm(ctx, &ret, http.MethodPost, s.config.TokenUrl, headers, params); err != nil {
+		return nil, err
+	}
+	if ret.AccessToken == "" {
+		return nil, ErrEmptyAccessToken
+	}
+	return &Token{
+		AccessToken: ret.AccessToken,
+		TokenType:   ret.TokenType,
+		Expiry:      time.Now().Add(time.Duration(ret.ExpiresIn) * time.Second),
+	}, nil
+}
+
+func basicAuth(credentials *auth.Credentials) string {
+	req := http.Request{Header: http.Header{}}
+	req.SetBasicAuth(url.QueryEscape(credentials.ClientKey), url.QueryEscape(credentials.ClientSecret))
+	return strings.TrimPrefix(req.Header.Get("Authorization"), "Basic ")
+}
+
+// tokenRoundTrip 携带令牌发送请求，401时刷新令牌重试一次
+func tokenRoundTrip(source TokenSource, next http.RoundTripper, req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	token, err := source.Token(ctx)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := next.RoundTrip(withToken(req, token))
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+	// 请求体无法重放的不重试
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		return resp, nil
+	}
+	source.Invalidate(ctx, token)
+	newToken, err := source.Token(ctx)
+	if err != nil {
+		return resp, nil
+	}
+	retryReq := req.Clone(ctx)
+	if req.GetBody != nil {
+		if retryReq.Body, err = req.GetBody(); err != nil {
+			return resp, nil
+		}
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	mylog.WithInfo(ctx, gopkg.LogHttp, map[string]interface{}{
+		"req_url": req.URL.String(),
+	}, "令牌被拒绝，刷新令牌后重试")
+	return next.RoundTrip(withToken(retryReq, newToken))
+}
+
+// withToken 复制请求并设置Authorization请求头
+func withToken(req *http.Request, token *Token) *http.Request {
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", token.authorization())
+	return req
+}
@@ -0,0 +1,172 @@
+package httpclient
+
+import (
+	"context"
+	"fmt"
+	"github.com/youchuangcd/gopkg/redis"
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RateLimitError 限流快速失败时返回的错误
+type RateLimitError struct {
+	Key        string
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("httpclient: rate limit exceeded for %s, retry after %s", e.Key, e.RetryAfter)
+}
+
+// InvalidRateLimitRuleError 限流规则配置错误时NewRateLimiter返回的错误
+type InvalidRateLimitRuleError struct {
+	Key  string
+	Rate float64
+}
+
+func (e *InvalidRateLimitRuleError) Error() string {
+	return fmt.Sprintf("httpclient: rate limit rule %s has invalid rate %v, must be greater than 0", e.Key, e.Rate)
+}
+
+// RateLimitRule 限流规则，Host和Prefix二选一
+type RateLimitRule struct {
+	// Host 匹配请求的host，带端口时需要完全一致
+	Host string
+	// Prefix 匹配请求地址前缀，例如 https://oapi.dingtalk.com/robot/
+	Prefix string
+	// Rate 每秒生成的令牌数，必须大于0
+	Rate float64
+	// Burst 桶容量，小于1时按1处理
+	Burst int
+	// Wait true时阻塞等待令牌直到ctx结束，false时直接返回RateLimitError
+	Wait bool
+	// Redis 是否使用redis令牌桶，多个副本共享配额；使用ctx选择的redis实例
+	Redis bool
+	// RedisKey redis令牌桶的key，默认 http_rate_limit:Host或Prefix
+	RedisKey string
+}
+
+func (r RateLimitRule) key() string {
+	if r.Host != "" {
+		return r.Host
+	}
+	return r.Prefix
+}
+
+func (r RateLimitRule) match(req *http.Request) bool {
+	if r.Host != "" {
+		return req.URL.Host == r.Host || req.URL.Hostname() == r.Host
+	}
+	return r.Prefix != "" && strings.HasPrefix(req.URL.Scheme+"://"+req.URL.Host+req.URL.Path, r.Prefix)
+}
+
+// RateLimiter 按host或地址前缀的客户端限流，按规则顺序匹配第一个
+type RateLimiter struct {
+	rules   []RateLimitRule
+	buckets []*tokenBucket
+}
+
+// NewRateLimiter
+// @Description: 创建客户端限流
+// @param rules
+// @return *RateLimiter
+// @return error 规则的Rate不大于0时返回InvalidRateLimitRuleError
+func NewRateLimiter(rules ...RateLimitRule) (*RateLimiter, error) {
+	l := &RateLimiter{
+		rules:   make([]RateLimitRule, 0, len(rules)),
+		buckets: make([]*tokenBucket, 0, len(rules)),
+	}
+	for _, rule := range rules {
+		if rule.Rate <= 0 {
+			return nil, &InvalidRateLimitRuleError{Key: rule.key(), Rate: rule.Rate}
+		}
+		if rule.Burst < 1 {
+			rule.Burst = 1
+		}
+		if rule.RedisKey == "" {
+			rule.RedisKey = "http_rate_limit:" + rule.key()
+		}
+		l.rules = append(l.rules, rule)
+		l.buckets = append(l.buckets, newTokenBucket(rule.Rate, float64(rule.Burst)))
+	}
+	return l, nil
+}
+
+// Wait
+// @Description: 按匹配的规则获取令牌，没有匹配的规则时直接放行
+// @receiver l
+// @param ctx
+// @param req
+// @return error
+func (l *RateLimiter) Wait(ctx context.Context, req *http.Request) error {
+	for i, rule := range l.rules {
+		if rule.match(req) {
+			return l.take(ctx, rule, l.buckets[i])
+		}
+	}
+	return nil
+}
+
+func (l *RateLimiter) take(ctx context.Context, rule RateLimitRule, bucket *tokenBucket) error {
+	for {
+		var (
+			allowed    bool
+			retryAfter time.Duration
+			err        error
+		)
+		if rule.Redis {
+			allowed, _, retryAfter, err = redis.TokenBucketTake(ctx, rule.RedisKey, rule.Rate, int64(rule.Burst), 1)
+			if err != nil {
+				return err
+			}
+		} else {
+			allowed, retryAfter = bucket.take(time.Now())
+		}
+		if allowed {
+			return nil
+		}
+		if !rule.Wait {
+			return &RateLimitError{Key: rule.key(), RetryAfter: retryAfter}
+		}
+		timer := time.NewTimer(retryAfter)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// tokenBucket 本地令牌桶
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate, burst float64) *tokenBucket {
+	return &tokenBucket{rate: rate, burst: burst, tokens: burst}
+}
+
+// take 获取1个令牌，不足时返回需要等待的时间
+func (b *tokenBucket) take(now time.Time) (bool, time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.last.IsZero() && now.After(b.last) {
+		b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	}
+	if now.After(b.last) {
+		b.last = now
+	}
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration(math.Ceil((1 - b.tokens) / b.rate * float64(time.Second)))
+}
@@ -0,0 +1,370 @@
+// Package recorder 录制和回放http请求，用于测试依赖httpclient的代码
+//
+//	录制：m := httpclient.NewManagerV2(nil, timeout, recorder.New("testdata/order.json", recorder.ModeRecord))
+//	回放：m := httpclient.NewManagerV2(nil, timeout, recorder.New("testdata/order.json", recorder.ModeReplay))
+//	手写：m := httpclient.NewManagerV2(nil, timeout, recorder.NewStub().On("GET", url).ReplyJSON(200, ret).Recorder())
+package recorder
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	jsoniter "github.com/json-iterator/go"
+	"github.com/youchuangcd/gopkg"
+	"github.com/youchuangcd/gopkg/http-client/client"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// Mode 工作模式
+type Mode int
+
+const (
+	// ModeReplay 从录制文件回放，未匹配的请求返回UnmatchedRequestError
+	ModeReplay Mode = iota
+	// ModeRecord 发送真实请求并录制，调用Save写入录制文件
+	ModeRecord
+)
+
+// RedactedValue 脱敏后的请求头和url参数内容
+const RedactedValue = client.RedactedValue
+
+var (
+	json = jsoniter.ConfigCompatibleWithStandardLibrary
+	// DefaultRedactHeaders 默认脱敏的请求头和响应头，与调试日志一致
+	DefaultRedactHeaders = client.DefaultRedactHeaders
+	// DefaultRedactQueryParams 默认脱敏的url参数，与调试日志一致
+	DefaultRedactQueryParams = client.DefaultRedactQueryParams
+)
+
+// Interaction 一次请求和响应
+type Interaction struct {
+	Request  Request  `json:"request"`
+	Response Response `json:"response"`
+	// Times 可以匹配的次数，0表示不限次数
+	Times int `json:"times,omitempty"`
+	used  int
+}
+
+// Request 录制的请求
+type Request struct {
+	Method string      `json:"method"`
+	Url    string      `json:"url"`
+	Header http.Header `json:"header,omitempty"`
+	Body   Body        `json:"body,omitempty"`
+	// AnyBody 为true时不比较请求体
+	AnyBody bool `json:"any_body,omitempty"`
+}
+
+// Response 录制的响应
+type Response struct {
+	StatusCode int         `json:"status_code"`
+	Header     http.Header `json:"header,omitempty"`
+	Body       Body        `json:"body,omitempty"`
+}
+
+// Body 请求体或响应体，非utf8内容按base64保存
+type Body []byte
+
+func (b Body) MarshalJSON() ([]byte, error) {
+	if utf8.Valid(b) {
+		return json.Marshal(string(b))
+	}
+	return json.Marshal("base64:" + base64.StdEncoding.EncodeToString(b))
+}
+
+func (b *Body) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	if strings.HasPrefix(s, "base64:") {
+		decoded, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(s, "base64:"))
+		if err != nil {
+			return err
+		}
+		*b = decoded
+		return nil
+	}
+	*b = Body(s)
+	return nil
+}
+
+// UnmatchedRequestError 回放时没有匹配的录制
+type UnmatchedRequestError struct {
+	Method string
+	Url    string
+	Body   string
+}
+
+func (e *UnmatchedRequestError) Error() string {
+	return fmt.Sprintf("recorder: no recorded interaction matches %s %s body=%s", e.Method, e.Url, e.Body)
+}
+
+// Option 录制配置
+type Option struct {
+	// Transport 录制时发送真实请求使用的RoundTripper，默认gopkg.HttpClientDefaultTransport
+	Transport http.RoundTripper
+	// RedactHeaders 录制时脱敏的请求头和响应头
+	RedactHeaders []string
+	// RedactQueryParams 录制时脱敏的url参数，不区分大小写；回放时请求地址按同样的规则脱敏后匹配
+	RedactQueryParams []string
+}
+
+// SetOptionFunc 设置录制配置的方法
+type SetOptionFunc func(option Option) Option
+
+// Recorder 录制或回放请求的http.RoundTripper
+type Recorder struct {
+	path         string
+	mode         Mode
+	option       Option
+	mu           sync.Mutex
+	interactions []*Interaction
+	unmatched    []*UnmatchedRequestError
+}
+
+// New
+// @Description: 创建录制器，回放模式下录制文件不存在或格式错误会panic
+// @param path 录制文件路径
+// @param mode
+// @param optionFuncs
+// @return *Recorder
+func New(path string, mode Mode, optionFuncs ...SetOptionFunc) *Recorder {
+	option := Option{
+		Transport:         gopkg.HttpClientDefaultTransport,
+		RedactHeaders:     DefaultRedactHeaders,
+		RedactQueryParams: DefaultRedactQueryParams,
+	}
+	for _, optionFunc := range optionFuncs {
+		option = optionFunc(option)
+	}
+	r := &Recorder{path: path, mode: mode, option: option}
+	if mode == ModeReplay && path != "" {
+		if err := r.load(); err != nil {
+			panic(fmt.Sprintf("recorder: 读取录制文件%s失败: %v", path, err))
+		}
+	}
+	return r
+}
+
+func (r *Recorder) load() error {
+	data, err := os.ReadFile(r.path)
+	if err != nil {
+		return err
+	}
+	var file struct {
+		Interactions []*Interaction `json:"interactions"`
+	}
+	if err = json.Unmarshal(data, &file); err != nil {
+		return err
+	}
+	r.interactions = file.Interactions
+	return nil
+}
+
+// Save
+// @Description: 把录制的请求写入录制文件
+// @receiver r
+// @return error
+func (r *Recorder) Save() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	data, err := json.MarshalIndent(map[string]interface{}{"interactions": r.interactions}, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(r.path), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(r.path, data, 0644)
+}
+
+// Interactions 已录制或已加载的请求
+func (r *Recorder) Interactions() []*Interaction {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]*Interaction(nil), r.interactions...)
+}
+
+// Unmatched 回放时没有匹配到的请求
+func (r *Recorder) Unmatched() []*UnmatchedRequestError {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]*UnmatchedRequestError(nil), r.unmatched...)
+}
+
+// Unused 回放时一次都没有被匹配的录制
+func (r *Recorder) Unused() []*Interaction {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var unused []*Interaction
+	for _, v := range r.interactions {
+		if v.used == 0 {
+			unused = append(unused, v)
+		}
+	}
+	return unused
+}
+
+// RoundTrip 录制或回放请求
+func (r *Recorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	body, err := readRequestBody(req)
+	if err != nil {
+		return nil, err
+	}
+	if r.mode == ModeRecord {
+		return r.record(req, body)
+	}
+	return r.replay(req, body)
+}
+
+func (r *Recorder) record(req *http.Request, body []byte) (*http.Response, error) {
+	// 请求体已读取，复制请求后放回去，不修改调用方的请求
+	if req.Body != nil && req.Body != http.NoBody {
+		req = req.Clone(req.Context())
+		req.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	resp, err := r.option.Transport.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	respBody, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(respBody))
+	interaction := &Interaction{
+		Request: Request{
+			Method: req.Method,
+			Url:    r.redactUrl(req.URL),
+			Header: r.redact(req.Header),
+			Body:   body,
+		},
+		Response: Response{
+			StatusCode: resp.StatusCode,
+			Header:     r.redact(resp.Header),
+			Body:       respBody,
+		},
+	}
+	r.mu.Lock()
+	r.interactions = append(r.interactions, interaction)
+	r.mu.Unlock()
+	return resp, nil
+}
+
+func (r *Recorder) replay(req *http.Request, body []byte) (*http.Response, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, v := range r.interactions {
+		if v.Times > 0 && v.used >= v.Times {
+			continue
+		}
+		if !v.Request.match(req, r.redactUrl(req.URL), body) {
+			continue
+		}
+		v.used++
+		header := v.Response.Header.Clone()
+		if header == nil {
+			header = http.Header{}
+		}
+		return &http.Response{
+			Status:        fmt.Sprintf("%d %s", v.Response.StatusCode, http.StatusText(v.Response.StatusCode)),
+			StatusCode:    v.Response.StatusCode,
+			Proto:         "HTTP/1.1",
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			Header:        header,
+			Body:          io.NopCloser(bytes.NewReader(v.Response.Body)),
+			ContentLength: int64(len(v.Response.Body)),
+			Request:       req,
+		}, nil
+	}
+	e := &UnmatchedRequestError{Method: req.Method, Url: req.URL.String(), Body: string(body)}
+	r.unmatched = append(r.unmatched, e)
+	return nil, e
+}
+
+// redact 复制请求头并脱敏
+func (r *Recorder) redact(header http.Header) http.Header {
+	header = header.Clone()
+	for _, key := range r.option.RedactHeaders {
+		if _, ok := header[http.CanonicalHeaderKey(key)]; ok {
+			header.Set(key, RedactedValue)
+		}
+	}
+	return header
+}
+
+// redactUrl 脱敏url参数，没有需要脱敏的参数时原样返回
+func (r *Recorder) redactUrl(u *url.URL) string {
+	if u.RawQuery == "" {
+		return u.String()
+	}
+	values, err := url.ParseQuery(u.RawQuery)
+	if err != nil {
+		return u.String()
+	}
+	changed := false
+	for key := range values {
+		for _, v := range r.option.RedactQueryParams {
+			if strings.EqualFold(v, key) {
+				values[key] = []string{RedactedValue}
+				changed = true
+				break
+			}
+		}
+	}
+	if !changed {
+		return u.String()
+	}
+	c := *u
+	c.RawQuery = values.Encode()
+	return c.String()
+}
+
+// match 按请求方法、地址、请求体匹配，地址与原始地址或脱敏后的地址一致即可，JSON请求体忽略格式差异
+func (q Request) match(req *http.Request, redactedUrl string, body []byte) bool {
+	if !strings.EqualFold(q.Method, req.Method) || (q.Url != req.URL.String() && q.Url != redactedUrl) {
+		return false
+	}
+	if q.AnyBody || bytes.Equal(q.Body, body) {
+		return true
+	}
+	var expected, actual interface{}
+	if unmarshalJson(q.Body, &expected) != nil || unmarshalJson(body, &actual) != nil {
+		return false
+	}
+	return reflect.DeepEqual(expected, actual)
+}
+
+// unmarshalJson 数字按json.Number解析，避免大整数丢失精度
+func unmarshalJson(data []byte, v interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(v); err != nil {
+		return err
+	}
+	if decoder.More() {
+		return fmt.Errorf("recorder: invalid json")
+	}
+	return nil
+}
+
+// readRequestBody 读取并关闭请求体，不修改请求
+func readRequestBody(req *http.Request) ([]byte, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil, nil
+	}
+	body, err := io.ReadAll(req.Body)
+	req.Body.Close()
+	return body, err
+}
@@ -0,0 +1,100 @@
+package recorder_test
+
+import (
+	"context"
+	"errors"
+	httpclient "github.com/youchuangcd/gopkg/http-client"
+	"github.com/youchuangcd/gopkg/http-client/recorder"
+	"github.com/youchuangcd/gopkg/mylog"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	mylog.InitLog()
+	os.Exit(m.Run())
+}
+
+func TestRecordReplay(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Set-Cookie", "session=secret")
+		w.Write([]byte(`{"code":0,"data":{"id":1}}`))
+	}))
+	defer srv.Close()
+
+	path := filepath.Join(t.TempDir(), "golden.json")
+	rec := recorder.New(path, recorder.ModeRecord)
+	m := httpclient.NewManagerV2(nil, 5*time.Second, rec)
+	var ret map[string]interface{}
+	headers := http.Header{"Authorization": []string{"Bearer secret"}}
+	if err := m.Client.CallWithJson(context.Background(), &ret, http.MethodPost, srv.URL+"/order?access_token=secret&page=1", headers, map[string]int{"id": 1}); err != nil {
+		t.Fatal(err)
+	}
+	// 录制时不修改调用方的请求体
+	body := io.NopCloser(strings.NewReader(`{"id": 3}`))
+	req, _ := http.NewRequest(http.MethodPost, srv.URL+"/order", body)
+	resp, err := rec.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if req.Body != body {
+		t.Error("录制时不应该替换调用方的请求体")
+	}
+	if err := rec.Save(); err != nil {
+		t.Fatal(err)
+	}
+	golden, _ := os.ReadFile(path)
+	if strings.Contains(string(golden), "secret") {
+		t.Errorf("录制文件应该脱敏: %s", golden)
+	}
+
+	// 回放时服务已关闭
+	srv.Close()
+	rep := recorder.New(path, recorder.ModeReplay)
+	m = httpclient.NewManagerV2(nil, 5*time.Second, rep)
+	ret = nil
+	if err := m.Client.CallWithJson(context.Background(), &ret, http.MethodPost, srv.URL+"/order?access_token=other&page=1", nil, map[string]int{"id": 1}); err != nil {
+		t.Fatal(err)
+	}
+	if ret["code"] != float64(0) {
+		t.Errorf("回放响应不一致: %v", ret)
+	}
+
+	err = m.Client.CallWithJson(context.Background(), &ret, http.MethodPost, srv.URL+"/order?access_token=other&page=1", nil, map[string]int{"id": 2})
+	var unmatched *recorder.UnmatchedRequestError
+	if !errors.As(err, &unmatched) || len(rep.Unmatched()) != 1 {
+		t.Errorf("请求体不一致应该返回UnmatchedRequestError: %v", err)
+	}
+}
+
+func TestStub(t *testing.T) {
+	tr := recorder.NewStub().
+		On(http.MethodPost, "https://api.example.com/order").WithJSON(map[string]int{"id": 1}).ReplyJSON(http.StatusOK, map[string]int{"code": 0}).
+		On(http.MethodGet, "https://api.example.com/ping").Reply(http.StatusOK, "pong").Times(1).
+		Recorder()
+	m := httpclient.NewManagerV2(nil, 5*time.Second, tr)
+
+	var ret map[string]int
+	if err := m.Client.CallWithJson(context.Background(), &ret, http.MethodPost, "https://api.example.com/order", nil, map[string]int{"id": 1}); err != nil || ret["code"] != 0 {
+		t.Fatalf("ret %v err %v", ret, err)
+	}
+	resp, err := m.Client.Get("https://api.example.com/ping")
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("resp %v err %v", resp, err)
+	}
+	resp.Body.Close()
+	if _, err = m.Client.Get("https://api.example.com/ping"); err == nil {
+		t.Error("超过Times后应该返回未匹配错误")
+	}
+	if len(tr.Unused()) != 0 {
+		t.Errorf("所有录制都应该被使用: %v", tr.Unused())
+	}
+}
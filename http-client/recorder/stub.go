@@ -0,0 +1,95 @@
+package recorder
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// Stub 手写回放内容的构造器
+//
+//	tr := recorder.NewStub().
+//		On(http.MethodPost, "https://api.example.com/order").WithJSON(param).ReplyJSON(http.StatusOK, ret).
+//		On(http.MethodGet, "https://api.example.com/ping").Reply(http.StatusOK, "pong").Times(2).
+//		Recorder()
+type Stub struct {
+	recorder *Recorder
+	current  *Interaction
+}
+
+// NewStub
+// @Description: 创建手写回放内容的构造器
+// @return *Stub
+func NewStub() *Stub {
+	return &Stub{recorder: New("", ModeReplay)}
+}
+
+// On 新增一条录制，默认不比较请求体、响应200
+func (s *Stub) On(method, url string) *Stub {
+	s.current = &Interaction{
+		Request:  Request{Method: method, Url: url, AnyBody: true},
+		Response: Response{StatusCode: http.StatusOK, Header: http.Header{}},
+	}
+	s.recorder.interactions = append(s.recorder.interactions, s.current)
+	return s
+}
+
+// WithBody 要求请求体一致，JSON忽略格式差异
+func (s *Stub) WithBody(body string) *Stub {
+	s.mustCurrent("WithBody")
+	s.current.Request.Body = Body(body)
+	s.current.Request.AnyBody = false
+	return s
+}
+
+// WithJSON 要求请求体为v序列化后的JSON
+func (s *Stub) WithJSON(v interface{}) *Stub {
+	return s.WithBody(string(mustMarshal(v)))
+}
+
+// Reply 设置响应状态码和响应体
+func (s *Stub) Reply(statusCode int, body string) *Stub {
+	s.mustCurrent("Reply")
+	s.current.Response.StatusCode = statusCode
+	s.current.Response.Body = Body(body)
+	return s
+}
+
+// ReplyJSON 设置响应状态码和JSON响应体
+func (s *Stub) ReplyJSON(statusCode int, v interface{}) *Stub {
+	s.Reply(statusCode, string(mustMarshal(v)))
+	s.current.Response.Header.Set("Content-Type", "application/json")
+	return s
+}
+
+// Header 设置响应头
+func (s *Stub) Header(key, value string) *Stub {
+	s.mustCurrent("Header")
+	s.current.Response.Header.Set(key, value)
+	return s
+}
+
+// Times 最多匹配n次，超过后继续匹配后面的录制
+func (s *Stub) Times(n int) *Stub {
+	s.mustCurrent("Times")
+	s.current.Times = n
+	return s
+}
+
+// Recorder 返回可以传给NewManagerV2的RoundTripper
+func (s *Stub) Recorder() *Recorder {
+	return s.recorder
+}
+
+func (s *Stub) mustCurrent(name string) {
+	if s.current == nil {
+		panic(fmt.Sprintf("recorder: %s必须在On之后调用", name))
+	}
+}
+
+func mustMarshal(v interface{}) []byte {
+	b, err := json.Marshal(v)
+	if err != nil {
+		panic(fmt.Sprintf("recorder: 序列化失败: %v", err))
+	}
+	return b
+}
@@ -0,0 +1,287 @@
+package httpclient
+
+import (
+	"errors"
+	"fmt"
+	"github.com/nacos-group/nacos-sdk-go/model"
+	"github.com/youchuangcd/gopkg"
+	"github.com/youchuangcd/gopkg/mylog"
+	"github.com/youchuangcd/gopkg/nacos"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ServiceScheme 逻辑地址的scheme，例如 service://order-service/api/x
+const ServiceScheme = "service"
+
+var (
+	// ErrNoAvailableInstance 服务没有可用的实例
+	ErrNoAvailableInstance = errors.New("httpclient: no available service instance")
+	// DefaultInstanceFailureCooldown 实例请求失败后被跳过的时长
+	DefaultInstanceFailureCooldown = 10 * time.Second
+)
+
+// ServiceInstance 服务实例
+type ServiceInstance struct {
+	Ip      string
+	Port    uint64
+	Weight  float64
+	Healthy bool
+	Enable  bool
+	// Metadata 实例元数据，scheme=https 时使用https访问
+	Metadata map[string]string
+}
+
+// Addr 实例地址 ip:port
+func (i ServiceInstance) Addr() string {
+	return net.JoinHostPort(i.Ip, strconv.FormatUint(i.Port, 10))
+}
+
+// Resolver 根据服务名获取实例列表
+type Resolver interface {
+	Instances(serviceName string) ([]ServiceInstance, error)
+}
+
+// StaticResolver 固定实例列表，测试或不接入nacos时使用
+type StaticResolver map[string][]ServiceInstance
+
+// Instances 获取服务的实例列表
+func (r StaticResolver) Instances(serviceName string) ([]ServiceInstance, error) {
+	instances, ok := r[serviceName]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrNoAvailableInstance, serviceName)
+	}
+	return instances, nil
+}
+
+// NacosNaming NacosResolver使用的nacos服务发现接口，*nacos.Nacos实现了该接口
+type NacosNaming interface {
+	SelectInstances(serviceName string, groupName string, clusters []string, healthyOnly bool) ([]model.Instance, error)
+	Subscribe(param *nacos.SubscribeParam) error
+}
+
+// NacosResolver 基于nacos订阅的实例列表，首次请求某个服务时拉取并订阅，之后随nacos推送更新
+type NacosResolver struct {
+	Nacos     NacosNaming
+	GroupName string
+	Clusters  []string
+
+	mu       sync.RWMutex
+	services map[string][]ServiceInstance
+	// subscribing 每个服务一把锁，同一个服务只订阅一次；订阅时不持有mu，nacos可能同步执行回调
+	subscribing map[string]*sync.Mutex
+}
+
+// NewNacosResolver
+// @Description: 创建nacos服务发现，n需要通过nacos.NewNaming创建
+// @param n
+// @param groupName 默认值DEFAULT_GROUP
+// @param clusters 默认值DEFAULT
+// @return *NacosResolver
+func NewNacosResolver(n NacosNaming, groupName string, clusters []string) *NacosResolver {
+	return &NacosResolver{
+		Nacos:       n,
+		GroupName:   groupName,
+		Clusters:    clusters,
+		services:    make(map[string][]ServiceInstance),
+		subscribing: make(map[string]*sync.Mutex),
+	}
+}
+
+// Instances 获取服务的实例列表
+func (r *NacosResolver) Instances(serviceName string) ([]ServiceInstance, error) {
+	r.mu.RLock()
+	instances, ok := r.services[serviceName]
+	r.mu.RUnlock()
+	if ok {
+		return instances, nil
+	}
+	return r.subscribe(serviceName)
+}
+
+// subscribeLock 获取服务的订阅锁
+func (r *NacosResolver) subscribeLock(serviceName string) *sync.Mutex {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	l, ok := r.subscribing[serviceName]
+	if !ok {
+		l = &sync.Mutex{}
+		r.subscribing[serviceName] = l
+	}
+	return l
+}
+
+// subscribe 拉取实例列表并订阅变化
+func (r *NacosResolver) subscribe(serviceName string) ([]ServiceInstance, error) {
+	l := r.subscribeLock(serviceName)
+	l.Lock()
+	defer l.Unlock()
+	r.mu.RLock()
+	instances, ok := r.services[serviceName]
+	r.mu.RUnlock()
+	if ok {
+		return instances, nil
+	}
+	list, err := r.Nacos.SelectInstances(serviceName, r.GroupName, r.Clusters, true)
+	if err != nil {
+		return nil, err
+	}
+	instances = make([]ServiceInstance, 0, len(list))
+	for _, v := range list {
+		instances = append(instances, ServiceInstance{
+			Ip:       v.Ip,
+			Port:     v.Port,
+			Weight:   v.Weight,
+			Healthy:  v.Healthy,
+			Enable:   v.Enable,
+			Metadata: v.Metadata,
+		})
+	}
+	err = r.Nacos.Subscribe(&nacos.SubscribeParam{
+		ServiceName: serviceName,
+		GroupName:   r.GroupName,
+		Clusters:    r.Clusters,
+		SubscribeCallback: func(services []nacos.SubscribeService, err error) {
+			if err != nil {
+				mylog.WithError(nil, gopkg.LogNacos, map[string]interface{}{
+					"serviceName": serviceName,
+					"err":         err,
+				}, "nacos服务订阅回调出错")
+				return
+			}
+			updated := make([]ServiceInstance, 0, len(services))
+			for _, v := range services {
+				updated = append(updated, ServiceInstance{
+					Ip:       v.Ip,
+					Port:     v.Port,
+					Weight:   v.Weight,
+					Healthy:  v.Healthy && v.Valid,
+					Enable:   v.Enable,
+					Metadata: v.Metadata,
+				})
+			}
+			r.mu.Lock()
+			r.services[serviceName] = updated
+			r.mu.Unlock()
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	// 订阅期间回调已经写入的列表更新，不能用拉取的列表覆盖
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if current, ok := r.services[serviceName]; ok {
+		return current, nil
+	}
+	r.services[serviceName] = instances
+	return instances, nil
+}
+
+// serviceBalancer 按权重选择实例，跳过最近请求失败的实例
+type serviceBalancer struct {
+	resolver Resolver
+	cooldown time.Duration
+	mu       sync.Mutex
+	failed   map[string]time.Time // 实例地址 => 恢复时间
+}
+
+func newServiceBalancer(resolver Resolver, cooldown time.Duration) *serviceBalancer {
+	if cooldown <= 0 {
+		cooldown = DefaultInstanceFailureCooldown
+	}
+	return &serviceBalancer{
+		resolver: resolver,
+		cooldown: cooldown,
+		failed:   make(map[string]time.Time),
+	}
+}
+
+// pick 选择一个实例；可用实例都在失败冷却中时，从所有健康实例中选择
+func (b *serviceBalancer) pick(serviceName string) (instance ServiceInstance, err error) {
+	instances, err := b.resolver.Instances(serviceName)
+	if err != nil {
+		return
+	}
+	healthy := make([]ServiceInstance, 0, len(instances))
+	for _, v := range instances {
+		if v.Healthy && v.Enable && v.Weight > 0 {
+			healthy = append(healthy, v)
+		}
+	}
+	if len(healthy) == 0 {
+		err = fmt.Errorf("%w: %s", ErrNoAvailableInstance, serviceName)
+		return
+	}
+	now := time.Now()
+	available := make([]ServiceInstance, 0, len(healthy))
+	b.mu.Lock()
+	for _, v := range healthy {
+		if until, ok := b.failed[v.Addr()]; ok {
+			if now.Before(until) {
+				continue
+			}
+			delete(b.failed, v.Addr())
+		}
+		available = append(available, v)
+	}
+	b.mu.Unlock()
+	if len(available) == 0 {
+		available = healthy
+	}
+	return weightedRandom(available), nil
+}
+
+// markFailed 实例请求失败，冷却期内不再选择
+func (b *serviceBalancer) markFailed(addr string) {
+	b.mu.Lock()
+	b.failed[addr] = time.Now().Add(b.cooldown)
+	b.mu.Unlock()
+}
+
+func weightedRandom(instances []ServiceInstance) ServiceInstance {
+	var total float64
+	for _, v := range instances {
+		total += v.Weight
+	}
+	r := rand.Float64() * total
+	for _, v := range instances {
+		if r < v.Weight {
+			return v
+		}
+		r -= v.Weight
+	}
+	return instances[len(instances)-1]
+}
+
+// roundTrip 把逻辑地址替换为实例地址后发送请求
+func (b *serviceBalancer) roundTrip(next http.RoundTripper, req *http.Request) (resp *http.Response, err error) {
+	serviceName := req.URL.Host
+	instance, err := b.pick(serviceName)
+	if err != nil {
+		return nil, err
+	}
+	scheme := "http"
+	if s := instance.Metadata["scheme"]; s != "" {
+		scheme = s
+	}
+	// RoundTripper不能修改调用方的请求，复制一份再改写地址
+	req = req.Clone(req.Context())
+	req.URL.Scheme = scheme
+	req.URL.Host = instance.Addr()
+	req.Host = ""
+	resp, err = next.RoundTrip(req)
+	if err != nil && req.Context().Err() == nil {
+		b.markFailed(instance.Addr())
+		mylog.WithWarn(req.Context(), gopkg.LogHttp, map[string]interface{}{
+			"service":  serviceName,
+			"instance": instance.Addr(),
+			"err":      err.Error(),
+		}, "服务实例请求失败，暂时跳过该实例")
+	}
+	return
+}
@@ -0,0 +1,213 @@
+package httpclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/youchuangcd/gopkg"
+	"github.com/youchuangcd/gopkg/mylog"
+	"io"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+var (
+	// DefaultRetryableStatusCodes 默认可重试的响应状态码
+	DefaultRetryableStatusCodes = []int{
+		http.StatusTooManyRequests,
+		http.StatusBadGateway,
+		http.StatusServiceUnavailable,
+		http.StatusGatewayTimeout,
+	}
+	// idempotentMethods 幂等的请求方法，默认只重试这些方法
+	idempotentMethods = map[string]bool{
+		http.MethodGet:     true,
+		http.MethodHead:    true,
+		http.MethodOptions: true,
+		http.MethodTrace:   true,
+		http.MethodPut:     true,
+		http.MethodDelete:  true,
+	}
+)
+
+// RetryPolicy 重试策略
+type RetryPolicy struct {
+	// MaxAttempts 最大尝试次数，包含首次请求；小于等于1时不重试
+	MaxAttempts int
+	// BaseDelay 第一次重试前的等待时间，之后按Multiplier指数增长
+	BaseDelay time.Duration
+	// MaxDelay 单次等待时间上限
+	MaxDelay time.Duration
+	// Multiplier 退避倍数，小于1时按2处理
+	Multiplier float64
+	// Jitter 随机抖动比例[0,1]，实际等待时间在 delay*(1-Jitter) ~ delay 之间
+	Jitter float64
+	// RetryableStatusCodes 可重试的响应状态码
+	RetryableStatusCodes []int
+	// RetryableError 判断错误是否可重试，为nil时使用IsRetryableError
+	RetryableError func(err error) bool
+	// RetryNonIdempotent 是否重试POST、PATCH等非幂等请求；请求头带Idempotency-Key的视为幂等
+	RetryNonIdempotent bool
+}
+
+// DefaultRetryPolicy
+// @Description: 默认重试策略：最多3次，100ms起指数退避，最多等待2s
+// @return *RetryPolicy
+func DefaultRetryPolicy() *RetryPolicy {
+	return &RetryPolicy{
+		MaxAttempts:          3,
+		BaseDelay:            100 * time.Millisecond,
+		MaxDelay:             2 * time.Second,
+		Multiplier:           2,
+		Jitter:               0.2,
+		RetryableStatusCodes: DefaultRetryableStatusCodes,
+	}
+}
+
+// IsRetryableError
+// @Description: 默认的错误重试判断：超时、连接被拒绝、连接被重置、连接意外断开
+// @param err
+// @return bool
+func IsRetryableError(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, context.Canceled) {
+		return false
+	}
+	if errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF) ||
+		errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) {
+		return true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	return false
+}
+
+// canRetryRequest 请求方法是否允许重试
+func (p *RetryPolicy) canRetryRequest(req *http.Request) bool {
+	if p.RetryNonIdempotent || idempotentMethods[req.Method] {
+		return true
+	}
+	_, ok := req.Header["Idempotency-Key"]
+	return ok
+}
+
+func (p *RetryPolicy) retryableStatus(statusCode int) bool {
+	for _, code := range p.RetryableStatusCodes {
+		if code == statusCode {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *RetryPolicy) retryableError(err error) bool {
+	if p.RetryableError != nil {
+		return p.RetryableError(err)
+	}
+	return IsRetryableError(err)
+}
+
+// backoff 计算第attempt次请求失败后的等待时间
+func (p *RetryPolicy) backoff(attempt int, resp *http.Response) time.Duration {
+	// 服务端通过Retry-After明确告知等待秒数的，优先使用
+	if resp != nil {
+		if sec, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && sec >= 0 {
+			delay := time.Duration(sec) * time.Second
+			if p.MaxDelay > 0 && delay > p.MaxDelay {
+				delay = p.MaxDelay
+			}
+			return delay
+		}
+	}
+	multiplier := p.Multiplier
+	if multiplier < 1 {
+		multiplier = 2
+	}
+	delay := float64(p.BaseDelay) * math.Pow(multiplier, float64(attempt-1))
+	if p.MaxDelay > 0 && delay > float64(p.MaxDelay) {
+		delay = float64(p.MaxDelay)
+	}
+	if p.Jitter > 0 {
+		jitter := math.Min(p.Jitter, 1)
+		delay -= delay * jitter * rand.Float64()
+	}
+	return time.Duration(delay)
+}
+
+// roundTrip 按重试策略发送请求
+func (p *RetryPolicy) roundTrip(next http.RoundTripper, req *http.Request) (resp *http.Response, err error) {
+	ctx := req.Context()
+	maxAttempts := p.MaxAttempts
+	// 请求体无法重放的不重试
+	if maxAttempts < 1 || !p.canRetryRequest(req) || (req.Body != nil && req.Body != http.NoBody && req.GetBody == nil) {
+		maxAttempts = 1
+	}
+	for attempt := 1; ; attempt++ {
+		attemptReq := req
+		if attempt > 1 {
+			attemptReq = req.Clone(ctx)
+			if req.GetBody != nil {
+				if attemptReq.Body, err = req.GetBody(); err != nil {
+					return nil, err
+				}
+			}
+		}
+		startTime := time.Now()
+		resp, err = next.RoundTrip(attemptReq)
+		retry := attempt < maxAttempts && ctx.Err() == nil &&
+			((err != nil && p.retryableError(err)) || (err == nil && p.retryableStatus(resp.StatusCode)))
+		logAttempt(ctx, req, attempt, maxAttempts, time.Since(startTime), resp, err, retry)
+		if !retry {
+			return
+		}
+		delay := p.backoff(attempt, resp)
+		if resp != nil {
+			// 丢弃本次响应，复用连接
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// logAttempt 记录每一次请求尝试
+func logAttempt(ctx context.Context, req *http.Request, attempt, maxAttempts int, latencyTime time.Duration,
+	resp *http.Response, err error, retry bool) {
+	logContent := map[string]interface{}{
+		"attempt":          attempt,
+		"max_attempts":     maxAttempts,
+		"method":           req.Method,
+		"req_url":          req.URL.String(),
+		"latency_time_str": latencyTime.String(),
+		"latency_time":     float64(latencyTime.Nanoseconds()) / 1e6,
+	}
+	if resp != nil {
+		logContent["status"] = resp.StatusCode
+	}
+	if err != nil {
+		logContent["err"] = err.Error()
+	}
+	switch {
+	case retry:
+		mylog.WithWarn(ctx, gopkg.LogHttp, logContent, fmt.Sprintf("http请求第%d次失败，准备重试", attempt))
+	case attempt > 1:
+		mylog.WithInfo(ctx, gopkg.LogHttp, logContent, fmt.Sprintf("http请求第%d次结束，不再重试", attempt))
+	default:
+		mylog.WithDebug(ctx, gopkg.LogHttp, logContent, "http请求第1次结束")
+	}
+}
@@ -0,0 +1,28 @@
+package middleware
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/youchuangcd/gopkg"
+	"github.com/youchuangcd/gopkg/common/utils"
+	"github.com/youchuangcd/gopkg/http-client/auth"
+	"github.com/youchuangcd/gopkg/mylog"
+)
+
+// VerifySign 验证请求签名，验签通过后把请求方的ClientKey放到上下文
+func VerifySign(verifier *auth.Verifier) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		credentials, err := verifier.Verify(c.Request)
+		if err != nil {
+			mylog.WithWarn(c, gopkg.LogCtx, map[string]interface{}{
+				"err":        err.Error(),
+				"client_key": c.Request.Header.Get(auth.HeaderClientKey),
+				"request":    c.Request.Method + " " + c.Request.URL.String(),
+			}, "请求签名验证失败")
+			utils.ToJson(c, gopkg.InvalidSign, nil)
+			c.Abort()
+			return
+		}
+		c.Set(gopkg.ContextRequestClientKey, credentials.ClientKey)
+		c.Next()
+	}
+}
@@ -281,6 +281,26 @@ func (p *Nacos) SelectOneHealthyInstance(serviceName string, groupName string, c
 	return
 }
 
+// SelectInstances
+//
+//	@Description: 获取服务的实例列表
+//	@receiver p
+//	@param serviceName
+//	@param groupName 默认值DEFAULT_GROUP
+//	@param clusters 默认值DEFAULT
+//	@param healthyOnly 是否只返回健康的实例
+//	@return instances
+//	@return err
+func (p *Nacos) SelectInstances(serviceName string, groupName string, clusters []string, healthyOnly bool) (instances []model.Instance, err error) {
+	instances, err = p.namingClient.SelectInstances(vo.SelectInstancesParam{
+		ServiceName: serviceName,
+		GroupName:   groupName,
+		Clusters:    clusters,
+		HealthyOnly: healthyOnly,
+	})
+	return
+}
+
 type SubscribeParam struct {
 	ServiceName       string                                       `param:"serviceName"` //required
 	Clusters          []string                                     `param:"clusters"`    //optional,default:DEFAULT
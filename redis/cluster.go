@@ -0,0 +1,663 @@
+package redis
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/gomodule/redigo/redis"
+	"github.com/youchuangcd/gopkg"
+	"github.com/youchuangcd/gopkg/mylog"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// clusterSlots 集群slot数量
+	clusterSlots = 16384
+	// clusterMaxRedirects 一个命令最多跟随重定向的次数
+	clusterMaxRedirects = 5
+	// clusterRefreshInterval 两次刷新slot信息的最小间隔
+	clusterRefreshInterval = 100 * time.Millisecond
+)
+
+var (
+	// ErrClusterTooManyRedirects 重定向次数超过限制
+	ErrClusterTooManyRedirects = errors.New("redis: too many cluster redirects")
+	// ErrClusterNoNode 没有可用的集群节点
+	ErrClusterNoNode = errors.New("redis: no cluster node available")
+	// errClusterConnClosed 连接已关闭
+	errClusterConnClosed = errors.New("redis: cluster connection closed")
+	// errClusterNoPending 没有发送过命令就读取响应
+	errClusterNoPending = errors.New("redis: cluster connection has no pending reply")
+
+	// clusterKeylessCommands 不带key的命令，随机发送到一个master
+	clusterKeylessCommands = map[string]bool{
+		"PING": true, "ECHO": true, "INFO": true, "TIME": true, "DBSIZE": true, "KEYS": true, "SCAN": true,
+		"RANDOMKEY": true, "FLUSHDB": true, "FLUSHALL": true, "CONFIG": true, "CLIENT": true, "CLUSTER": true,
+		"COMMAND": true, "SLOWLOG": true, "LASTSAVE": true, "WAIT": true, "AUTH": true, "SELECT": true,
+		"MULTI": true, "EXEC": true, "DISCARD": true, "UNWATCH": true, "SCRIPT": true, "FUNCTION": true,
+	}
+	// clusterSplitCommands 参数全部是key的多key命令，key不在同一个slot时按slot拆分发送，结果合并
+	clusterSplitCommands = map[string]bool{"DEL": true, "UNLINK": true, "EXISTS": true, "TOUCH": true, "MGET": true}
+)
+
+// cluster 集群模式下维护slot到master的映射和每个节点的连接池
+type cluster struct {
+	config Config
+
+	mu      sync.RWMutex
+	slots   []string // 每个slot所在master的地址
+	masters []string
+	pools   map[string]*redis.Pool
+
+	refreshMu   sync.Mutex
+	lastRefresh time.Time
+}
+
+func newCluster(v Config) *cluster {
+	return &cluster{
+		config: v,
+		pools:  make(map[string]*redis.Pool),
+	}
+}
+
+// seedAddrs 配置的种子节点，没有配置Addrs时使用Host、Port
+func (c *cluster) seedAddrs() []string {
+	if len(c.config.Addrs) > 0 {
+		return c.config.Addrs
+	}
+	return []string{fmt.Sprintf("%s:%d", c.config.Host, c.config.Port)}
+}
+
+func (c *cluster) seedAddr() string {
+	return c.seedAddrs()[0]
+}
+
+// nodePool 获取节点的连接池，没有时创建
+func (c *cluster) nodePool(addr string) *redis.Pool {
+	c.mu.RLock()
+	p := c.pools[addr]
+	c.mu.RUnlock()
+	if p != nil {
+		return p
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if p = c.pools[addr]; p == nil {
+		p = newNodePool(c.config, func(ctx context.Context) (redis.Conn, error) {
+			return dialNode(ctx, c.config, addr)
+		})
+		c.pools[addr] = p
+	}
+	return p
+}
+
+// refresh 同步刷新slot信息，刚刷新过时直接返回
+func (c *cluster) refresh(ctx context.Context) error {
+	c.refreshMu.Lock()
+	defer c.refreshMu.Unlock()
+	if time.Since(c.lastRefresh) < clusterRefreshInterval {
+		return nil
+	}
+	return c.reload(ctx)
+}
+
+// triggerRefresh 异步刷新slot信息，已经在刷新时跳过
+func (c *cluster) triggerRefresh() {
+	if !c.refreshMu.TryLock() {
+		return
+	}
+	go func() {
+		defer c.refreshMu.Unlock()
+		if time.Since(c.lastRefresh) >= clusterRefreshInterval {
+			c.reload(context.Background())
+		}
+	}()
+}
+
+// reload 依次向已知的节点查询 CLUSTER SLOTS，调用方需持有refreshMu
+func (c *cluster) reload(ctx context.Context) error {
+	c.mu.RLock()
+	addrs := append([]string{}, c.masters...)
+	c.mu.RUnlock()
+	for _, addr := range c.seedAddrs() {
+		if !inSlice(addrs, addr) {
+			addrs = append(addrs, addr)
+		}
+	}
+	var lastErr error = ErrClusterNoNode
+	for _, addr := range addrs {
+		slots, masters, err := c.loadSlots(ctx, addr)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		c.mu.Lock()
+		c.slots, c.masters = slots, masters
+		c.mu.Unlock()
+		c.lastRefresh = time.Now()
+		return nil
+	}
+	mylog.WithError(ctx, gopkg.LogRedis, map[string]interface{}{
+		"name":  c.config.Name,
+		"addrs": addrs,
+		"err":   lastErr.Error(),
+	}, "获取redis集群slot信息失败")
+	return lastErr
+}
+
+// loadSlots 解析 CLUSTER SLOTS：[[start, end, [ip, port, id], 从节点...], ...]
+func (c *cluster) loadSlots(ctx context.Context, addr string) (slots, masters []string, err error) {
+	conn, err := c.nodePool(addr).GetContext(ctx)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	items, err := redis.Values(redis.DoContext(conn, ctx, "CLUSTER", "SLOTS"))
+	if err != nil {
+		return
+	}
+	slots = make([]string, clusterSlots)
+	for _, item := range items {
+		fields, _ := redis.Values(item, nil)
+		if len(fields) < 3 {
+			continue
+		}
+		start, _ := redis.Int(fields[0], nil)
+		end, _ := redis.Int(fields[1], nil)
+		node, _ := redis.Values(fields[2], nil)
+		if len(node) < 2 || start < 0 || end >= clusterSlots {
+			continue
+		}
+		host, _ := redis.String(node[0], nil)
+		port, _ := redis.Int(node[1], nil)
+		master := nodeAddr(addr, host, strconv.Itoa(port))
+		for i := start; i <= end; i++ {
+			slots[i] = master
+		}
+		if !inSlice(masters, master) {
+			masters = append(masters, master)
+		}
+	}
+	if len(masters) == 0 {
+		return nil, nil, fmt.Errorf("redis: no slots served by cluster node %s", addr)
+	}
+	return
+}
+
+// addrForKey 获取key所在的master地址，不带key时随机选择一个master
+func (c *cluster) addrForKey(ctx context.Context, key string, hasKey bool) (string, error) {
+	c.mu.RLock()
+	loaded := c.masters != nil
+	c.mu.RUnlock()
+	if !loaded {
+		if err := c.refresh(ctx); err != nil {
+			return "", err
+		}
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if hasKey {
+		if addr := c.slots[keySlot(key)]; addr != "" {
+			return addr, nil
+		}
+	}
+	if len(c.masters) == 0 {
+		return "", ErrClusterNoNode
+	}
+	return c.masters[rand.Intn(len(c.masters))], nil
+}
+
+func (c *cluster) setSlot(slot int, addr string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.slots != nil && slot >= 0 && slot < clusterSlots {
+		c.slots[slot] = addr
+	}
+}
+
+// do 发送一个命令，跟随MOVED、ASK重定向；TRYAGAIN、CLUSTERDOWN时稍后重试
+func (c *cluster) do(ctx context.Context, key string, hasKey bool, cmd string, args []interface{}) (interface{}, error) {
+	var (
+		addr   string
+		asking bool
+		err    error
+	)
+	for attempt := 0; attempt <= clusterMaxRedirects; attempt++ {
+		if addr == "" {
+			if addr, err = c.addrForKey(ctx, key, hasKey); err != nil {
+				return nil, err
+			}
+		}
+		conn, cErr := c.nodePool(addr).GetContext(ctx)
+		if cErr != nil {
+			// 节点连接失败，可能发生了故障转移，刷新后重试
+			conn.Close()
+			err = cErr
+			if ctx.Err() != nil {
+				return nil, err
+			}
+			c.refresh(ctx)
+			addr, asking = "", false
+			continue
+		}
+		if asking {
+			if _, err = redis.DoContext(conn, ctx, "ASKING"); err != nil {
+				conn.Close()
+				return nil, err
+			}
+		}
+		var reply interface{}
+		reply, err = redis.DoContext(conn, ctx, cmd, args...)
+		conn.Close()
+		e, ok := err.(redis.Error)
+		if !ok {
+			if err != nil && ctx.Err() == nil {
+				// 命令可能已经执行，不重试，只刷新slot信息
+				c.triggerRefresh()
+			}
+			return reply, err
+		}
+		msg := string(e)
+		switch {
+		case strings.HasPrefix(msg, "MOVED "):
+			slot, target, ok := parseRedirect(msg, addr)
+			if !ok {
+				return reply, err
+			}
+			c.setSlot(slot, target)
+			c.triggerRefresh()
+			addr, asking = target, false
+		case strings.HasPrefix(msg, "ASK "):
+			_, target, ok := parseRedirect(msg, addr)
+			if !ok {
+				return reply, err
+			}
+			addr, asking = target, true
+		case strings.HasPrefix(msg, "TRYAGAIN"), strings.HasPrefix(msg, "CLUSTERDOWN"):
+			timer := time.NewTimer(time.Duration(attempt+1) * 50 * time.Millisecond)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return nil, ctx.Err()
+			case <-timer.C:
+			}
+			addr, asking = "", false
+		default:
+			return reply, err
+		}
+	}
+	return nil, ErrClusterTooManyRedirects
+}
+
+// broadcast 发送到所有master，用于 SCRIPT LOAD 等需要在每个节点执行的命令
+func (c *cluster) broadcast(ctx context.Context, cmd string, args []interface{}) (reply interface{}, err error) {
+	masters, err := c.masterAddrs(ctx)
+	if err != nil {
+		return
+	}
+	for _, addr := range masters {
+		conn, cErr := c.nodePool(addr).GetContext(ctx)
+		if cErr != nil {
+			conn.Close()
+			return nil, cErr
+		}
+		reply, err = redis.DoContext(conn, ctx, cmd, args...)
+		conn.Close()
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// doSplit 多key命令按slot拆分发送，DEL、UNLINK、EXISTS、TOUCH的结果相加，MGET的结果按key原来的顺序合并；
+// 拆分后不是原子操作，某个slot失败时返回错误，已发送的命令不会回滚
+func (c *cluster) doSplit(ctx context.Context, cmd, commandName string, args []interface{}) (interface{}, error) {
+	groups := make(map[int][]int)
+	slots := make([]int, 0, 1)
+	for i, arg := range args {
+		slot := keySlot(argString(arg))
+		if _, ok := groups[slot]; !ok {
+			slots = append(slots, slot)
+		}
+		groups[slot] = append(groups[slot], i)
+	}
+	if len(slots) == 1 {
+		return c.do(ctx, argString(args[0]), true, commandName, args)
+	}
+	var (
+		sum    int64
+		values = make([]interface{}, len(args))
+	)
+	for _, slot := range slots {
+		indexes := groups[slot]
+		slotArgs := make([]interface{}, len(indexes))
+		for i, index := range indexes {
+			slotArgs[i] = args[index]
+		}
+		reply, err := c.do(ctx, argString(slotArgs[0]), true, commandName, slotArgs)
+		if err != nil {
+			return nil, err
+		}
+		if cmd != "MGET" {
+			n, err := redis.Int64(reply, nil)
+			if err != nil {
+				return nil, err
+			}
+			sum += n
+			continue
+		}
+		slotValues, err := redis.Values(reply, nil)
+		if err != nil {
+			return nil, err
+		}
+		if len(slotValues) != len(indexes) {
+			return nil, fmt.Errorf("redis: %s returned %d values for %d keys", cmd, len(slotValues), len(indexes))
+		}
+		for i, index := range indexes {
+			values[index] = slotValues[i]
+		}
+	}
+	if cmd == "MGET" {
+		return values, nil
+	}
+	return sum, nil
+}
+
+// masterAddrs 所有master的地址，还没有加载slot信息时先加载
+func (c *cluster) masterAddrs(ctx context.Context) ([]string, error) {
+	if _, err := c.addrForKey(ctx, "", false); err != nil {
+		return nil, err
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return append([]string{}, c.masters...), nil
+}
+
+// conn 创建一个集群连接
+func (c *cluster) conn() redis.Conn {
+	return &clusterConn{cluster: c}
+}
+
+func (c *cluster) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, p := range c.pools {
+		p.Close()
+	}
+	c.pools = make(map[string]*redis.Pool)
+}
+
+// multi状态：收到MULTI后还不知道事务在哪个节点执行，等到第一个带key的命令再发送
+const (
+	multiNone = iota
+	multiDo
+	multiSend
+)
+
+// clusterConn 集群模式的连接
+//
+// Do按key路由，每个命令独立获取对应节点的连接，DEL、UNLINK、EXISTS、TOUCH、MGET的key不在同一个slot时按slot拆分；
+// Send(pipeline)、WATCH、MULTI之后连接固定到第一个带key的命令所在的节点，直到Close，
+// 这期间不跟随重定向，所有key需要在同一个slot（可以使用{hash tag}）
+type clusterConn struct {
+	cluster *cluster
+	pinned  redis.Conn
+	multi   int
+	err     error
+}
+
+// pin 固定到key所在节点的连接
+func (c *clusterConn) pin(ctx context.Context, key string, hasKey bool) error {
+	addr, err := c.cluster.addrForKey(ctx, key, hasKey)
+	if err != nil {
+		return err
+	}
+	conn, err := c.cluster.nodePool(addr).GetContext(ctx)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	c.pinned = conn
+	switch c.multi {
+	case multiDo:
+		_, err = redis.DoContext(conn, ctx, "MULTI")
+	case multiSend:
+		err = conn.Send("MULTI")
+	}
+	c.multi = multiNone
+	return err
+}
+
+func (c *clusterConn) Do(commandName string, args ...interface{}) (interface{}, error) {
+	return c.DoContext(context.Background(), commandName, args...)
+}
+
+// DoWithTimeout 用于XREADGROUP、BLPOP等阻塞命令，固定到key所在节点后使用指定的读取超时
+func (c *clusterConn) DoWithTimeout(timeout time.Duration, commandName string, args ...interface{}) (interface{}, error) {
+	if c.err != nil {
+		return nil, c.err
+	}
+	if c.pinned == nil {
+		key, hasKey := commandKey(strings.ToUpper(commandName), args)
+		if err := c.pin(context.Background(), key, hasKey); err != nil {
+			return nil, err
+		}
+	}
+	return redis.DoWithTimeout(c.pinned, timeout, commandName, args...)
+}
+
+func (c *clusterConn) DoContext(ctx context.Context, commandName string, args ...interface{}) (interface{}, error) {
+	if c.err != nil {
+		return nil, c.err
+	}
+	if c.pinned != nil {
+		return redis.DoContext(c.pinned, ctx, commandName, args...)
+	}
+	cmd := strings.ToUpper(commandName)
+	switch {
+	case cmd == "":
+		// 没有待读取的响应
+		return nil, nil
+	case cmd == "MULTI":
+		c.multi = multiDo
+		return "OK", nil
+	case c.multi != multiNone && cmd == "EXEC":
+		c.multi = multiNone
+		return []interface{}{}, nil
+	case c.multi != multiNone && cmd == "DISCARD":
+		c.multi = multiNone
+		return "OK", nil
+	case cmd == "WATCH" || c.multi != multiNone:
+		key, hasKey := commandKey(cmd, args)
+		if err := c.pin(ctx, key, hasKey); err != nil {
+			return nil, err
+		}
+		return redis.DoContext(c.pinned, ctx, commandName, args...)
+	case cmd == "SCRIPT":
+		return c.cluster.broadcast(ctx, commandName, args)
+	case clusterSplitCommands[cmd] && len(args) > 1:
+		return c.cluster.doSplit(ctx, cmd, commandName, args)
+	}
+	key, hasKey := commandKey(cmd, args)
+	return c.cluster.do(ctx, key, hasKey, commandName, args)
+}
+
+func (c *clusterConn) Send(commandName string, args ...interface{}) error {
+	if c.err != nil {
+		return c.err
+	}
+	if c.pinned == nil {
+		cmd := strings.ToUpper(commandName)
+		key, hasKey := commandKey(cmd, args)
+		if cmd == "MULTI" {
+			c.multi = multiSend
+			return nil
+		}
+		if err := c.pin(context.Background(), key, hasKey); err != nil {
+			return err
+		}
+	}
+	return c.pinned.Send(commandName, args...)
+}
+
+func (c *clusterConn) Flush() error {
+	if c.err != nil {
+		return c.err
+	}
+	if c.pinned == nil {
+		return nil
+	}
+	return c.pinned.Flush()
+}
+
+func (c *clusterConn) Receive() (interface{}, error) {
+	return c.ReceiveContext(context.Background())
+}
+
+func (c *clusterConn) ReceiveContext(ctx context.Context) (interface{}, error) {
+	if c.err != nil {
+		return nil, c.err
+	}
+	if c.pinned == nil {
+		return nil, errClusterNoPending
+	}
+	return redis.ReceiveContext(c.pinned, ctx)
+}
+
+func (c *clusterConn) ReceiveWithTimeout(timeout time.Duration) (interface{}, error) {
+	if c.err != nil {
+		return nil, c.err
+	}
+	if c.pinned == nil {
+		return nil, errClusterNoPending
+	}
+	return redis.ReceiveWithTimeout(c.pinned, timeout)
+}
+
+func (c *clusterConn) Err() error {
+	if c.err != nil {
+		return c.err
+	}
+	if c.pinned != nil {
+		return c.pinned.Err()
+	}
+	return nil
+}
+
+func (c *clusterConn) Close() (err error) {
+	if c.err != nil {
+		return nil
+	}
+	if c.pinned != nil {
+		err = c.pinned.Close()
+		c.pinned = nil
+	}
+	c.err = errClusterConnClosed
+	return
+}
+
+// commandKey 获取命令中用于路由的key
+func commandKey(cmd string, args []interface{}) (string, bool) {
+	if len(args) == 0 || clusterKeylessCommands[cmd] {
+		return "", false
+	}
+	switch cmd {
+	case "EVAL", "EVALSHA", "EVAL_RO", "EVALSHA_RO", "FCALL", "FCALL_RO":
+		if len(args) > 2 {
+			if n, err := strconv.Atoi(argString(args[1])); err == nil && n > 0 {
+				return argString(args[2]), true
+			}
+		}
+		return "", false
+	case "XREAD", "XREADGROUP":
+		for i := 0; i < len(args)-1; i++ {
+			if strings.EqualFold(argString(args[i]), "STREAMS") {
+				return argString(args[i+1]), true
+			}
+		}
+		return "", false
+	case "BITOP", "OBJECT", "MEMORY", "XINFO":
+		if len(args) > 1 {
+			return argString(args[1]), true
+		}
+		return "", false
+	}
+	return argString(args[0]), true
+}
+
+func argString(arg interface{}) string {
+	switch v := arg.(type) {
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// keySlot 计算key的slot，key中包含{hash tag}时只计算hash tag
+func keySlot(key string) int {
+	if start := strings.IndexByte(key, '{'); start >= 0 {
+		if end := strings.IndexByte(key[start+1:], '}'); end > 0 {
+			key = key[start+1 : start+1+end]
+		}
+	}
+	return int(crc16(key) % clusterSlots)
+}
+
+// crc16 CRC16/XMODEM
+func crc16(s string) uint16 {
+	var crc uint16
+	for i := 0; i < len(s); i++ {
+		crc ^= uint16(s[i]) << 8
+		for j := 0; j < 8; j++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// parseRedirect 解析 MOVED 3999 127.0.0.1:6381，节点地址未知时host为空，使用当前节点的host
+func parseRedirect(msg, current string) (slot int, addr string, ok bool) {
+	fields := strings.Fields(msg)
+	if len(fields) != 3 {
+		return
+	}
+	slot, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return
+	}
+	host, port, err := net.SplitHostPort(fields[2])
+	if err != nil {
+		return
+	}
+	return slot, nodeAddr(current, host, port), true
+}
+
+// nodeAddr 拼接节点地址，host为空时使用from的host
+func nodeAddr(from, host, port string) string {
+	if host == "" {
+		host, _, _ = net.SplitHostPort(from)
+	}
+	return net.JoinHostPort(host, port)
+}
+
+func inSlice(s []string, v string) bool {
+	for _, item := range s {
+		if item == v {
+			return true
+		}
+	}
+	return false
+}
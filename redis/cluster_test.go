@@ -0,0 +1,170 @@
+package redis
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestKeySlot(t *testing.T) {
+	if crc16("123456789") != 0x31C3 {
+		t.Errorf("crc16 %x", crc16("123456789"))
+	}
+	if keySlot("foo") != 12182 {
+		t.Errorf("foo slot %d", keySlot("foo"))
+	}
+	if keySlot("{user1000}.following") != keySlot("user1000") || keySlot("foo{}bar") != keySlot("foo{}bar") {
+		t.Error("hash tag slot错误")
+	}
+	if key, ok := commandKey("EVALSHA", []interface{}{"sha", 1, "k1", "a"}); !ok || key != "k1" {
+		t.Errorf("evalsha key %s", key)
+	}
+	if key, ok := commandKey("XREADGROUP", []interface{}{"GROUP", "g", "c", "STREAMS", "s1", ">"}); !ok || key != "s1" {
+		t.Errorf("xreadgroup key %s", key)
+	}
+}
+
+// movedServer 对所有命令返回MOVED到target
+func movedServer(t *testing.T, target string) string {
+	return fakeNode(t, func(args []string) string {
+		return fmt.Sprintf("-MOVED %d %s\r\n", keySlot(args[1]), target)
+	})
+}
+
+// crossSlotServer 多个key不在同一个slot时返回CROSSSLOT，否则DEL、EXISTS返回key的数量，MGET按顺序返回key本身
+func crossSlotServer(t *testing.T) string {
+	return fakeNode(t, func(args []string) string {
+		keys := args[1:]
+		for _, key := range keys {
+			if keySlot(key) != keySlot(keys[0]) {
+				return "-CROSSSLOT Keys in request don't hash to the same slot\r\n"
+			}
+		}
+		if strings.EqualFold(args[0], "MGET") {
+			reply := fmt.Sprintf("*%d\r\n", len(keys))
+			for _, key := range keys {
+				reply += fmt.Sprintf("$%d\r\n%s\r\n", len(key), key)
+			}
+			return reply
+		}
+		return fmt.Sprintf(":%d\r\n", len(keys))
+	})
+}
+
+// fakeNode 按handle返回的RESP内容响应每个命令
+func fakeNode(t *testing.T, handle func(args []string) string) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					n, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+					args := make([]string, 0, n)
+					for i := 0; i < n; i++ {
+						r.ReadString('\n')
+						arg, _ := r.ReadString('\n')
+						args = append(args, strings.TrimSpace(arg))
+					}
+					io.WriteString(conn, handle(args))
+				}
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestClusterMode(t *testing.T) {
+	p := newPool(Config{
+		Name:    "cluster_test",
+		Mode:    ModeCluster,
+		Addrs:   []string{"127.0.0.1:6379"},
+		MaxIdle: 2,
+	})
+	defer p.Close()
+	redisCollections["cluster_test"] = p
+	defer delete(redisCollections, "cluster_test")
+	ctx := SwitchRedisByCtx(context.Background(), "cluster_test")
+
+	key := "test_cluster:" + strconv.FormatInt(time.Now().UnixNano(), 10)
+	defer Del(ctx, key)
+	if err := Set(ctx, key, "v1", 10).Error(); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := Get(ctx, key).String(); err != nil || v != "v1" {
+		t.Fatalf("get %s %v", v, err)
+	}
+	if keys, err := Keys(ctx, key).Strings(); err != nil || len(keys) != 1 || keys[0] != key {
+		t.Fatalf("keys %v %v", keys, err)
+	}
+	if v, err := EvalScript(ctx, ScriptKeyIncr, key+"_incr", 10).Int64(); err != nil || v != 1 {
+		t.Fatalf("eval %d %v", v, err)
+	}
+	Del(ctx, key+"_incr")
+	replies, err := Pipelined(ctx, func(ctx context.Context) {
+		Get(ctx, key)
+		Get(ctx, key+"{other}")
+	})
+	if err != nil || len(replies) != 2 {
+		t.Fatalf("pipeline %d %v", len(replies), err)
+	}
+	if v, _ := replies[0].String(); v != "v1" {
+		t.Errorf("pipeline get %s", v)
+	}
+
+	// slot信息过期时跟随MOVED
+	slot := keySlot(key)
+	slotAddr := func() string {
+		p.cluster.mu.RLock()
+		defer p.cluster.mu.RUnlock()
+		return p.cluster.slots[slot]
+	}
+	p.cluster.setSlot(slot, movedServer(t, slotAddr()))
+	if v, err := Get(ctx, key).String(); err != nil || v != "v1" {
+		t.Fatalf("moved get %s %v", v, err)
+	}
+	if addr := slotAddr(); addr != "127.0.0.1:6379" {
+		t.Errorf("MOVED后slot应该更新 %s", addr)
+	}
+
+	// 多key命令的key不在同一个slot时按slot拆分
+	keys := []string{"a", "b", "c{a}", "d"}
+	node := crossSlotServer(t)
+	for _, k := range keys {
+		p.cluster.setSlot(keySlot(k), node)
+	}
+	if n, err := Del(ctx, keys...).Int64(); err != nil || n != 4 {
+		t.Errorf("跨slot del %d %v", n, err)
+	}
+	if values, err := MGet(ctx, keys).Strings(); err != nil || strings.Join(values, ",") != "a,b,c{a},d" {
+		t.Errorf("跨slot mget %v %v", values, err)
+	}
+}
+
+func TestClusterModeDatabase(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("集群模式配置非0的database应该panic")
+		}
+	}()
+	newPool(Config{Name: "cluster_db_test", Mode: ModeCluster, Addrs: []string{"127.0.0.1:6379"}, Database: 1})
+}
@@ -0,0 +1,391 @@
+package redis
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/gomodule/redigo/redis"
+	"github.com/youchuangcd/gopkg"
+	"github.com/youchuangcd/gopkg/common/utils"
+	"github.com/youchuangcd/gopkg/mylog"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrDelayJobNotClaimed 任务不在处理中，已确认、已超时被放回等待集合、已被重新领取或不存在
+	ErrDelayJobNotClaimed = errors.New("redis: delay job not claimed")
+	// ErrDelayJobProcessing 任务正在处理中，不能用相同的id重新添加
+	ErrDelayJobProcessing = errors.New("redis: delay job is processing")
+	// DefaultDelayQueueVisibilityTimeout 领取后超过该时间没有确认，任务放回等待集合重新领取
+	DefaultDelayQueueVisibilityTimeout = 30 * time.Second
+	// DefaultDelayQueueMaxAttempts 领取次数达到该值仍未确认时放入死信集合
+	DefaultDelayQueueMaxAttempts int64 = 5
+	// DefaultDelayQueuePollInterval 没有到期任务时的轮询间隔
+	DefaultDelayQueuePollInterval = time.Second
+)
+
+// DelayJob 延迟任务
+type DelayJob struct {
+	Id      string
+	Payload string
+	// Attempts 领取次数，包括本次
+	Attempts int64
+	// Token 领取凭证，每次领取都不同；Ack、Retry时与当前的凭证一致才生效，避免超时后被重新领取的任务被旧的处理者确认
+	Token string
+}
+
+// DelayQueueOption 延迟队列配置
+type DelayQueueOption struct {
+	// VisibilityTimeout 领取后超过该时间没有确认，任务放回等待集合，需要大于任务的处理时间
+	VisibilityTimeout time.Duration
+	// MaxAttempts 领取次数达到该值仍未确认时放入死信集合，0表示不限制
+	MaxAttempts int64
+	// RetryDelay 处理失败后延迟多久重试
+	RetryDelay time.Duration
+	// PollInterval 没有到期任务时的轮询间隔，任务最多延迟该时间后执行
+	PollInterval time.Duration
+}
+
+// SetDelayQueueOptionFunc 设置延迟队列配置的方法
+type SetDelayQueueOptionFunc func(option DelayQueueOption) DelayQueueOption
+
+// DelayQueue 基于有序集合的延迟队列，不依赖消息队列的延迟投递
+//
+// 等待集合按执行时间排序，领取时通过lua原子地移入处理中集合；是否到期、处理是否超时按redis服务器时间判断，
+// 不受各个消费者时钟误差的影响，执行时间由添加任务的客户端指定；
+// 集群模式下队列的所有key使用相同的hash tag
+//
+//	q := redis.NewDelayQueue("order:close")
+//	q.Enqueue(ctx, orderId, time.Now().Add(30*time.Minute))
+//	q.Consume(ctx, func(ctx context.Context, job redis.DelayJob) error {
+//		return closeOrder(ctx, job.Payload)
+//	}, 10)
+type DelayQueue struct {
+	name       string
+	delayed    string
+	processing string
+	attempts   string
+	payload    string
+	dead       string
+	claims     string
+	option     DelayQueueOption
+}
+
+// NewDelayQueue
+// @Description: 创建延迟队列
+// @param name 队列名称
+// @param optionFuncs
+// @return *DelayQueue
+func NewDelayQueue(name string, optionFuncs ...SetDelayQueueOptionFunc) *DelayQueue {
+	option := DelayQueueOption{
+		VisibilityTimeout: DefaultDelayQueueVisibilityTimeout,
+		MaxAttempts:       DefaultDelayQueueMaxAttempts,
+		RetryDelay:        5 * time.Second,
+		PollInterval:      DefaultDelayQueuePollInterval,
+	}
+	for _, optionFunc := range optionFuncs {
+		option = optionFunc(option)
+	}
+	return &DelayQueue{
+		name:       name,
+		delayed:    tagKey(name, "delayed"),
+		processing: tagKey(name, "processing"),
+		attempts:   tagKey(name, "attempts"),
+		payload:    tagKey(name, "payload"),
+		dead:       tagKey(name, "dead"),
+		claims:     tagKey(name, "claims"),
+		option:     option,
+	}
+}
+
+// Enqueue
+// @Description: 添加任务，到达runAt后才可以领取
+// @receiver q
+// @param ctx
+// @param payload 任务内容
+// @param runAt 执行时间，早于当前时间时立即可以领取
+// @return id 任务id
+// @return err
+func (q *DelayQueue) Enqueue(ctx context.Context, payload string, runAt time.Time) (id string, err error) {
+	id = utils.GenUniqueId()
+	return id, q.EnqueueWithId(ctx, id, payload, runAt)
+}
+
+// EnqueueWithId
+// @Description: 使用指定的id添加任务，id已存在且还在等待时覆盖内容和执行时间，可用于去重或修改执行时间；
+// id在死信集合中时移出死信集合并重置领取次数
+// @receiver q
+// @param ctx
+// @param id
+// @param payload
+// @param runAt
+// @return error 任务正在处理中时返回ErrDelayJobProcessing
+func (q *DelayQueue) EnqueueWithId(ctx context.Context, id, payload string, runAt time.Time) error {
+	res, err := EvalScript(ctx, ScriptKeyDelayQueuePush, q.delayed, q.payload, q.processing, q.dead, q.attempts,
+		id, runAt.UnixMilli(), payload).Int64()
+	if err != nil {
+		return err
+	}
+	if res < 0 {
+		return ErrDelayJobProcessing
+	}
+	return nil
+}
+
+// Claim
+// @Description: 领取最多count个到期的任务，领取前先把处理超时的任务放回等待集合
+// @receiver q
+// @param ctx
+// @param count
+// @return []DelayJob 没有到期任务时为空
+// @return error
+func (q *DelayQueue) Claim(ctx context.Context, count int64) ([]DelayJob, error) {
+	token := utils.GenUniqueId()
+	values, err := EvalScript(ctx, ScriptKeyDelayQueueClaim, q.delayed, q.processing, q.attempts, q.payload, q.dead, q.claims,
+		count, q.option.VisibilityTimeout.Milliseconds(), q.option.MaxAttempts, token).Values()
+	if err != nil {
+		return nil, err
+	}
+	jobs := make([]DelayJob, 0, len(values)/3)
+	// [id, 内容, 领取次数, ...]
+	for i := 0; i+2 < len(values); i += 3 {
+		var job DelayJob
+		job.Id, _ = redis.String(values[i], nil)
+		job.Payload, _ = redis.String(values[i+1], nil)
+		job.Attempts, _ = redis.Int64(values[i+2], nil)
+		job.Token = token
+		jobs = append(jobs, job)
+	}
+	return jobs, nil
+}
+
+// Ack
+// @Description: 确认任务处理完成，删除任务
+// @receiver q
+// @param ctx
+// @param job Claim返回的任务
+// @return error 任务已超时被放回等待集合或已被重新领取时返回ErrDelayJobNotClaimed，任务会被再次执行
+func (q *DelayQueue) Ack(ctx context.Context, job DelayJob) error {
+	ok, err := EvalScript(ctx, ScriptKeyDelayQueueAck, q.processing, q.attempts, q.payload, q.claims, job.Id, job.Token).Int64()
+	if err != nil {
+		return err
+	}
+	if ok == 0 {
+		return ErrDelayJobNotClaimed
+	}
+	return nil
+}
+
+// Retry
+// @Description: 处理失败，延迟delay后重新领取，领取次数达到MaxAttempts时放入死信集合
+// @receiver q
+// @param ctx
+// @param job Claim返回的任务
+// @param delay
+// @return dead 是否已放入死信集合
+// @return err 任务不在处理中或已被重新领取时返回ErrDelayJobNotClaimed
+func (q *DelayQueue) Retry(ctx context.Context, job DelayJob, delay time.Duration) (dead bool, err error) {
+	res, err := EvalScript(ctx, ScriptKeyDelayQueueRetry, q.processing, q.delayed, q.attempts, q.dead, q.claims,
+		job.Id, delay.Milliseconds(), q.option.MaxAttempts, job.Token).Int64()
+	if err != nil {
+		return
+	}
+	if res < 0 {
+		return false, ErrDelayJobNotClaimed
+	}
+	return res == 1, nil
+}
+
+// Len
+// @Description: 各集合的任务数量
+// @receiver q
+// @param ctx
+// @return delayed 等待中(包括未到期和已到期)
+// @return processing 处理中
+// @return dead 死信
+// @return err
+func (q *DelayQueue) Len(ctx context.Context) (delayed, processing, dead int64, err error) {
+	replies, err := Pipelined(ctx, func(ctx context.Context) {
+		ZCard(ctx, q.delayed)
+		ZCard(ctx, q.processing)
+		ZCard(ctx, q.dead)
+	})
+	if err != nil {
+		return
+	}
+	delayed, _ = replies[0].Int64()
+	processing, _ = replies[1].Int64()
+	dead, _ = replies[2].Int64()
+	return
+}
+
+// DeadJobs
+// @Description: 按放入时间读取死信任务，死信任务保留内容直到RemoveDead
+// @receiver q
+// @param ctx
+// @param count
+// @return []DelayJob
+// @return error
+func (q *DelayQueue) DeadJobs(ctx context.Context, count int64) ([]DelayJob, error) {
+	ids, err := ZRange(ctx, q.dead, 0, count-1).Strings()
+	if err != nil || len(ids) == 0 {
+		return nil, err
+	}
+	replies, err := Pipelined(ctx, func(ctx context.Context) {
+		HMGet(ctx, q.payload, ids)
+		HMGet(ctx, q.attempts, ids)
+	})
+	if err != nil {
+		return nil, err
+	}
+	payloads, _ := replies[0].Strings()
+	attempts, _ := replies[1].Int64s()
+	jobs := make([]DelayJob, len(ids))
+	for i, id := range ids {
+		jobs[i].Id = id
+		if i < len(payloads) {
+			jobs[i].Payload = payloads[i]
+		}
+		if i < len(attempts) {
+			jobs[i].Attempts = attempts[i]
+		}
+	}
+	return jobs, nil
+}
+
+// RemoveDead
+// @Description: 删除死信任务，重新执行时先读取再Enqueue
+// @receiver q
+// @param ctx
+// @param ids
+// @return error
+func (q *DelayQueue) RemoveDead(ctx context.Context, ids ...string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	_, err := Transaction(ctx, func(tx *Tx) error {
+		tx.Do("zrem", redis.Args{q.dead}.AddFlat(ids)...)
+		tx.Do("hdel", redis.Args{q.payload}.AddFlat(ids)...)
+		tx.Do("hdel", redis.Args{q.attempts}.AddFlat(ids)...)
+		return nil
+	})
+	return err
+}
+
+// Consume
+// @Description: 轮询领取到期的任务并处理，直到ctx取消，等待处理中的任务完成后返回；
+// cb返回nil时确认任务，返回错误时RetryDelay之后重试
+// @receiver q
+// @param ctx 同时用于选择redis实例
+// @param cb
+// @param goPoolSize 并发处理的协程数
+// @return error 创建协程池失败
+func (q *DelayQueue) Consume(ctx context.Context, cb func(ctx context.Context, job DelayJob) error, goPoolSize int) error {
+	if goPoolSize < 1 {
+		goPoolSize = 1
+	}
+	pool, err := utils.NewPool(goPoolSize)
+	if err != nil {
+		return err
+	}
+	defer pool.Release()
+
+	var (
+		wg  sync.WaitGroup
+		sem = make(chan struct{}, goPoolSize)
+		// 确认任务不受ctx取消的影响，避免退出时处理完的任务被重新执行
+		ackCtx = valueOnlyContext{ctx}
+	)
+	defer wg.Wait()
+	for ctx.Err() == nil {
+		// 只领取有空闲协程处理的数量，避免领取后等待超时
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			return nil
+		}
+		free := int64(1)
+		for len(sem) < cap(sem) {
+			sem <- struct{}{}
+			free++
+		}
+		jobs, cErr := q.Claim(ctx, free)
+		if cErr != nil && ctx.Err() == nil {
+			q.logError(ctx, cErr, "延迟队列领取任务失败")
+		}
+		for i := int64(len(jobs)); i < free; i++ {
+			<-sem
+		}
+		if len(jobs) == 0 {
+			q.sleep(ctx)
+			continue
+		}
+		for _, job := range jobs {
+			job := job
+			wg.Add(1)
+			task := func() {
+				defer func() {
+					<-sem
+					wg.Done()
+				}()
+				q.handle(ctx, ackCtx, cb, job)
+			}
+			if sErr := pool.Submit(task); sErr != nil {
+				<-sem
+				wg.Done()
+				// 超时后会被重新领取
+				q.logError(ctx, sErr, "延迟队列提交任务到协程池失败")
+			}
+		}
+	}
+	return nil
+}
+
+func (q *DelayQueue) handle(ctx, ackCtx context.Context, cb func(ctx context.Context, job DelayJob) error, job DelayJob) {
+	err := func() (err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				err = fmt.Errorf("delay queue panic: %v", r)
+			}
+		}()
+		return cb(ctx, job)
+	}()
+	if err == nil {
+		if err = q.Ack(ackCtx, job); err != nil {
+			q.logError(ctx, err, "延迟队列确认任务失败")
+		}
+		return
+	}
+	fields := map[string]interface{}{
+		"queue":    q.name,
+		"id":       job.Id,
+		"attempts": job.Attempts,
+		"err":      err.Error(),
+	}
+	dead, rErr := q.Retry(ackCtx, job, q.option.RetryDelay)
+	if rErr != nil {
+		fields["retry_err"] = rErr.Error()
+	}
+	if dead {
+		mylog.WithWarn(ctx, gopkg.LogRedis, fields, "延迟任务失败次数过多，放入死信集合")
+		return
+	}
+	mylog.WithError(ctx, gopkg.LogRedis, fields, "[DelayQueue] Job Failed")
+}
+
+func (q *DelayQueue) logError(ctx context.Context, err error, msg string) {
+	mylog.WithError(ctx, gopkg.LogRedis, map[string]interface{}{
+		"queue": q.name,
+		"err":   err.Error(),
+	}, msg)
+}
+
+func (q *DelayQueue) sleep(ctx context.Context) {
+	timer := time.NewTimer(q.option.PollInterval)
+	select {
+	case <-ctx.Done():
+		timer.Stop()
+	case <-timer.C:
+	}
+}
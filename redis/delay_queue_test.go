@@ -0,0 +1,106 @@
+package redis
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDelayQueue(t *testing.T) {
+	ctx := context.Background()
+	name := "test_delay_queue:" + strconv.FormatInt(time.Now().UnixNano(), 10)
+	q := NewDelayQueue(name, func(option DelayQueueOption) DelayQueueOption {
+		option.VisibilityTimeout = 100 * time.Millisecond
+		option.MaxAttempts = 2
+		return option
+	})
+	defer Del(ctx, q.delayed, q.processing, q.attempts, q.payload, q.dead, q.claims)
+
+	// 到期按redis服务器时间判断，服务器时间可能比本机慢，立即执行的任务使用过去的时间
+	due := time.Now().Add(-time.Second)
+	id1, err := q.Enqueue(ctx, "now", due)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.Enqueue(ctx, "later", time.Now().Add(time.Hour))
+	jobs, err := q.Claim(ctx, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 1 || jobs[0].Id != id1 || jobs[0].Payload != "now" || jobs[0].Attempts != 1 {
+		t.Fatalf("应该只领取到期的任务: %+v", jobs)
+	}
+	job := jobs[0]
+	if jobs, _ = q.Claim(ctx, 10); len(jobs) != 0 {
+		t.Fatalf("处理中的任务不应被重复领取: %+v", jobs)
+	}
+	if err = q.EnqueueWithId(ctx, id1, "again", time.Now()); err != ErrDelayJobProcessing {
+		t.Errorf("处理中的任务重新添加应该返回ErrDelayJobProcessing，实际%v", err)
+	}
+	if err = q.Ack(ctx, job); err != nil {
+		t.Fatal(err)
+	}
+	if err = q.Ack(ctx, job); err != ErrDelayJobNotClaimed {
+		t.Errorf("重复确认应该返回ErrDelayJobNotClaimed，实际%v", err)
+	}
+
+	// 超时未确认放回等待集合，达到最大次数后放入死信集合
+	id2, _ := q.Enqueue(ctx, "timeout", due)
+	stale, _ := q.Claim(ctx, 10)
+	time.Sleep(110 * time.Millisecond)
+	if jobs, _ = q.Claim(ctx, 10); len(jobs) != 1 || jobs[0].Id != id2 || jobs[0].Attempts != 2 {
+		t.Fatalf("超时的任务应该被重新领取: %+v", jobs)
+	}
+	// 超时后被重新领取，旧的领取凭证不能确认或重试
+	if err = q.Ack(ctx, stale[0]); err != ErrDelayJobNotClaimed {
+		t.Errorf("旧的领取凭证确认应该返回ErrDelayJobNotClaimed，实际%v", err)
+	}
+	if _, err = q.Retry(ctx, stale[0], 0); err != ErrDelayJobNotClaimed {
+		t.Errorf("旧的领取凭证重试应该返回ErrDelayJobNotClaimed，实际%v", err)
+	}
+	if _, processing, _, _ := q.Len(ctx); processing != 1 {
+		t.Errorf("旧的领取凭证不应影响重新领取的任务，processing %d", processing)
+	}
+	time.Sleep(110 * time.Millisecond)
+	if jobs, _ = q.Claim(ctx, 10); len(jobs) != 0 {
+		t.Fatalf("达到最大次数不应被领取: %+v", jobs)
+	}
+	delayed, processing, dead, err := q.Len(ctx)
+	if err != nil || delayed != 1 || processing != 0 || dead != 1 {
+		t.Errorf("数量错误 delayed %d processing %d dead %d err %v", delayed, processing, dead, err)
+	}
+	deadJobs, err := q.DeadJobs(ctx, 10)
+	if err != nil || len(deadJobs) != 1 || deadJobs[0].Payload != "timeout" || deadJobs[0].Attempts != 2 {
+		t.Errorf("死信任务错误: %+v %v", deadJobs, err)
+	}
+	if err = q.RemoveDead(ctx, id2); err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := HLen(ctx, q.payload).Int(); n != 1 {
+		t.Errorf("删除死信后应该只剩1个任务内容，实际%d", n)
+	}
+
+	// 失败后重试，成功后确认
+	var calls int32
+	q.option.RetryDelay = 0
+	q.option.PollInterval = 10 * time.Millisecond
+	q.Enqueue(ctx, "consume", due)
+	cctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	err = q.Consume(cctx, func(ctx context.Context, job DelayJob) error {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			return errors.New("fail")
+		}
+		cancel()
+		return nil
+	}, 2)
+	if n := atomic.LoadInt32(&calls); err != nil || n != 2 {
+		t.Errorf("应该失败重试一次后成功，calls %d err %v", n, err)
+	}
+	if delayed, processing, _, _ = q.Len(ctx); delayed != 1 || processing != 0 {
+		t.Errorf("确认后应该只剩未到期的任务 delayed %d processing %d", delayed, processing)
+	}
+}
@@ -0,0 +1,289 @@
+package redis
+
+import (
+	"context"
+	"errors"
+	"github.com/gomodule/redigo/redis"
+	"strings"
+)
+
+// 距离单位
+const (
+	GeoUnitM  = "m"
+	GeoUnitKM = "km"
+	GeoUnitMI = "mi"
+	GeoUnitFT = "ft"
+)
+
+// ErrInvalidGeoQuery 搜索条件缺少中心点或范围
+var ErrInvalidGeoQuery = errors.New("redis: invalid geo query")
+
+// GeoLocation 成员的经纬度
+type GeoLocation struct {
+	Name      string
+	Longitude float64
+	Latitude  float64
+}
+
+// GeoSearchQuery 搜索条件
+type GeoSearchQuery struct {
+	// Member 以该成员的位置为中心，为空时使用Longitude、Latitude
+	Member    string
+	Longitude float64
+	Latitude  float64
+	// Radius 按半径搜索，Width、Height都大于0时按矩形搜索
+	Radius float64
+	Width  float64
+	Height float64
+	// Unit 距离单位，默认m
+	Unit string
+	// Sort ASC由近到远，DESC由远到近，为空时不排序
+	Sort string
+	// Count 最多返回的数量，0表示不限制
+	Count int64
+	// Any 找到Count个后立即返回，结果不一定是最近的
+	Any bool
+	// WithCoord 返回经纬度
+	WithCoord bool
+	// WithDist 返回与中心点的距离，单位与Unit相同
+	WithDist bool
+	// WithHash 返回52位geohash整数
+	WithHash bool
+}
+
+// GeoSearchResult 搜索结果，没有设置对应的With选项时为零值
+type GeoSearchResult struct {
+	Name      string
+	Dist      float64
+	Hash      int64
+	Longitude float64
+	Latitude  float64
+}
+
+// 添加或更新成员的位置
+func GeoAdd(ctx context.Context, key string, locations ...GeoLocation) *Reply {
+	c, _ := getPoolInstance(ctx).GetContext(ctx)
+	defer c.Close()
+	args := redis.Args{}.Add(key)
+	for _, v := range locations {
+		args = args.Add(v.Longitude, v.Latitude, v.Name)
+	}
+	return getReply(redis.DoContext(c, ctx, "geoadd", args...))
+}
+
+// 返回成员的经纬度，使用Reply.Positions()读取，成员不存在时为nil
+func GeoPos(ctx context.Context, key string, members ...string) *Reply {
+	c, _ := getPoolInstance(ctx).GetContext(ctx)
+	defer c.Close()
+	return getReply(redis.DoContext(c, ctx, "geopos", redis.Args{}.Add(key).AddFlat(members)...))
+}
+
+// 返回两个成员的距离，unit为空时单位为m，成员不存在时返回ErrNil
+func GeoDist(ctx context.Context, key, member1, member2 string, unit string) *Reply {
+	c, _ := getPoolInstance(ctx).GetContext(ctx)
+	defer c.Close()
+	args := redis.Args{}.Add(key, member1, member2)
+	if unit != "" {
+		args = args.Add(unit)
+	}
+	return getReply(redis.DoContext(c, ctx, "geodist", args...))
+}
+
+// 返回成员的geohash字符串
+func GeoHash(ctx context.Context, key string, members ...string) *Reply {
+	c, _ := getPoolInstance(ctx).GetContext(ctx)
+	defer c.Close()
+	return getReply(redis.DoContext(c, ctx, "geohash", redis.Args{}.Add(key).AddFlat(members)...))
+}
+
+// 删除成员的位置
+func GeoRemove(ctx context.Context, key string, members ...string) *Reply {
+	c, _ := getPoolInstance(ctx).GetContext(ctx)
+	defer c.Close()
+	return getReply(redis.DoContext(c, ctx, "zrem", redis.Args{}.Add(key).AddFlat(members)...))
+}
+
+// GeoSearch
+// @Description: 按半径或矩形搜索范围内的成员；redis 6.2以下不支持GEOSEARCH，按半径搜索时改用GEORADIUS
+//
+//	// 查找用户附近5km内最近的20台设备
+//	devices, err := redis.GeoSearch(ctx, "device:location", redis.GeoSearchQuery{
+//		Longitude: lng, Latitude: lat,
+//		Radius: 5, Unit: redis.GeoUnitKM,
+//		Sort: "ASC", Count: 20, WithDist: true,
+//	})
+//
+// @param ctx
+// @param key
+// @param query
+// @return []GeoSearchResult
+// @return error
+func GeoSearch(ctx context.Context, key string, query GeoSearchQuery) ([]GeoSearchResult, error) {
+	args, err := query.args()
+	if err != nil {
+		return nil, err
+	}
+	var with redis.Args
+	if query.WithCoord {
+		with = with.Add("withcoord")
+	}
+	if query.WithDist {
+		with = with.Add("withdist")
+	}
+	if query.WithHash {
+		with = with.Add("withhash")
+	}
+	c, _ := getPoolInstance(ctx).GetContext(ctx)
+	defer c.Close()
+	items, err := redis.Values(redis.DoContext(c, ctx, "geosearch", redis.Args{}.Add(key).AddFlat(args).AddFlat(with)...))
+	if isUnknownCommand(err) && query.Width <= 0 {
+		cmd, rArgs := query.radiusArgs(key)
+		items, err = redis.Values(redis.DoContext(c, ctx, cmd, rArgs.AddFlat(with)...))
+	}
+	if err != nil {
+		return nil, err
+	}
+	return parseGeoSearch(items, query)
+}
+
+// GeoSearchStore
+// @Description: 搜索结果保存到dest，集群模式下dest与key需要在同一个slot
+// @param ctx
+// @param dest
+// @param key
+// @param query With选项不生效
+// @param storeDist true时分数保存为距离，false时保存位置，dest可以继续用于GEO命令
+// @return *Reply 保存的数量
+func GeoSearchStore(ctx context.Context, dest, key string, query GeoSearchQuery, storeDist bool) *Reply {
+	args, err := query.args()
+	if err != nil {
+		return getReply(nil, err)
+	}
+	if storeDist {
+		args = args.Add("storedist")
+	}
+	c, _ := getPoolInstance(ctx).GetContext(ctx)
+	defer c.Close()
+	reply, err := redis.DoContext(c, ctx, "geosearchstore", redis.Args{}.Add(dest, key).AddFlat(args)...)
+	if isUnknownCommand(err) && query.Width <= 0 {
+		store := "store"
+		if storeDist {
+			store = "storedist"
+		}
+		cmd, rArgs := query.radiusArgs(key)
+		reply, err = redis.DoContext(c, ctx, cmd, rArgs.Add(store, dest)...)
+	}
+	return getReply(reply, err)
+}
+
+// args 中心点、范围、排序和数量参数
+func (q GeoSearchQuery) args() (redis.Args, error) {
+	unit := q.Unit
+	if unit == "" {
+		unit = GeoUnitM
+	}
+	var args redis.Args
+	if q.Member != "" {
+		args = args.Add("frommember", q.Member)
+	} else {
+		args = args.Add("fromlonlat", q.Longitude, q.Latitude)
+	}
+	switch {
+	case q.Width > 0 && q.Height > 0:
+		args = args.Add("bybox", q.Width, q.Height, unit)
+	case q.Radius > 0:
+		args = args.Add("byradius", q.Radius, unit)
+	default:
+		return nil, ErrInvalidGeoQuery
+	}
+	if q.Sort != "" {
+		args = args.Add(q.Sort)
+	}
+	if q.Count > 0 {
+		args = args.Add("count", q.Count)
+		if q.Any {
+			args = args.Add("any")
+		}
+	}
+	return args, nil
+}
+
+// radiusArgs redis 6.2以下按半径搜索的GEORADIUS、GEORADIUSBYMEMBER命令参数
+func (q GeoSearchQuery) radiusArgs(key string) (string, redis.Args) {
+	unit := q.Unit
+	if unit == "" {
+		unit = GeoUnitM
+	}
+	cmd, args := "georadius", redis.Args{}.Add(key)
+	if q.Member != "" {
+		cmd, args = "georadiusbymember", args.Add(q.Member)
+	} else {
+		args = args.Add(q.Longitude, q.Latitude)
+	}
+	args = args.Add(q.Radius, unit)
+	if q.Sort != "" {
+		args = args.Add(q.Sort)
+	}
+	if q.Count > 0 {
+		args = args.Add("count", q.Count)
+	}
+	return cmd, args
+}
+
+func isUnknownCommand(err error) bool {
+	e, ok := err.(redis.Error)
+	return ok && strings.HasPrefix(strings.ToLower(string(e)), "err unknown command")
+}
+
+// parseGeoSearch 没有With选项时每项是成员名，否则是 [成员名, 距离, geohash, [经度, 纬度]]，按选项依次出现
+func parseGeoSearch(items []interface{}, query GeoSearchQuery) ([]GeoSearchResult, error) {
+	res := make([]GeoSearchResult, 0, len(items))
+	withAny := query.WithCoord || query.WithDist || query.WithHash
+	for _, item := range items {
+		var (
+			r   GeoSearchResult
+			err error
+		)
+		if !withAny {
+			if r.Name, err = redis.String(item, nil); err != nil {
+				return nil, err
+			}
+			res = append(res, r)
+			continue
+		}
+		fields, err := redis.Values(item, nil)
+		if err != nil {
+			return nil, err
+		}
+		if len(fields) == 0 {
+			continue
+		}
+		if r.Name, err = redis.String(fields[0], nil); err != nil {
+			return nil, err
+		}
+		i := 1
+		if query.WithDist && i < len(fields) {
+			if r.Dist, err = redis.Float64(fields[i], nil); err != nil {
+				return nil, err
+			}
+			i++
+		}
+		if query.WithHash && i < len(fields) {
+			if r.Hash, err = redis.Int64(fields[i], nil); err != nil {
+				return nil, err
+			}
+			i++
+		}
+		if query.WithCoord && i < len(fields) {
+			coord, err := redis.Float64s(fields[i], nil)
+			if err != nil {
+				return nil, err
+			}
+			if len(coord) == 2 {
+				r.Longitude, r.Latitude = coord[0], coord[1]
+			}
+		}
+		res = append(res, r)
+	}
+	return res, nil
+}
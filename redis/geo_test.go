@@ -0,0 +1,84 @@
+package redis
+
+import (
+	"context"
+	"math"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestGeo(t *testing.T) {
+	ctx := context.Background()
+	key := "test_geo:" + strconv.FormatInt(time.Now().UnixNano(), 10)
+	defer Del(ctx, key, key+":store")
+
+	n, err := GeoAdd(ctx, key,
+		GeoLocation{Name: "device1", Longitude: 120.15, Latitude: 30.28},
+		GeoLocation{Name: "device2", Longitude: 120.16, Latitude: 30.29},
+		GeoLocation{Name: "device3", Longitude: 121.47, Latitude: 31.23},
+	).Int()
+	if err != nil || n != 3 {
+		t.Fatalf("添加位置失败 %d %v", n, err)
+	}
+	positions, err := GeoPos(ctx, key, "device1", "not_exists").Positions()
+	if err != nil || len(positions) != 2 || positions[1] != nil || math.Abs(positions[0][0]-120.15) > 0.001 {
+		t.Errorf("GeoPos结果错误 %v %v", positions, err)
+	}
+	dist, err := GeoDist(ctx, key, "device1", "device2", GeoUnitKM).Float64()
+	if err != nil || dist < 1 || dist > 2 {
+		t.Errorf("GeoDist结果错误 %v %v", dist, err)
+	}
+	if _, err = GeoDist(ctx, key, "device1", "not_exists", "").Float64(); err != ErrNil {
+		t.Errorf("成员不存在应该返回ErrNil，实际%v", err)
+	}
+
+	res, err := GeoSearch(ctx, key, GeoSearchQuery{
+		Longitude: 120.15, Latitude: 30.28,
+		Radius: 10, Unit: GeoUnitKM,
+		Sort: "ASC", WithDist: true, WithCoord: true,
+	})
+	if err != nil || len(res) != 2 || res[0].Name != "device1" || res[1].Name != "device2" {
+		t.Fatalf("按半径搜索结果错误 %+v %v", res, err)
+	}
+	if res[1].Dist < 1 || res[1].Dist > 2 || math.Abs(res[1].Latitude-30.29) > 0.001 {
+		t.Errorf("With选项结果错误 %+v", res[1])
+	}
+	res, err = GeoSearch(ctx, key, GeoSearchQuery{Member: "device1", Radius: 400, Unit: GeoUnitKM, Sort: "DESC", Count: 1})
+	if err != nil || len(res) != 1 || res[0].Name != "device3" {
+		t.Errorf("以成员为中心搜索结果错误 %+v %v", res, err)
+	}
+	// 按矩形搜索需要redis 6.2以上
+	res, err = GeoSearch(ctx, key, GeoSearchQuery{Longitude: 120.15, Latitude: 30.28, Width: 10, Height: 10, Unit: GeoUnitKM})
+	if isUnknownCommand(err) {
+		t.Log("redis不支持GEOSEARCH，跳过按矩形搜索")
+	} else if err != nil || len(res) != 2 {
+		t.Errorf("按矩形搜索结果错误 %+v %v", res, err)
+	}
+	if _, err = GeoSearch(ctx, key, GeoSearchQuery{Member: "device1"}); err != ErrInvalidGeoQuery {
+		t.Errorf("没有范围应该返回ErrInvalidGeoQuery，实际%v", err)
+	}
+	if n, err = GeoSearchStore(ctx, key+":store", key, GeoSearchQuery{Member: "device1", Radius: 10, Unit: GeoUnitKM}, false).Int(); err != nil || n != 2 {
+		t.Errorf("GeoSearchStore结果错误 %d %v", n, err)
+	}
+	if n, _ = GeoRemove(ctx, key, "device3").Int(); n != 1 {
+		t.Error("删除位置失败")
+	}
+}
+
+func TestParseGeoSearch(t *testing.T) {
+	items := []interface{}{
+		[]interface{}{[]byte("device1"), []byte("1.5"), int64(4054421060663027), []interface{}{[]byte("120.15"), []byte("30.28")}},
+	}
+	res, err := parseGeoSearch(items, GeoSearchQuery{WithCoord: true, WithDist: true, WithHash: true})
+	if err != nil || len(res) != 1 {
+		t.Fatal(res, err)
+	}
+	if r := res[0]; r.Name != "device1" || r.Dist != 1.5 || r.Hash != 4054421060663027 || r.Longitude != 120.15 || r.Latitude != 30.28 {
+		t.Errorf("解析结果错误 %+v", r)
+	}
+	res, err = parseGeoSearch([]interface{}{[]byte("device1"), []byte("device2")}, GeoSearchQuery{})
+	if err != nil || len(res) != 2 || res[1].Name != "device2" {
+		t.Errorf("解析成员名错误 %+v %v", res, err)
+	}
+}
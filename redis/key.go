@@ -5,11 +5,29 @@ import (
 	"github.com/gomodule/redigo/redis"
 )
 
-// 查找键 [*模糊查找]
+// 查找键 [*模糊查找]，会阻塞redis直到遍历完所有key，线上使用Scan；集群模式在每个master执行后合并结果
 func Keys(ctx context.Context, key string) *Reply {
-	c, _ := getPoolInstance(ctx).GetContext(ctx)
-	defer c.Close()
-	return getReply(redis.DoContext(c, ctx, "keys", key))
+	p := getPoolInstance(ctx)
+	if p.cluster == nil {
+		c, _ := p.GetContext(ctx)
+		defer c.Close()
+		return getReply(redis.DoContext(c, ctx, "keys", key))
+	}
+	masters, err := p.cluster.masterAddrs(ctx)
+	if err != nil {
+		return getReply(nil, err)
+	}
+	keys := []interface{}{}
+	for _, addr := range masters {
+		c, _ := p.cluster.nodePool(addr).GetContext(ctx)
+		items, err := redis.Values(redis.DoContext(c, ctx, "keys", key))
+		c.Close()
+		if err != nil {
+			return getReply(nil, err)
+		}
+		keys = append(keys, items...)
+	}
+	return getReply(keys, nil)
 }
 
 // 判断key是否存在
@@ -40,6 +58,13 @@ func Del(ctx context.Context, keys ...string) *Reply {
 	return getReply(redis.DoContext(c, ctx, "del", redis.Args{}.AddFlat(keys)...))
 }
 
+// 异步删除key，大key不会阻塞redis
+func Unlink(ctx context.Context, keys ...string) *Reply {
+	c, _ := getPoolInstance(ctx).GetContext(ctx)
+	defer c.Close()
+	return getReply(redis.DoContext(c, ctx, "unlink", redis.Args{}.AddFlat(keys)...))
+}
+
 // 重命名
 func Rename(ctx context.Context, key, newKey string) *Reply {
 	c, _ := getPoolInstance(ctx).GetContext(ctx)
@@ -0,0 +1,141 @@
+package redis
+
+import (
+	"context"
+	"errors"
+	"github.com/youchuangcd/gopkg/common/utils"
+	"time"
+)
+
+// TokenBucketTake
+// @Description: 从redis令牌桶获取令牌，多个进程共用同一个key即可共享配额；使用redis服务器的时间，不受各进程时钟偏差影响
+// @param ctx
+// @param key
+// @param rate 每秒生成的令牌数，不大于0时返回ErrInvalidLimit
+// @param burst 桶容量
+// @param requested 本次需要的令牌数
+// @return allowed 是否获取成功
+// @return remaining 剩余令牌数
+// @return retryAfter 获取失败时需要等待的时间
+// @return err
+func TokenBucketTake(ctx context.Context, key string, rate float64, burst, requested int64) (allowed bool, remaining int64, retryAfter time.Duration, err error) {
+	if rate <= 0 {
+		return false, 0, 0, ErrInvalidLimit
+	}
+	res, err := EvalScript(ctx, ScriptKeyTokenBucket, key, rate, burst, requested).Int64s()
+	if err != nil {
+		return
+	}
+	return res[0] == 1, res[1], time.Duration(res[2]) * time.Millisecond, nil
+}
+
+// ErrInvalidLimit 限流规则无效，或本次请求数超过了规则的容量，永远不会被允许
+var ErrInvalidLimit = errors.New("redis: invalid limit")
+
+// Limit 限流规则，一次请求可以同时检查多个规则(如按用户和按商户)，所有规则都允许才扣减配额；
+// 集群模式下同一次请求的多个key需要使用相同的hash tag，如 limit:{merchant:1}:user:2 和 limit:{merchant:1}
+type Limit struct {
+	Key string
+	// Rate 每个Period允许的请求数
+	Rate int64
+	// Period 时间窗口
+	Period time.Duration
+	// Burst 令牌桶容量/GCRA允许的突发数量，默认等于Rate；滑动窗口不使用
+	Burst int64
+}
+
+func (l Limit) burst() int64 {
+	if l.Burst > 0 {
+		return l.Burst
+	}
+	return l.Rate
+}
+
+// SlidingWindowLogTake
+// @Description: 滑动窗口日志限流，记录窗口内每次请求的时间，精确但每次请求占用一个zset成员，适合限制数较小的场景
+// @param ctx
+// @param requested 本次请求数
+// @param limits
+// @return allowed 是否允许
+// @return remaining 各规则剩余次数的最小值
+// @return retryAfter 不允许时需要等待的时间
+// @return err
+func SlidingWindowLogTake(ctx context.Context, requested int64, limits ...Limit) (allowed bool, remaining int64, retryAfter time.Duration, err error) {
+	return limiterTake(ctx, ScriptKeySlidingWindowLog, requested, limits, func(l Limit) (int64, []interface{}) {
+		return l.Rate, []interface{}{l.Rate, l.Period.Milliseconds()}
+	}, utils.GenUniqueId())
+}
+
+// SlidingWindowTake
+// @Description: 滑动窗口计数器限流，按上一个固定窗口的计数加权估算，避免固定窗口(IncrMax)在窗口边界放过两倍的请求
+// @param ctx
+// @param requested 本次请求数
+// @param limits
+// @return allowed 是否允许
+// @return remaining 各规则剩余次数的最小值
+// @return retryAfter 不允许时需要等待的时间，为估算值
+// @return err
+func SlidingWindowTake(ctx context.Context, requested int64, limits ...Limit) (allowed bool, remaining int64, retryAfter time.Duration, err error) {
+	return limiterTake(ctx, ScriptKeySlidingWindowCounter, requested, limits, func(l Limit) (int64, []interface{}) {
+		return l.Rate, []interface{}{l.Rate, l.Period.Milliseconds()}
+	})
+}
+
+// TokenBucketTakeMulti
+// @Description: 多规则令牌桶，与TokenBucketTake使用相同的存储结构，同一个key可以混用
+// @param ctx
+// @param requested 本次需要的令牌数
+// @param limits 每个Period生成Rate个令牌，桶容量为Burst
+// @return allowed 是否获取成功
+// @return remaining 各规则剩余令牌数的最小值
+// @return retryAfter 获取失败时需要等待的时间
+// @return err
+func TokenBucketTakeMulti(ctx context.Context, requested int64, limits ...Limit) (allowed bool, remaining int64, retryAfter time.Duration, err error) {
+	return limiterTake(ctx, ScriptKeyTokenBucketMulti, requested, limits, func(l Limit) (int64, []interface{}) {
+		return l.burst(), []interface{}{float64(l.Rate) / l.Period.Seconds(), l.burst()}
+	})
+}
+
+// GCRATake
+// @Description: GCRA限流，效果与令牌桶相同，每个key只存储一个时间戳
+// @param ctx
+// @param requested 本次请求数
+// @param limits 每个Period允许Rate个请求，最多突发Burst个
+// @return allowed 是否允许
+// @return remaining 各规则剩余突发数量的最小值
+// @return retryAfter 不允许时需要等待的时间
+// @return err
+func GCRATake(ctx context.Context, requested int64, limits ...Limit) (allowed bool, remaining int64, retryAfter time.Duration, err error) {
+	return limiterTake(ctx, ScriptKeyGCRA, requested, limits, func(l Limit) (int64, []interface{}) {
+		return l.burst(), []interface{}{float64(l.Period) / float64(time.Millisecond) / float64(l.Rate), l.burst()}
+	})
+}
+
+// limiterTake 检查规则后执行多key限流脚本，参数为 key数量, key..., 本次请求数, extra..., 每个规则的参数...；脚本使用redis服务器的时间
+func limiterTake(ctx context.Context, scriptKey string, requested int64, limits []Limit, limitArgs func(l Limit) (capacity int64, args []interface{}), extra ...interface{}) (allowed bool, remaining int64, retryAfter time.Duration, err error) {
+	if len(limits) == 0 || requested < 1 {
+		return false, 0, 0, ErrInvalidLimit
+	}
+	args := make([]interface{}, 0, 2+len(extra)+len(limits)*3)
+	args = append(args, len(limits))
+	for _, l := range limits {
+		args = append(args, l.Key)
+	}
+	args = append(args, requested)
+	args = append(args, extra...)
+	for _, l := range limits {
+		if l.Rate <= 0 || l.Period < time.Millisecond {
+			return false, 0, 0, ErrInvalidLimit
+		}
+		capacity, a := limitArgs(l)
+		if requested > capacity {
+			return false, 0, 0, ErrInvalidLimit
+		}
+		args = append(args, a...)
+	}
+	res, err := EvalScript(ctx, scriptKey, args...).Int64s()
+	if err != nil {
+		return
+	}
+	return res[0] == 1, res[1], time.Duration(res[2]) * time.Millisecond, nil
+}
@@ -0,0 +1,101 @@
+package redis
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestTokenBucketTake(t *testing.T) {
+	ctx := context.Background()
+	key := "test_token_bucket:" + strconv.FormatInt(time.Now().UnixNano(), 10)
+	defer Del(ctx, key)
+	for i := 0; i < 3; i++ {
+		allowed, remaining, _, err := TokenBucketTake(ctx, key, 10, 3, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !allowed || remaining != int64(2-i) {
+			t.Errorf("第%d次应该获取成功，剩余%d", i+1, remaining)
+		}
+	}
+	allowed, _, retryAfter, err := TokenBucketTake(ctx, key, 10, 3, 1)
+	if err != nil || allowed || retryAfter <= 0 || retryAfter > 100*time.Millisecond {
+		t.Errorf("令牌用完应该获取失败，allowed %v retryAfter %s err %v", allowed, retryAfter, err)
+	}
+	time.Sleep(110 * time.Millisecond)
+	if allowed, _, _, _ = TokenBucketTake(ctx, key, 10, 3, 1); !allowed {
+		t.Error("补充令牌后应该获取成功")
+	}
+	if _, _, _, err = TokenBucketTake(ctx, key, 0, 3, 1); err != ErrInvalidLimit {
+		t.Errorf("rate为0应该返回ErrInvalidLimit，实际%v", err)
+	}
+}
+
+func TestLimiters(t *testing.T) {
+	ctx := context.Background()
+	takes := map[string]func(ctx context.Context, requested int64, limits ...Limit) (bool, int64, time.Duration, error){
+		"sliding_window_log":     SlidingWindowLogTake,
+		"sliding_window_counter": SlidingWindowTake,
+		"token_bucket":           TokenBucketTakeMulti,
+		"gcra":                   GCRATake,
+	}
+	for name, take := range takes {
+		t.Run(name, func(t *testing.T) {
+			prefix := "test_limiter:{" + name + strconv.FormatInt(time.Now().UnixNano(), 10) + "}"
+			user := Limit{Key: prefix + ":user", Rate: 5, Period: time.Minute}
+			merchant := Limit{Key: prefix + ":merchant", Rate: 3, Period: time.Minute}
+			defer Del(ctx, user.Key, merchant.Key)
+
+			for i := 0; i < 3; i++ {
+				allowed, remaining, _, err := take(ctx, 1, user, merchant)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !allowed || remaining != int64(2-i) {
+					t.Errorf("第%d次应该允许，剩余%d", i+1, remaining)
+				}
+			}
+			// 商户达到限制，用户的配额不应被扣减
+			allowed, _, retryAfter, err := take(ctx, 1, user, merchant)
+			if err != nil || allowed || retryAfter <= 0 || retryAfter > time.Minute {
+				t.Errorf("商户达到限制应该拒绝，allowed %v retryAfter %s err %v", allowed, retryAfter, err)
+			}
+			allowed, remaining, _, err := take(ctx, 2, user)
+			if err != nil || !allowed || remaining != 0 {
+				t.Errorf("用户剩余配额应该为2，allowed %v remaining %d err %v", allowed, remaining, err)
+			}
+			if allowed, _, _, _ = take(ctx, 1, user); allowed {
+				t.Error("用户达到限制应该拒绝")
+			}
+			if _, _, _, err = take(ctx, 6, user); err != ErrInvalidLimit {
+				t.Errorf("请求数超过容量应该返回ErrInvalidLimit，实际%v", err)
+			}
+		})
+	}
+}
+
+func TestSlidingWindowRetryAfter(t *testing.T) {
+	ctx := context.Background()
+	l := Limit{Key: "test_sliding_log:" + strconv.FormatInt(time.Now().UnixNano(), 10), Rate: 2, Period: 200 * time.Millisecond}
+	defer Del(ctx, l.Key)
+	SlidingWindowLogTake(ctx, 1, l)
+	time.Sleep(50 * time.Millisecond)
+	SlidingWindowLogTake(ctx, 1, l)
+	allowed, _, retryAfter, err := SlidingWindowLogTake(ctx, 1, l)
+	if err != nil || allowed || retryAfter > 150*time.Millisecond {
+		t.Fatalf("应该在第一次请求过期后允许，allowed %v retryAfter %s err %v", allowed, retryAfter, err)
+	}
+	time.Sleep(retryAfter + 5*time.Millisecond)
+	if allowed, _, _, _ = SlidingWindowLogTake(ctx, 1, l); !allowed {
+		t.Error("等待retryAfter后应该允许")
+	}
+
+	// 降低限制后窗口内的记录超过新的限制
+	l.Rate = 1
+	allowed, remaining, retryAfter, err := SlidingWindowLogTake(ctx, 1, l)
+	if err != nil || allowed || remaining != 0 || retryAfter <= 0 || retryAfter > l.Period {
+		t.Errorf("降低限制后应该拒绝，allowed %v remaining %d retryAfter %s err %v", allowed, remaining, retryAfter, err)
+	}
+}
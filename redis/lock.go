@@ -21,7 +21,7 @@ func Lock(ctx context.Context, key string, value interface{}, expire int64) (loc
 }
 
 // LockLocalTimeout
-// @Description: 加锁，如果加锁失败会一直尝试，直到本地超时才返回
+// @Description: 加锁，如果加锁失败会一直尝试，直到本地超时才返回；本地超时返回的locked为true但并没有持有锁，需要确认持有锁时使用Mutex
 // @param ctx context.Context
 // @param key
 // @param value
@@ -3,6 +3,7 @@ package redis
 import (
 	"context"
 	"fmt"
+	"github.com/youchuangcd/gopkg/mylog"
 	"os"
 	"strconv"
 	"testing"
@@ -12,6 +13,7 @@ import (
 func TestMain(m *testing.M) {
 	//准备工作
 	fmt.Println("start prepare")
+	mylog.InitLog()
 	configs := make([]Config, 0, 1)
 	configs = append(configs, Config{
 		Name:        "default",
@@ -114,3 +116,16 @@ func TestLockLocalTimeout(t *testing.T) {
 		t.Log("阻塞式等待加锁成功4, 是否为本地加锁: ", local, ",本地最多等待", localTimeout, "剩余时长：", remainDuration, "s 等待", endTime.Sub(startTime).Milliseconds(), "ms") // 记录一些你期望记录的信息
 	}
 }
+
+func TestNonceStore(t *testing.T) {
+	ctx := context.Background()
+	s := NonceStore{Prefix: "test_nonce:"}
+	key := strconv.FormatInt(time.Now().UnixNano(), 10)
+	defer Del(ctx, s.Prefix+key)
+	if ok, err := s.Use(ctx, key, time.Minute); err != nil || !ok {
+		t.Fatalf("第一次使用应该成功: %v %v", ok, err)
+	}
+	if ok, _ := s.Use(ctx, key, time.Minute); ok {
+		t.Error("重复使用应该失败")
+	}
+}
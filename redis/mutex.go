@@ -0,0 +1,264 @@
+package redis
+
+import (
+	"context"
+	"errors"
+	"github.com/youchuangcd/gopkg"
+	"github.com/youchuangcd/gopkg/common/utils"
+	"github.com/youchuangcd/gopkg/mylog"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrLockNotHeld 没有持有锁，或锁已过期被其他持有者获取
+	ErrLockNotHeld = errors.New("redis: lock not held")
+	// DefaultMutexExpire 锁的默认过期时间，持有期间看门狗每1/3过期时间续期一次
+	DefaultMutexExpire = 30 * time.Second
+	// DefaultMutexRetryInterval 加锁失败后的默认重试间隔
+	DefaultMutexRetryInterval = 50 * time.Millisecond
+)
+
+// MutexOption 锁配置
+type MutexOption struct {
+	// Owner 持有者token，默认随机生成；相同token的Mutex视为同一个持有者，可以重入
+	Owner string
+	// Expire 锁的过期时间，进程退出没有解锁时最多在该时间后自动释放
+	Expire time.Duration
+	// RetryInterval 加锁失败后的重试间隔，会加上随机抖动，不超过锁的剩余时间
+	RetryInterval time.Duration
+	// DisableWatchdog 关闭自动续期，锁在Expire后过期
+	DisableWatchdog bool
+}
+
+// SetMutexOptionFunc 设置锁配置的方法
+type SetMutexOptionFunc func(option MutexOption) MutexOption
+
+// Mutex 可重入的分布式锁
+//
+// 同一个Mutex对象是同一个持有者，多个协程之间互斥需要各自创建Mutex；
+// 持有期间看门狗自动续期，续期发现锁已被其他持有者获取时关闭Lost返回的channel
+//
+//	m := redis.NewMutex("order:1")
+//	fence, err := m.Acquire(ctx)
+//	if err != nil {
+//		return err
+//	}
+//	defer m.Release(ctx)
+type Mutex struct {
+	key      string
+	fenceKey string
+	option   MutexOption
+
+	mu    sync.Mutex
+	held  int64
+	fence int64
+	stop  chan struct{}
+	lost  chan struct{}
+}
+
+// NewMutex
+// @Description: 创建锁
+// @param key
+// @param optionFuncs
+// @return *Mutex
+func NewMutex(key string, optionFuncs ...SetMutexOptionFunc) *Mutex {
+	option := MutexOption{
+		Expire:        DefaultMutexExpire,
+		RetryInterval: DefaultMutexRetryInterval,
+	}
+	for _, optionFunc := range optionFuncs {
+		option = optionFunc(option)
+	}
+	if option.Owner == "" {
+		option.Owner = utils.GenUniqueId()
+	}
+	return &Mutex{
+		key:      key,
+		fenceKey: fenceKey(key),
+		option:   option,
+	}
+}
+
+// fenceKey fencing token计数器的key，不过期以保证递增；集群模式下与锁在同一个slot
+func fenceKey(key string) string {
+	return tagKey(key, "fence")
+}
+
+// tagKey 生成与key在同一个slot的关联key，key没有hash tag时把整个key作为hash tag
+func tagKey(key, suffix string) string {
+	if start := strings.IndexByte(key, '{'); start >= 0 {
+		if end := strings.IndexByte(key[start+1:], '}'); end > 0 {
+			return key + ":" + suffix
+		}
+	}
+	return "{" + key + "}:" + suffix
+}
+
+// TryAcquire
+// @Description: 尝试加锁一次
+// @receiver m
+// @param ctx 选择redis实例，看门狗续期时也使用该实例
+// @return fence fencing token，每次获取锁都比上一次大，重入时不变
+// @return ok
+// @return err
+func (m *Mutex) TryAcquire(ctx context.Context) (fence int64, ok bool, err error) {
+	fence, ok, _, err = m.tryAcquire(ctx)
+	return
+}
+
+// Acquire
+// @Description: 加锁，锁被占用时重试直到获取成功或ctx结束
+// @receiver m
+// @param ctx
+// @return fence fencing token，写入受保护的资源时带上，资源方拒绝比已见过的更小的token
+// @return err ctx结束时返回ctx.Err()
+func (m *Mutex) Acquire(ctx context.Context) (fence int64, err error) {
+	for {
+		var (
+			ok  bool
+			ttl time.Duration
+		)
+		if fence, ok, ttl, err = m.tryAcquire(ctx); ok || err != nil {
+			return
+		}
+		wait := m.option.RetryInterval + time.Duration(rand.Int63n(int64(m.option.RetryInterval)+1))
+		if ttl > 0 && ttl < wait {
+			wait = ttl
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return 0, ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+func (m *Mutex) tryAcquire(ctx context.Context) (fence int64, ok bool, ttl time.Duration, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	res, err := EvalScript(ctx, ScriptKeyMutexLock, m.key, m.fenceKey, m.option.Owner, m.option.Expire.Milliseconds()).Int64s()
+	if err != nil {
+		return
+	}
+	if res[0] != 1 {
+		return 0, false, time.Duration(res[2]) * time.Millisecond, nil
+	}
+	m.held++
+	m.fence = res[1]
+	if m.held == 1 {
+		m.lost = make(chan struct{})
+		if !m.option.DisableWatchdog {
+			m.stop = make(chan struct{})
+			go m.watchdog(valueOnlyContext{ctx}, m.stop, m.lost)
+		}
+	}
+	return m.fence, true, 0, nil
+}
+
+// Release
+// @Description: 解锁，重入时需要解锁相同的次数才会释放
+// @receiver m
+// @param ctx
+// @return error 没有持有锁或锁已被其他持有者获取时返回ErrLockNotHeld
+func (m *Mutex) Release(ctx context.Context) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.held == 0 {
+		return ErrLockNotHeld
+	}
+	remaining, err := EvalScript(ctx, ScriptKeyMutexUnlock, m.key, m.option.Owner).Int64()
+	if err != nil {
+		return err
+	}
+	if remaining > 0 {
+		m.held = remaining
+		return nil
+	}
+	m.reset(remaining < 0)
+	if remaining < 0 {
+		return ErrLockNotHeld
+	}
+	return nil
+}
+
+// reset 释放或丢失锁后停止看门狗，调用方需持有mu
+func (m *Mutex) reset(lost bool) {
+	m.held = 0
+	if m.stop != nil {
+		close(m.stop)
+		m.stop = nil
+	}
+	if lost {
+		close(m.lost)
+	}
+}
+
+// Fence 最近一次获取锁的fencing token
+func (m *Mutex) Fence() int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.fence
+}
+
+// Held 是否持有锁
+func (m *Mutex) Held() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.held > 0
+}
+
+// Lost
+// @Description: 当前持有的锁被其他持有者获取时关闭，没有持有锁时返回nil
+// @receiver m
+// @return <-chan struct{}
+func (m *Mutex) Lost() <-chan struct{} {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.held == 0 {
+		return nil
+	}
+	return m.lost
+}
+
+// watchdog 每1/3过期时间续期一次，直到解锁或发现锁已丢失
+func (m *Mutex) watchdog(ctx context.Context, stop, lost chan struct{}) {
+	ticker := time.NewTicker(m.option.Expire / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		ok, err := EvalScript(ctx, ScriptKeyMutexRenew, m.key, m.option.Owner, m.option.Expire.Milliseconds()).Int64()
+		if err != nil {
+			// 网络错误时继续尝试，锁在过期前还有两次机会
+			mylog.WithWarn(ctx, gopkg.LogRedis, map[string]interface{}{
+				"key": m.key,
+				"err": err.Error(),
+			}, "分布式锁续期失败")
+			continue
+		}
+		if ok == 1 {
+			continue
+		}
+		m.mu.Lock()
+		// 等锁期间可能已经解锁
+		if m.stop == stop {
+			m.stop = nil
+			m.held = 0
+			close(lost)
+			mylog.WithError(ctx, gopkg.LogRedis, map[string]interface{}{
+				"key":   m.key,
+				"fence": m.fence,
+			}, "分布式锁已丢失")
+		}
+		m.mu.Unlock()
+		return
+	}
+}
@@ -0,0 +1,68 @@
+package redis
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestMutex(t *testing.T) {
+	ctx := context.Background()
+	key := "test_mutex:" + strconv.FormatInt(time.Now().UnixNano(), 10)
+	defer Del(ctx, key, fenceKey(key))
+	expire := func(option MutexOption) MutexOption {
+		option.Expire = 300 * time.Millisecond
+		option.RetryInterval = 10 * time.Millisecond
+		return option
+	}
+
+	m1 := NewMutex(key, expire)
+	fence1, err := m1.Acquire(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 重入
+	if fence, ok, err := m1.TryAcquire(ctx); !ok || err != nil || fence != fence1 {
+		t.Fatalf("重入失败 %d %v %v", fence, ok, err)
+	}
+
+	// 看门狗续期，超过过期时间后其他持有者仍然无法获取
+	m2 := NewMutex(key, expire)
+	time.Sleep(500 * time.Millisecond)
+	if _, ok, _ := m2.TryAcquire(ctx); ok {
+		t.Fatal("续期后其他持有者不应该获取到锁")
+	}
+	tctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	if _, err = m2.Acquire(tctx); err != context.DeadlineExceeded {
+		t.Fatalf("ctx超时应该返回 %v", err)
+	}
+
+	// 重入两次需要解锁两次
+	if err = m1.Release(ctx); err != nil || !m1.Held() {
+		t.Fatalf("第一次解锁 %v", err)
+	}
+	if err = m1.Release(ctx); err != nil || m1.Held() {
+		t.Fatalf("第二次解锁 %v", err)
+	}
+	if err = m1.Release(ctx); err != ErrLockNotHeld {
+		t.Fatalf("没有持有时解锁 %v", err)
+	}
+
+	fence2, err := m2.Acquire(ctx)
+	if err != nil || fence2 <= fence1 {
+		t.Fatalf("fencing token应该递增 %d %d %v", fence1, fence2, err)
+	}
+	// 锁被删除后看门狗发现丢失
+	lost := m2.Lost()
+	Del(ctx, key)
+	select {
+	case <-lost:
+	case <-time.After(time.Second):
+		t.Fatal("锁丢失后应该关闭Lost")
+	}
+	if m2.Held() || m2.Release(ctx) != ErrLockNotHeld {
+		t.Error("锁丢失后不应该再持有")
+	}
+}
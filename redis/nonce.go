@@ -0,0 +1,26 @@
+package redis
+
+import (
+	"context"
+	"time"
+)
+
+// NonceStore 使用redis SET NX记录签名请求的nonce，多实例共享；实现auth.NonceStore，ctx用于选择redis实例
+type NonceStore struct {
+	// Prefix key前缀
+	Prefix string
+}
+
+// Use
+// @Description: SET NX EX，key已存在表示nonce已使用
+// @receiver s
+// @param ctx
+// @param key
+// @param ttl 向上取整到秒
+// @return bool nonce是否第一次使用
+// @return error
+func (s NonceStore) Use(ctx context.Context, key string, ttl time.Duration) (bool, error) {
+	seconds := int64((ttl + time.Second - 1) / time.Second)
+	locked, _, err := Lock(ctx, s.Prefix+key, 1, seconds)
+	return locked, err
+}
@@ -0,0 +1,380 @@
+package redis
+
+import (
+	"context"
+	"errors"
+	"github.com/gomodule/redigo/redis"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrPipelineNotExecuted 命令已加入pipeline，还没有执行Exec
+	ErrPipelineNotExecuted = errors.New("redis: pipeline not executed")
+	// ErrPipelinePool 加入pipeline的命令与pipeline不是同一个redis实例
+	ErrPipelinePool = errors.New("redis: command redis instance differs from pipeline")
+	// ErrTxFailed 监视的key被修改，事务没有执行
+	ErrTxFailed = errors.New("redis: transaction aborted, watched keys changed")
+	// errPipelineConn pipeline的连接只能使用Do
+	errPipelineConn = errors.New("redis: pipeline connection only supports Do")
+)
+
+// pipelineCtxKey 上下文中的pipeline
+type pipelineCtxKey struct{}
+
+type pipelineCmd struct {
+	name  string
+	args  []interface{}
+	reply *Reply
+}
+
+// Pipeline 把多个命令合并为一次往返发送，不是协程安全的
+//
+//	pl := redis.NewPipeline(ctx)
+//	redis.Set(pl.Context(), "k1", "v1", 60)
+//	r := redis.Get(pl.Context(), "k2")
+//	pl.Do("incr", "k3")
+//	replies, err := pl.Exec()
+//	v, err := r.String()
+//
+// 只有返回*Reply的方法可以加入pipeline，在Exec之后才可以读取结果
+type Pipeline struct {
+	ctx  context.Context
+	pool *Pool
+	cmds []pipelineCmd
+}
+
+// NewPipeline
+// @Description: 创建pipeline，使用ctx选择的redis实例，Exec时使用ctx的超时
+// @param ctx
+// @return *Pipeline
+func NewPipeline(ctx context.Context) *Pipeline {
+	return &Pipeline{ctx: ctx, pool: getPoolInstance(ctx)}
+}
+
+// Pipelined
+// @Description: 在fn中使用传入的ctx调用的方法都会加入pipeline，fn返回后一次发送
+// @param ctx
+// @param fn
+// @return []*Reply 与加入的顺序一致
+// @return error 第一个失败的命令的错误
+func Pipelined(ctx context.Context, fn func(ctx context.Context)) ([]*Reply, error) {
+	pl := NewPipeline(ctx)
+	fn(pl.Context())
+	return pl.Exec()
+}
+
+// Context
+// @Description: 返回的ctx传给Set、Get、EvalScript等方法时，命令加入pipeline而不是立即执行
+// @receiver p
+// @return context.Context
+func (p *Pipeline) Context() context.Context {
+	return context.WithValue(p.ctx, pipelineCtxKey{}, p)
+}
+
+// Do
+// @Description: 加入一个命令
+// @receiver p
+// @param commandName
+// @param args
+// @return *Reply Exec之后可以读取结果
+func (p *Pipeline) Do(commandName string, args ...interface{}) *Reply {
+	r := getReply(nil, ErrPipelineNotExecuted)
+	p.cmds = append(p.cmds, pipelineCmd{name: commandName, args: args, reply: r})
+	return r
+}
+
+// Len 已加入的命令数量
+func (p *Pipeline) Len() int {
+	return len(p.cmds)
+}
+
+// Exec
+// @Description: 发送所有命令，执行后清空，可以继续加入命令
+// @receiver p
+// @return []*Reply 与加入的顺序一致
+// @return error 第一个失败的命令的错误
+func (p *Pipeline) Exec() ([]*Reply, error) {
+	cmds := p.cmds
+	p.cmds = nil
+	replies := make([]*Reply, len(cmds))
+	for i, cmd := range cmds {
+		replies[i] = cmd.reply
+	}
+	if len(cmds) == 0 {
+		return replies, nil
+	}
+	if p.pool.cluster != nil {
+		p.execCluster(cmds)
+	} else {
+		c, err := p.pool.Pool.GetContext(p.ctx)
+		if err == nil {
+			execCmds(p.ctx, c, cmds)
+		} else {
+			fillError(cmds, err)
+		}
+		c.Close()
+	}
+	for _, r := range replies {
+		if r.error != nil {
+			return replies, r.error
+		}
+	}
+	return replies, nil
+}
+
+// execCluster 按节点分组发送，slot迁移导致重定向的命令单独重新执行
+func (p *Pipeline) execCluster(cmds []pipelineCmd) {
+	cl := p.pool.cluster
+	groups := make(map[string][]pipelineCmd)
+	var addrs []string
+	for _, cmd := range cmds {
+		key, hasKey := commandKey(strings.ToUpper(cmd.name), cmd.args)
+		addr, err := cl.addrForKey(p.ctx, key, hasKey)
+		if err != nil {
+			cmd.reply.error = err
+			continue
+		}
+		if _, ok := groups[addr]; !ok {
+			addrs = append(addrs, addr)
+		}
+		groups[addr] = append(groups[addr], cmd)
+	}
+	for _, addr := range addrs {
+		c, err := cl.nodePool(addr).GetContext(p.ctx)
+		if err == nil {
+			execCmds(p.ctx, c, groups[addr])
+		} else {
+			fillError(groups[addr], err)
+		}
+		c.Close()
+	}
+	for _, cmd := range cmds {
+		if e, ok := cmd.reply.error.(redis.Error); ok && isClusterRedirect(string(e)) {
+			key, hasKey := commandKey(strings.ToUpper(cmd.name), cmd.args)
+			cmd.reply.reply, cmd.reply.error = cl.do(p.ctx, key, hasKey, cmd.name, cmd.args)
+		}
+	}
+}
+
+// execCmds 在一个连接上发送命令并按顺序读取结果
+func execCmds(ctx context.Context, c redis.Conn, cmds []pipelineCmd) {
+	for _, cmd := range cmds {
+		if err := c.Send(cmd.name, cmd.args...); err != nil {
+			fillError(cmds, err)
+			return
+		}
+	}
+	if err := c.Flush(); err != nil {
+		fillError(cmds, err)
+		return
+	}
+	for i, cmd := range cmds {
+		cmd.reply.reply, cmd.reply.error = redis.ReceiveContext(c, ctx)
+		if _, ok := cmd.reply.error.(redis.Error); !ok && cmd.reply.error != nil {
+			// 连接错误，后面的结果无法读取
+			fillError(cmds[i+1:], cmd.reply.error)
+			return
+		}
+	}
+}
+
+func fillError(cmds []pipelineCmd, err error) {
+	for _, cmd := range cmds {
+		cmd.reply.reply, cmd.reply.error = nil, err
+	}
+}
+
+func isClusterRedirect(msg string) bool {
+	return strings.HasPrefix(msg, "MOVED ") || strings.HasPrefix(msg, "ASK ") ||
+		strings.HasPrefix(msg, "TRYAGAIN") || strings.HasPrefix(msg, "CLUSTERDOWN")
+}
+
+// conn 供Pool.GetContext返回，pool与pipeline不一致时返回错误
+func (p *Pipeline) conn(pool *Pool) redis.Conn {
+	c := &pipelineConn{pipeline: p}
+	if pool != p.pool {
+		c.err = ErrPipelinePool
+	}
+	return c
+}
+
+// queuedReply 加入pipeline后返回的占位结果，getReply会返回pipeline中的*Reply
+type queuedReply struct {
+	reply *Reply
+}
+
+// pipelineConn 把Do的命令加入pipeline
+type pipelineConn struct {
+	pipeline *Pipeline
+	err      error
+}
+
+func (c *pipelineConn) Do(commandName string, args ...interface{}) (interface{}, error) {
+	if c.err != nil {
+		return nil, c.err
+	}
+	return queuedReply{reply: c.pipeline.Do(commandName, args...)}, nil
+}
+
+func (c *pipelineConn) DoContext(_ context.Context, commandName string, args ...interface{}) (interface{}, error) {
+	return c.Do(commandName, args...)
+}
+
+func (c *pipelineConn) DoWithTimeout(_ time.Duration, commandName string, args ...interface{}) (interface{}, error) {
+	return c.Do(commandName, args...)
+}
+
+func (c *pipelineConn) Send(string, ...interface{}) error {
+	return errPipelineConn
+}
+
+func (c *pipelineConn) Flush() error {
+	return errPipelineConn
+}
+
+func (c *pipelineConn) Receive() (interface{}, error) {
+	return nil, errPipelineConn
+}
+
+func (c *pipelineConn) ReceiveContext(context.Context) (interface{}, error) {
+	return nil, errPipelineConn
+}
+
+func (c *pipelineConn) ReceiveWithTimeout(time.Duration) (interface{}, error) {
+	return nil, errPipelineConn
+}
+
+func (c *pipelineConn) Err() error {
+	return c.err
+}
+
+func (c *pipelineConn) Close() error {
+	return nil
+}
+
+// Tx 事务，Do和Context加入的命令在MULTI/EXEC中执行
+type Tx struct {
+	pipeline *Pipeline
+}
+
+// Do
+// @Description: 加入一个事务中执行的命令
+// @receiver tx
+// @param commandName
+// @param args
+// @return *Reply EXEC之后可以读取结果
+func (tx *Tx) Do(commandName string, args ...interface{}) *Reply {
+	return tx.pipeline.Do(commandName, args...)
+}
+
+// Context
+// @Description: 返回的ctx传给Set、Get等方法时，命令加入事务
+// @receiver tx
+// @return context.Context
+func (tx *Tx) Context() context.Context {
+	return tx.pipeline.Context()
+}
+
+// Transaction
+// @Description: 先WATCH监视的key，执行fn读取数据并加入命令，再通过MULTI/EXEC执行；fn中使用原ctx读取的数据不在事务中
+//
+//	replies, err := redis.Transaction(ctx, func(tx *redis.Tx) error {
+//		n, err := redis.Get(ctx, "counter").Int64()
+//		if err != nil && err != redis.ErrNil {
+//			return err
+//		}
+//		redis.Set(tx.Context(), "counter", n+1)
+//		return nil
+//	}, "counter")
+//
+// @param ctx
+// @param fn 返回错误时放弃事务
+// @param watchKeys 监视的key，执行前被修改时返回ErrTxFailed
+// @return []*Reply 事务中每个命令的结果
+// @return error
+func Transaction(ctx context.Context, fn func(tx *Tx) error, watchKeys ...string) ([]*Reply, error) {
+	pool := getPoolInstance(ctx)
+	c, err := pool.GetContext(ctx)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	defer c.Close()
+	if len(watchKeys) > 0 {
+		if _, err = redis.DoContext(c, ctx, "WATCH", redis.Args{}.AddFlat(watchKeys)...); err != nil {
+			return nil, err
+		}
+	}
+	tx := &Tx{pipeline: &Pipeline{ctx: ctx, pool: pool}}
+	if err = fn(tx); err != nil {
+		return nil, err
+	}
+	cmds := tx.pipeline.cmds
+	tx.pipeline.cmds = nil
+	replies := make([]*Reply, len(cmds))
+	for i, cmd := range cmds {
+		replies[i] = cmd.reply
+	}
+	if len(cmds) == 0 {
+		return replies, nil
+	}
+	if err = c.Send("MULTI"); err != nil {
+		return nil, err
+	}
+	for _, cmd := range cmds {
+		if err = c.Send(cmd.name, cmd.args...); err != nil {
+			return nil, err
+		}
+	}
+	// Do会读取MULTI和每个命令的QUEUED，返回EXEC的结果
+	values, err := redis.Values(redis.DoContext(c, ctx, "EXEC"))
+	if err == ErrNil {
+		err = ErrTxFailed
+	}
+	if err != nil {
+		fillError(cmds, err)
+		return replies, err
+	}
+	for i, cmd := range cmds {
+		if i >= len(values) {
+			break
+		}
+		if e, ok := values[i].(redis.Error); ok {
+			cmd.reply.reply, cmd.reply.error = nil, e
+		} else {
+			cmd.reply.reply, cmd.reply.error = values[i], nil
+		}
+	}
+	for _, r := range replies {
+		if r.error != nil {
+			return replies, r.error
+		}
+	}
+	return replies, nil
+}
+
+// TransactionRetry
+// @Description: 监视的key被修改时重新执行fn，最多重试maxRetries次
+// @param ctx
+// @param maxRetries
+// @param fn
+// @param watchKeys
+// @return []*Reply
+// @return error 重试次数用完时返回ErrTxFailed
+func TransactionRetry(ctx context.Context, maxRetries int, fn func(tx *Tx) error, watchKeys ...string) ([]*Reply, error) {
+	for i := 0; ; i++ {
+		replies, err := Transaction(ctx, fn, watchKeys...)
+		if err != ErrTxFailed || i >= maxRetries {
+			return replies, err
+		}
+		// 随重试次数增加等待时间，减少冲突
+		timer := time.NewTimer(time.Duration(i+1) * 5 * time.Millisecond)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return replies, ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package redis
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestPipeline(t *testing.T) {
+	ctx := context.Background()
+	key := "test_pipeline:" + strconv.FormatInt(time.Now().UnixNano(), 10)
+	defer Del(ctx, key, key+"_incr")
+
+	pl := NewPipeline(ctx)
+	Set(pl.Context(), key, "v1", 10)
+	get := Get(pl.Context(), key)
+	incr := EvalScript(pl.Context(), ScriptKeyIncr, key+"_incr", 10)
+	pl.Do("incrby", key+"_incr", 2)
+	if _, err := get.String(); err != ErrPipelineNotExecuted {
+		t.Fatalf("Exec之前不应该有结果 %v", err)
+	}
+	replies, err := pl.Exec()
+	if err != nil || len(replies) != 4 {
+		t.Fatalf("exec %d %v", len(replies), err)
+	}
+	if v, _ := get.String(); v != "v1" {
+		t.Errorf("get %s", v)
+	}
+	if v, _ := incr.Int64(); v != 1 {
+		t.Errorf("eval %d", v)
+	}
+	if v, _ := replies[3].Int64(); v != 3 {
+		t.Errorf("incrby %d", v)
+	}
+
+	replies, err = Pipelined(ctx, func(ctx context.Context) {
+		HSet(ctx, key, "f", 1)
+	})
+	if err == nil || replies[0].Error() == nil {
+		t.Error("类型错误的命令应该返回错误")
+	}
+}
+
+func TestTransaction(t *testing.T) {
+	ctx := context.Background()
+	key := "test_tx:" + strconv.FormatInt(time.Now().UnixNano(), 10)
+	defer Del(ctx, key)
+
+	attempts := 0
+	incr := func(tx *Tx) error {
+		attempts++
+		n, err := Get(ctx, key).Int64()
+		if err != nil && err != ErrNil {
+			return err
+		}
+		if attempts == 1 {
+			// 模拟并发修改
+			Set(ctx, key, 10)
+			n = 10
+		}
+		Set(tx.Context(), key, n+1)
+		tx.Do("get", key)
+		return nil
+	}
+	if _, err := Transaction(ctx, incr, key); err != ErrTxFailed {
+		t.Fatalf("监视的key被修改应该返回ErrTxFailed %v", err)
+	}
+	attempts = 0
+	replies, err := TransactionRetry(ctx, 3, incr, key)
+	if err != nil || attempts != 2 {
+		t.Fatalf("重试后应该成功 attempts %d err %v", attempts, err)
+	}
+	if v, _ := replies[1].Int64(); v != 11 {
+		t.Errorf("事务结果 %d", v)
+	}
+}
@@ -0,0 +1,363 @@
+package redis
+
+import (
+	"context"
+	"fmt"
+	"github.com/gomodule/redigo/redis"
+	"github.com/youchuangcd/gopkg"
+	"github.com/youchuangcd/gopkg/mylog"
+	"sync"
+	"time"
+)
+
+var (
+	// DefaultSubscribePingInterval 订阅连接默认的心跳间隔
+	DefaultSubscribePingInterval = 30 * time.Second
+	// DefaultSubscribeMinBackoff 断开后第一次重连的等待时间
+	DefaultSubscribeMinBackoff = 100 * time.Millisecond
+	// DefaultSubscribeMaxBackoff 重连等待时间的上限
+	DefaultSubscribeMaxBackoff = 10 * time.Second
+)
+
+// Message 订阅收到的消息，Pattern在PSubscribe匹配时才有值
+type Message struct {
+	Channel string
+	Pattern string
+	Data    []byte
+}
+
+// MessageHandler 消息处理方法，在接收消息的协程中依次调用，处理慢会阻塞后续消息
+type MessageHandler func(ctx context.Context, msg Message)
+
+// SubscribeOption 订阅配置
+type SubscribeOption struct {
+	// PingInterval 心跳间隔，超过两个间隔没有收到任何数据时重连
+	PingInterval time.Duration
+	// MinBackoff 断开后第一次重连的等待时间，连续失败时翻倍
+	MinBackoff time.Duration
+	// MaxBackoff 重连等待时间的上限
+	MaxBackoff time.Duration
+}
+
+// SetSubscribeOptionFunc 设置订阅配置的方法
+type SetSubscribeOptionFunc func(option SubscribeOption) SubscribeOption
+
+// Subscriber 使用独立连接订阅，断开后自动重连并重新订阅所有频道
+type Subscriber struct {
+	ctx     context.Context
+	cancel  context.CancelFunc
+	pool    *Pool
+	handler MessageHandler
+	option  SubscribeOption
+
+	// mu 保护订阅列表，同时保证同一时间只有一个协程写连接
+	mu       sync.Mutex
+	channels map[string]struct{}
+	patterns map[string]struct{}
+	conn     redis.Conn
+
+	done chan struct{}
+}
+
+// NewSubscriber
+// @Description: 创建订阅者，使用ctx选择的redis实例，ctx取消或调用Close后退出
+// @param ctx
+// @param handler
+// @param optionFuncs
+// @return *Subscriber
+func NewSubscriber(ctx context.Context, handler MessageHandler, optionFuncs ...SetSubscribeOptionFunc) *Subscriber {
+	option := SubscribeOption{
+		PingInterval: DefaultSubscribePingInterval,
+		MinBackoff:   DefaultSubscribeMinBackoff,
+		MaxBackoff:   DefaultSubscribeMaxBackoff,
+	}
+	for _, optionFunc := range optionFuncs {
+		option = optionFunc(option)
+	}
+	pool := getPoolInstance(ctx)
+	ctx, cancel := context.WithCancel(ctx)
+	s := &Subscriber{
+		ctx:      ctx,
+		cancel:   cancel,
+		pool:     pool,
+		handler:  handler,
+		option:   option,
+		channels: make(map[string]struct{}),
+		patterns: make(map[string]struct{}),
+		done:     make(chan struct{}),
+	}
+	go s.run()
+	return s
+}
+
+// Subscribe
+// @Description: 订阅频道，连接断开后会自动重新订阅
+// @param ctx
+// @param handler
+// @param channels
+// @return *Subscriber
+func Subscribe(ctx context.Context, handler MessageHandler, channels ...string) *Subscriber {
+	s := NewSubscriber(ctx, handler)
+	s.Subscribe(channels...)
+	return s
+}
+
+// PSubscribe
+// @Description: 按模式订阅频道，连接断开后会自动重新订阅
+// @param ctx
+// @param handler
+// @param patterns
+// @return *Subscriber
+func PSubscribe(ctx context.Context, handler MessageHandler, patterns ...string) *Subscriber {
+	s := NewSubscriber(ctx, handler)
+	s.PSubscribe(patterns...)
+	return s
+}
+
+// Publish
+// @Description: 发布消息
+// @param ctx
+// @param channel
+// @param message
+// @return *Reply 收到消息的订阅者数量
+func Publish(ctx context.Context, channel string, message interface{}) *Reply {
+	c, _ := getPoolInstance(ctx).GetContext(ctx)
+	defer c.Close()
+	return getReply(redis.DoContext(c, ctx, "publish", channel, message))
+}
+
+// Subscribe
+// @Description: 增加订阅的频道；未连接时在连接后订阅
+// @receiver s
+// @param channels
+// @return error 发送订阅命令失败，重连后会重新订阅
+func (s *Subscriber) Subscribe(channels ...string) error {
+	return s.update(s.channels, true, "SUBSCRIBE", channels)
+}
+
+// PSubscribe
+// @Description: 增加订阅的模式
+// @receiver s
+// @param patterns
+// @return error
+func (s *Subscriber) PSubscribe(patterns ...string) error {
+	return s.update(s.patterns, true, "PSUBSCRIBE", patterns)
+}
+
+// Unsubscribe
+// @Description: 取消订阅的频道
+// @receiver s
+// @param channels
+// @return error
+func (s *Subscriber) Unsubscribe(channels ...string) error {
+	return s.update(s.channels, false, "UNSUBSCRIBE", channels)
+}
+
+// PUnsubscribe
+// @Description: 取消订阅的模式
+// @receiver s
+// @param patterns
+// @return error
+func (s *Subscriber) PUnsubscribe(patterns ...string) error {
+	return s.update(s.patterns, false, "PUNSUBSCRIBE", patterns)
+}
+
+func (s *Subscriber) update(set map[string]struct{}, add bool, cmd string, names []string) error {
+	if len(names) == 0 {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, name := range names {
+		if add {
+			set[name] = struct{}{}
+		} else {
+			delete(set, name)
+		}
+	}
+	if s.conn == nil {
+		return nil
+	}
+	if err := s.conn.Send(cmd, redis.Args{}.AddFlat(names)...); err != nil {
+		return err
+	}
+	return s.conn.Flush()
+}
+
+// Close 取消订阅并等待退出
+func (s *Subscriber) Close() error {
+	s.cancel()
+	<-s.done
+	return nil
+}
+
+// Done 订阅者退出后关闭
+func (s *Subscriber) Done() <-chan struct{} {
+	return s.done
+}
+
+func (s *Subscriber) run() {
+	defer close(s.done)
+	backoff := s.option.MinBackoff
+	for {
+		subscribed, err := s.serve()
+		if s.ctx.Err() != nil {
+			return
+		}
+		if subscribed {
+			backoff = s.option.MinBackoff
+		}
+		mylog.WithWarn(s.ctx, gopkg.LogRedis, map[string]interface{}{
+			"name":    s.pool.config.Name,
+			"backoff": backoff.String(),
+			"err":     err.Error(),
+		}, "redis订阅连接断开，等待重连")
+		timer := time.NewTimer(backoff)
+		select {
+		case <-s.ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		if backoff *= 2; backoff > s.option.MaxBackoff {
+			backoff = s.option.MaxBackoff
+		}
+	}
+}
+
+// dial 订阅使用独立的连接，不占用连接池
+func (s *Subscriber) dial() (redis.Conn, error) {
+	if s.pool.cluster != nil {
+		// 集群中任意节点都可以收到所有频道的消息
+		addr, err := s.pool.cluster.addrForKey(s.ctx, "", false)
+		if err != nil {
+			return nil, err
+		}
+		return dialNode(s.ctx, s.pool.config, addr)
+	}
+	return s.pool.Pool.DialContext(s.ctx)
+}
+
+// serve 连接并重新订阅，读取消息直到连接断开；subscribed表示是否已经成功订阅
+func (s *Subscriber) serve() (subscribed bool, err error) {
+	c, err := s.dial()
+	if err != nil {
+		return
+	}
+	if err = s.resubscribe(c); err != nil {
+		c.Close()
+		return
+	}
+	subscribed = true
+	defer func() {
+		s.mu.Lock()
+		s.conn = nil
+		s.mu.Unlock()
+		c.Close()
+	}()
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		ticker := time.NewTicker(s.option.PingInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-s.ctx.Done():
+				// 关闭连接结束阻塞的读取
+				c.Close()
+				return
+			case <-stop:
+				return
+			case <-ticker.C:
+				s.mu.Lock()
+				pErr := c.Send("PING")
+				if pErr == nil {
+					pErr = c.Flush()
+				}
+				s.mu.Unlock()
+				if pErr != nil {
+					c.Close()
+					return
+				}
+			}
+		}
+	}()
+
+	readTimeout := 2*s.option.PingInterval + time.Duration(s.pool.config.ReadTimeout)*time.Millisecond
+	for {
+		reply, rErr := redis.ReceiveWithTimeout(c, readTimeout)
+		if rErr != nil {
+			if s.ctx.Err() != nil {
+				return subscribed, s.ctx.Err()
+			}
+			return subscribed, rErr
+		}
+		if msg, ok := parseMessage(reply); ok {
+			s.handle(msg)
+		}
+	}
+}
+
+// parseMessage 解析message、pmessage，订阅确认和PING的响应忽略；取消所有订阅后PING的响应是PONG字符串
+func parseMessage(reply interface{}) (msg Message, ok bool) {
+	values, err := redis.Values(reply, nil)
+	if err != nil || len(values) < 3 {
+		return
+	}
+	kind, _ := redis.String(values[0], nil)
+	switch {
+	case kind == "message":
+		msg.Channel, _ = redis.String(values[1], nil)
+		msg.Data, _ = redis.Bytes(values[2], nil)
+	case kind == "pmessage" && len(values) == 4:
+		msg.Pattern, _ = redis.String(values[1], nil)
+		msg.Channel, _ = redis.String(values[2], nil)
+		msg.Data, _ = redis.Bytes(values[3], nil)
+	default:
+		return
+	}
+	return msg, true
+}
+
+// resubscribe 订阅所有频道，与Subscribe互斥，保证新增的频道不会遗漏
+func (s *Subscriber) resubscribe(c redis.Conn) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.channels) > 0 {
+		if err := c.Send("SUBSCRIBE", redis.Args{}.AddFlat(mapKeys(s.channels))...); err != nil {
+			return err
+		}
+	}
+	if len(s.patterns) > 0 {
+		if err := c.Send("PSUBSCRIBE", redis.Args{}.AddFlat(mapKeys(s.patterns))...); err != nil {
+			return err
+		}
+	}
+	if err := c.Flush(); err != nil {
+		return err
+	}
+	s.conn = c
+	return nil
+}
+
+func (s *Subscriber) handle(msg Message) {
+	defer func() {
+		if r := recover(); r != nil {
+			mylog.WithError(s.ctx, gopkg.LogRedis, map[string]interface{}{
+				"channel": msg.Channel,
+				"pattern": msg.Pattern,
+				"panic":   fmt.Sprint(r),
+			}, "redis订阅消息处理异常")
+		}
+	}()
+	s.handler(s.ctx, msg)
+}
+
+func mapKeys(m map[string]struct{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	return keys
+}
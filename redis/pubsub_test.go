@@ -0,0 +1,69 @@
+package redis
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestSubscribe(t *testing.T) {
+	ctx := context.Background()
+	channel := "test_pubsub:" + strconv.FormatInt(time.Now().UnixNano(), 10)
+	msgs := make(chan Message, 10)
+	s := NewSubscriber(ctx, func(ctx context.Context, msg Message) {
+		msgs <- msg
+	}, func(option SubscribeOption) SubscribeOption {
+		option.PingInterval = 50 * time.Millisecond
+		option.MinBackoff = 10 * time.Millisecond
+		return option
+	})
+	defer s.Close()
+	s.Subscribe(channel)
+	s.PSubscribe(channel + ":*")
+
+	// 订阅生效前或断开后服务端还没有清理旧连接时消息会丢失，重复发布直到收到
+	receive := func(channel string) Message {
+		for len(msgs) > 0 {
+			<-msgs
+		}
+		deadline := time.After(2 * time.Second)
+		for {
+			Publish(ctx, channel, "hello")
+			select {
+			case msg := <-msgs:
+				return msg
+			case <-deadline:
+				t.Fatalf("%s 没有收到消息", channel)
+			case <-time.After(20 * time.Millisecond):
+			}
+		}
+	}
+	if msg := receive(channel); msg.Channel != channel || string(msg.Data) != "hello" {
+		t.Errorf("消息错误 %+v", msg)
+	}
+	if msg := receive(channel + ":a"); msg.Pattern != channel+":*" {
+		t.Errorf("模式订阅消息错误 %+v", msg)
+	}
+
+	// 连接断开后重新订阅
+	s.mu.Lock()
+	s.conn.Close()
+	s.mu.Unlock()
+	if msg := receive(channel); msg.Channel != channel {
+		t.Errorf("重连后消息错误 %+v", msg)
+	}
+
+	// 心跳期间保持连接
+	time.Sleep(200 * time.Millisecond)
+	if msg := receive(channel); msg.Channel != channel {
+		t.Errorf("心跳后消息错误 %+v", msg)
+	}
+
+	s.Close()
+	select {
+	case <-s.Done():
+	default:
+		t.Error("Close后应该退出")
+	}
+}
@@ -18,9 +18,20 @@ var (
 	once sync.Once
 )
 
+const (
+	// ModeStandalone 单节点，默认
+	ModeStandalone = "standalone"
+	// ModeSentinel 哨兵模式，通过哨兵发现master并跟随主从切换
+	ModeSentinel = "sentinel"
+	// ModeCluster 集群模式，按slot路由并处理MOVED/ASK重定向
+	ModeCluster = "cluster"
+)
+
 type Pool struct {
 	*redis.Pool
-	config Config
+	config   Config
+	sentinel *sentinel
+	cluster  *cluster
 }
 
 type Config struct {
@@ -35,6 +46,14 @@ type Config struct {
 	ConnectTimeout int    `mapstructure:"connectTimeout" yaml:"connectTimeout"` //连接超时 单位毫秒
 	ReadTimeout    int    `mapstructure:"readTimeout" yaml:"readTimeout"`       //读取超时 单位毫秒
 	WriteTimeout   int    `mapstructure:"writeTimeout" yaml:"writeTimeout"`     //写入超时 单位毫秒
+	// Mode 部署模式 standalone、sentinel、cluster，为空时是standalone
+	Mode string `mapstructure:"mode" yaml:"mode"`
+	// Addrs 哨兵模式是哨兵地址，集群模式是种子节点地址，格式 host:port；Host、Port仅在standalone模式使用
+	Addrs []string `mapstructure:"addrs" yaml:"addrs"`
+	// MasterName 哨兵模式监控的master名称
+	MasterName string `mapstructure:"masterName" yaml:"masterName"`
+	// SentinelPassword 哨兵的密码，Password是数据节点的密码
+	SentinelPassword string `mapstructure:"sentinelPassword" yaml:"sentinelPassword"`
 }
 
 func InitRedis(configs []Config) {
@@ -43,43 +62,116 @@ func InitRedis(configs []Config) {
 			redisCollections = make(map[string]*Pool, len(configs))
 		}
 		for _, v := range configs {
-			if v.ConnectTimeout == 0 {
-				v.ConnectTimeout = 1000
-			}
-			if v.ReadTimeout == 0 {
-				v.ReadTimeout = 1000
-			}
-			if v.WriteTimeout == 0 {
-				v.WriteTimeout = 1000
-			}
-			nv := v
 			// 建立连接池
-			redisCollections[v.Name] = &Pool{
-				config: nv,
-				Pool: &redis.Pool{
-					MaxIdle:     v.MaxIdle,                                       //最大空闲连接数
-					MaxActive:   v.MaxActive,                                     //最大连接数
-					IdleTimeout: time.Duration(v.IdleTimeout) * time.Millisecond, //空闲连接超时时间
-					Wait:        true,
-					DialContext: func(ctx context.Context) (redis.Conn, error) {
-						con, err := redis.DialContext(ctx, "tcp", fmt.Sprintf("%s:%d", nv.Host, nv.Port),
-							redis.DialPassword(nv.Password),
-							redis.DialDatabase(nv.Database),
-							redis.DialConnectTimeout(time.Duration(nv.ConnectTimeout)*time.Millisecond),
-							redis.DialReadTimeout(time.Duration(nv.ReadTimeout)*time.Millisecond),
-							redis.DialWriteTimeout(time.Duration(nv.WriteTimeout)*time.Millisecond))
-						if err != nil {
-							mylog.Error(ctx, gopkg.LogRedis, "[redis init] "+err.Error())
-							return nil, err
-						}
-						return con, nil
-					},
-				},
-			}
+			redisCollections[v.Name] = newPool(v)
 		}
 	})
 }
 
+// newPool
+// @Description: 按部署模式创建连接池，集群模式配置了非0的database时panic
+// @param v
+// @return *Pool
+func newPool(v Config) *Pool {
+	if v.ConnectTimeout == 0 {
+		v.ConnectTimeout = 1000
+	}
+	if v.ReadTimeout == 0 {
+		v.ReadTimeout = 1000
+	}
+	if v.WriteTimeout == 0 {
+		v.WriteTimeout = 1000
+	}
+	p := &Pool{config: v}
+	switch v.Mode {
+	case ModeSentinel:
+		p.sentinel = newSentinel(v)
+		p.Pool = newNodePool(v, p.sentinel.dial)
+		p.Pool.TestOnBorrow = p.sentinel.testOnBorrow
+		go p.sentinel.watch()
+	case ModeCluster:
+		// 集群只有db 0，配置了其他db时连接节点会失败，启动时直接报错
+		if v.Database != 0 {
+			panic(fmt.Sprintf("redis实例%s: 集群模式不支持选择db，database需要为0，当前为%d", v.Name, v.Database))
+		}
+		// 集群模式的连接由各节点的连接池提供，这里的连接池只用于兼容直接使用Pool.Pool的代码，连接到第一个种子节点
+		p.cluster = newCluster(v)
+		p.Pool = newNodePool(v, func(ctx context.Context) (redis.Conn, error) {
+			return dialNode(ctx, v, p.cluster.seedAddr())
+		})
+	default:
+		p.Pool = newNodePool(v, func(ctx context.Context) (redis.Conn, error) {
+			return dialNode(ctx, v, fmt.Sprintf("%s:%d", v.Host, v.Port))
+		})
+	}
+	return p
+}
+
+// newNodePool 按配置创建一个节点的连接池
+func newNodePool(v Config, dial func(ctx context.Context) (redis.Conn, error)) *redis.Pool {
+	return &redis.Pool{
+		MaxIdle:     v.MaxIdle,                                       //最大空闲连接数
+		MaxActive:   v.MaxActive,                                     //最大连接数
+		IdleTimeout: time.Duration(v.IdleTimeout) * time.Millisecond, //空闲连接超时时间
+		Wait:        true,
+		DialContext: dial,
+	}
+}
+
+// dialNode 连接一个数据节点
+func dialNode(ctx context.Context, v Config, addr string) (redis.Conn, error) {
+	con, err := redis.DialContext(ctx, "tcp", addr,
+		redis.DialPassword(v.Password),
+		redis.DialDatabase(v.Database),
+		redis.DialConnectTimeout(time.Duration(v.ConnectTimeout)*time.Millisecond),
+		redis.DialReadTimeout(time.Duration(v.ReadTimeout)*time.Millisecond),
+		redis.DialWriteTimeout(time.Duration(v.WriteTimeout)*time.Millisecond))
+	if err != nil {
+		mylog.Error(ctx, gopkg.LogRedis, "[redis init] "+err.Error())
+		return nil, err
+	}
+	return con, nil
+}
+
+// GetContext
+// @Description: 获取一个连接，集群模式返回按key路由到对应节点的连接；ctx来自Pipeline.Context时返回把命令加入pipeline的连接
+// @receiver p
+// @param ctx
+// @return redis.Conn
+// @return error
+func (p *Pool) GetContext(ctx context.Context) (redis.Conn, error) {
+	if pl, ok := ctx.Value(pipelineCtxKey{}).(*Pipeline); ok {
+		return pl.conn(p), nil
+	}
+	if p.cluster != nil {
+		return p.cluster.conn(), nil
+	}
+	return p.Pool.GetContext(ctx)
+}
+
+// Get
+// @Description: 获取一个连接，集群模式返回按key路由到对应节点的连接
+// @receiver p
+// @return redis.Conn
+func (p *Pool) Get() redis.Conn {
+	c, _ := p.GetContext(context.Background())
+	return c
+}
+
+// Close
+// @Description: 关闭连接池，哨兵模式同时停止监听主从切换，集群模式同时关闭所有节点的连接池
+// @receiver p
+// @return error
+func (p *Pool) Close() error {
+	if p.sentinel != nil {
+		p.sentinel.close()
+	}
+	if p.cluster != nil {
+		p.cluster.close()
+	}
+	return p.Pool.Close()
+}
+
 // getPoolInstance
 //
 //	@Description: 获取一个连接池对象
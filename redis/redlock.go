@@ -0,0 +1,218 @@
+package redis
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrRedLockNoInstance 没有可用于RedLock的实例
+	ErrRedLockNoInstance = errors.New("redis: no instance for redlock")
+	// ErrRedLockInvalidRetryInterval RedLockWait的重试间隔小于0
+	ErrRedLockInvalidRetryInterval = errors.New("redis: invalid redlock retry interval")
+	// RedLockInstanceTimeout 单个实例加锁的超时时间，远小于锁的过期时间，避免在故障实例上等待
+	RedLockInstanceTimeout = 100 * time.Millisecond
+	// RedLockClockDriftFactor 时钟漂移系数，有效时间扣除 过期时间*系数+2ms
+	RedLockClockDriftFactor = 0.01
+)
+
+// RedLock
+// @Description: 在多个独立的redis实例上加锁，超过半数实例加锁成功且仍在有效期内才算成功，失败时释放已加的锁；
+// 每个实例最多等待RedLockInstanceTimeout，超时未返回的实例按失败计算，之后才加锁成功的由其协程自行释放
+// @param ctx context.Context
+// @param key
+// @param value 锁的内容，需要唯一，解锁时比较一致才解锁
+// @param expire 秒级
+// @param instances 实例名称，为空时使用所有已初始化的实例
+// @return locked
+// @return validity 锁的剩余有效时间，扣除了加锁耗时和时钟漂移，业务需要在这之内完成
+// @return err 未达到半数时返回实例的错误
+func RedLock(ctx context.Context, key string, value interface{}, expire int64, instances ...string) (locked bool, validity time.Duration, err error) {
+	if instances, err = redLockInstances(instances); err != nil {
+		return
+	}
+	ttl := time.Duration(expire) * time.Second
+	start := time.Now()
+	var (
+		mu sync.Mutex
+		// finished 已统计结果，之后返回的实例不再计入
+		finished bool
+		// released 加锁失败已释放，之后才加锁成功的实例需要自行释放
+		released bool
+		results  = make(chan redLockResult, len(instances))
+	)
+	for _, name := range instances {
+		name := name
+		go func() {
+			ictx, cancel := context.WithTimeout(SwitchRedisByCtx(ctx, name), RedLockInstanceTimeout)
+			defer cancel()
+			ok, _, lErr := Lock(ictx, key, value, expire)
+			mu.Lock()
+			if !finished {
+				results <- redLockResult{name: name, ok: ok, err: lErr}
+				mu.Unlock()
+				return
+			}
+			release := released
+			mu.Unlock()
+			if ok && release {
+				UnLock(SwitchRedisByCtx(valueOnlyContext{ctx}, name), key, value)
+			}
+		}()
+	}
+
+	var (
+		n       int
+		errs    []error
+		replied = make(map[string]bool, len(instances))
+		timer   = time.NewTimer(RedLockInstanceTimeout)
+	)
+	collect := func(r redLockResult) {
+		replied[r.name] = true
+		if r.ok {
+			n++
+		} else if r.err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", r.name, r.err))
+		}
+	}
+wait:
+	for len(replied) < len(instances) {
+		select {
+		case r := <-results:
+			collect(r)
+		case <-timer.C:
+			break wait
+		}
+	}
+	timer.Stop()
+	mu.Lock()
+	finished = true
+	// 标记结束前已经返回的结果
+	for len(results) > 0 {
+		collect(<-results)
+	}
+	for _, name := range instances {
+		if !replied[name] {
+			errs = append(errs, fmt.Errorf("%s: %w", name, context.DeadlineExceeded))
+		}
+	}
+
+	drift := time.Duration(float64(ttl)*RedLockClockDriftFactor) + 2*time.Millisecond
+	validity = ttl - time.Since(start) - drift
+	if n >= len(instances)/2+1 && validity > 0 {
+		mu.Unlock()
+		return true, validity, nil
+	}
+	released = true
+	mu.Unlock()
+	// 未达到半数或已过期，释放所有实例，包括加锁请求超时但实际已成功的实例
+	RedUnLock(valueOnlyContext{ctx}, key, value, instances...)
+	return false, 0, errors.Join(errs...)
+}
+
+// RedLockWait
+// @Description: RedLock失败后随机等待一段时间重试，直到加锁成功或ctx结束
+// @param ctx context.Context
+// @param key
+// @param value
+// @param expire 秒级
+// @param retryInterval 重试间隔，会加上随机抖动避免多个客户端同时重试；小于0时返回ErrRedLockInvalidRetryInterval
+// @param instances
+// @return locked
+// @return validity
+// @return err ctx结束时返回ctx.Err()
+func RedLockWait(ctx context.Context, key string, value interface{}, expire int64, retryInterval time.Duration, instances ...string) (locked bool, validity time.Duration, err error) {
+	if retryInterval < 0 {
+		return false, 0, ErrRedLockInvalidRetryInterval
+	}
+	for {
+		if locked, validity, err = RedLock(ctx, key, value, expire, instances...); locked {
+			return
+		}
+		if errors.Is(err, ErrRedLockNoInstance) {
+			return
+		}
+		timer := time.NewTimer(retryInterval + time.Duration(rand.Int63n(int64(retryInterval)+1)))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return false, 0, ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// RedUnLock
+// @Description: 在所有实例上解锁，锁的内容一致才解锁；每个实例最多等待RedLockInstanceTimeout
+// @param ctx context.Context
+// @param key
+// @param value 加锁时的内容
+// @param instances 与加锁时相同
+// @return err 各实例的错误，超时的实例返回context.DeadlineExceeded
+func RedUnLock(ctx context.Context, key string, value interface{}, instances ...string) (err error) {
+	if instances, err = redLockInstances(instances); err != nil {
+		return
+	}
+	results := make(chan redLockResult, len(instances))
+	for _, name := range instances {
+		name := name
+		go func() {
+			ictx, cancel := context.WithTimeout(SwitchRedisByCtx(ctx, name), RedLockInstanceTimeout)
+			defer cancel()
+			results <- redLockResult{name: name, err: UnLock(ictx, key, value)}
+		}()
+	}
+	var (
+		errs    []error
+		replied = make(map[string]bool, len(instances))
+		timer   = time.NewTimer(RedLockInstanceTimeout)
+	)
+	defer timer.Stop()
+wait:
+	for len(replied) < len(instances) {
+		select {
+		case r := <-results:
+			replied[r.name] = true
+			if r.err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", r.name, r.err))
+			}
+		case <-timer.C:
+			break wait
+		}
+	}
+	for _, name := range instances {
+		if !replied[name] {
+			errs = append(errs, fmt.Errorf("%s: %w", name, context.DeadlineExceeded))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// redLockResult 单个实例的加锁、解锁结果
+type redLockResult struct {
+	name string
+	ok   bool
+	err  error
+}
+
+// redLockInstances 检查实例名称，为空时使用所有实例
+func redLockInstances(instances []string) ([]string, error) {
+	if len(instances) == 0 {
+		for name := range redisCollections {
+			instances = append(instances, name)
+		}
+	}
+	if len(instances) == 0 {
+		return nil, ErrRedLockNoInstance
+	}
+	for _, name := range instances {
+		if _, ok := redisCollections[name]; !ok {
+			return nil, fmt.Errorf("%w: %s", ErrRedLockNoInstance, name)
+		}
+	}
+	return instances, nil
+}
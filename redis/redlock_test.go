@@ -0,0 +1,108 @@
+package redis
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestRedLock(t *testing.T) {
+	// 同一个redis的不同库模拟三个独立实例
+	instances := []string{"redlock_1", "redlock_2", "redlock_3"}
+	for i, name := range instances {
+		p := newPool(Config{Name: name, Host: "127.0.0.1", Port: 6379, MaxIdle: 2, MaxActive: 10, IdleTimeout: 200, Database: i + 1})
+		redisCollections[name] = p
+		defer func(name string, p *Pool) {
+			delete(redisCollections, name)
+			p.Close()
+		}(name, p)
+	}
+	ctx := context.Background()
+	key := "redlock:" + strconv.FormatInt(time.Now().UnixNano(), 10)
+
+	locked, validity, err := RedLock(ctx, key, "a", 10, instances...)
+	if err != nil || !locked {
+		t.Fatalf("加锁失败: %v %v", locked, err)
+	}
+	if validity <= 0 || validity > 10*time.Second {
+		t.Errorf("剩余有效时间错误: %v", validity)
+	}
+	if locked, _, _ = RedLock(ctx, key, "b", 10, instances...); locked {
+		t.Fatal("锁已被持有，应该失败")
+	}
+	if err = RedUnLock(ctx, key, "a", instances...); err != nil {
+		t.Fatal(err)
+	}
+
+	// 一个实例被占用，仍然达到半数
+	Set(SwitchRedisByCtx(ctx, instances[0]), key, "other", 10)
+	if locked, _, err = RedLock(ctx, key, "a", 10, instances...); err != nil || !locked {
+		t.Fatalf("达到半数应该成功: %v %v", locked, err)
+	}
+	RedUnLock(ctx, key, "a", instances...)
+	if v, _ := Get(SwitchRedisByCtx(ctx, instances[0]), key).String(); v != "other" {
+		t.Errorf("解锁不应删除其他持有者的锁: %s", v)
+	}
+
+	// 两个实例被占用，失败并释放已加的锁
+	Set(SwitchRedisByCtx(ctx, instances[1]), key, "other", 10)
+	if locked, _, _ = RedLock(ctx, key, "a", 10, instances...); locked {
+		t.Fatal("未达到半数应该失败")
+	}
+	if n, _ := Exists(SwitchRedisByCtx(ctx, instances[2]), key).Int(); n != 0 {
+		t.Error("失败后应释放已加的锁")
+	}
+
+	wctx, cancel := context.WithTimeout(ctx, 200*time.Millisecond)
+	defer cancel()
+	if _, _, err = RedLockWait(wctx, key, "a", 10, 50*time.Millisecond, instances...); err != context.DeadlineExceeded {
+		t.Errorf("应该等待超时: %v", err)
+	}
+	for _, name := range instances {
+		Del(SwitchRedisByCtx(ctx, name), key)
+	}
+	if locked, _, err = RedLockWait(wctx, key, "a", 10, 50*time.Millisecond, "not_exists"); err == nil || locked {
+		t.Error("不存在的实例应该返回错误")
+	}
+	if _, _, err = RedLockWait(ctx, key, "a", 10, -time.Millisecond, instances...); err != ErrRedLockInvalidRetryInterval {
+		t.Errorf("重试间隔小于0应该返回ErrRedLockInvalidRetryInterval: %v", err)
+	}
+
+	// 不响应的实例不影响其他实例，按超时计算
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	addr := ln.Addr().(*net.TCPAddr)
+	hung := newPool(Config{Name: "redlock_hung", Host: "127.0.0.1", Port: addr.Port, MaxIdle: 1, ReadTimeout: 10000})
+	redisCollections["redlock_hung"] = hung
+	defer func() {
+		delete(redisCollections, "redlock_hung")
+		hung.Close()
+	}()
+	start := time.Now()
+	locked, _, err = RedLock(ctx, key, "a", 10, instances[1], instances[2], "redlock_hung")
+	if !locked || err != nil {
+		t.Errorf("不响应的实例之外达到半数应该成功: %v %v", locked, err)
+	}
+	if d := time.Since(start); d > 3*RedLockInstanceTimeout {
+		t.Errorf("不响应的实例应该在RedLockInstanceTimeout后放弃，耗时%s", d)
+	}
+	start = time.Now()
+	RedUnLock(ctx, key, "a", instances[1], instances[2], "redlock_hung")
+	if d := time.Since(start); d > 3*RedLockInstanceTimeout {
+		t.Errorf("解锁不应该等待不响应的实例，耗时%s", d)
+	}
+}
@@ -14,6 +14,10 @@ type Reply struct {
 var ErrNil = redis.ErrNil
 
 func getReply(rp interface{}, err error) *Reply {
+	// 加入pipeline的命令返回pipeline中的结果，Exec之后才有值
+	if q, ok := rp.(queuedReply); ok && err == nil {
+		return q.reply
+	}
 	return &Reply{reply: rp, error: err}
 }
 
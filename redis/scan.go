@@ -0,0 +1,252 @@
+package redis
+
+import (
+	"context"
+	"errors"
+	"github.com/gomodule/redigo/redis"
+	"strconv"
+)
+
+var (
+	// ErrScanStop 回调返回该错误时提前结束遍历，Scan等方法返回nil
+	ErrScanStop = errors.New("redis: scan stop")
+	// ErrScanDeleteNoMatch ScanDelete必须指定Match，避免误删整个库
+	ErrScanDeleteNoMatch = errors.New("redis: scan delete without match")
+)
+
+// ScanOption 遍历配置
+type ScanOption struct {
+	// Match 匹配的模式，如 user:*
+	Match string
+	// Count 每次遍历的数量提示，redis不保证每批返回的数量
+	Count int64
+	// Type 只返回该类型的key，如 string、hash，只用于Scan，需要redis 6.0以上
+	Type string
+}
+
+// SetScanOptionFunc 设置遍历配置的方法
+type SetScanOptionFunc func(option ScanOption) ScanOption
+
+func newScanOption(optionFuncs []SetScanOptionFunc) ScanOption {
+	option := ScanOption{}
+	for _, optionFunc := range optionFuncs {
+		option = optionFunc(option)
+	}
+	return option
+}
+
+// Scan
+// @Description: 使用SCAN遍历key，不会像Keys一样阻塞redis；集群模式下依次遍历每个master；
+// 遍历期间新增或删除的key可能返回也可能不返回，同一个key可能返回多次
+// @param ctx ctx结束时停止遍历并返回ctx.Err()
+// @param cb 每批key回调一次，返回错误时停止遍历
+// @param optionFuncs
+// @return error
+func Scan(ctx context.Context, cb func(keys []string) error, optionFuncs ...SetScanOptionFunc) error {
+	option := newScanOption(optionFuncs)
+	p := getPoolInstance(ctx)
+	if p.cluster == nil {
+		c, _ := p.GetContext(ctx)
+		defer c.Close()
+		return stopScan(scanCursor(ctx, c, "scan", nil, option, cb))
+	}
+	masters, err := p.cluster.masterAddrs(ctx)
+	if err != nil {
+		return err
+	}
+	for _, addr := range masters {
+		c, _ := p.cluster.nodePool(addr).GetContext(ctx)
+		err = scanCursor(ctx, c, "scan", nil, option, cb)
+		c.Close()
+		if err != nil {
+			return stopScan(err)
+		}
+	}
+	return nil
+}
+
+// HScan
+// @Description: 使用HSCAN遍历hash的域和值
+// @param ctx
+// @param key
+// @param cb 每批回调一次，返回错误时停止遍历
+// @param optionFuncs Type不生效
+// @return error
+func HScan(ctx context.Context, key string, cb func(fields map[string]string) error, optionFuncs ...SetScanOptionFunc) error {
+	return scanKey(ctx, "hscan", key, newScanOption(optionFuncs), func(items []string) error {
+		fields := make(map[string]string, len(items)/2)
+		for i := 0; i+1 < len(items); i += 2 {
+			fields[items[i]] = items[i+1]
+		}
+		return cb(fields)
+	})
+}
+
+// SScan
+// @Description: 使用SSCAN遍历集合的成员
+// @param ctx
+// @param key
+// @param cb 每批回调一次，返回错误时停止遍历
+// @param optionFuncs Type不生效
+// @return error
+func SScan(ctx context.Context, key string, cb func(members []string) error, optionFuncs ...SetScanOptionFunc) error {
+	return scanKey(ctx, "sscan", key, newScanOption(optionFuncs), cb)
+}
+
+// ZScan
+// @Description: 使用ZSCAN遍历有序集合的成员和分数，Member为string
+// @param ctx
+// @param key
+// @param cb 每批回调一次，返回错误时停止遍历
+// @param optionFuncs Type不生效
+// @return error
+func ZScan(ctx context.Context, key string, cb func(members []Z) error, optionFuncs ...SetScanOptionFunc) error {
+	return scanKey(ctx, "zscan", key, newScanOption(optionFuncs), func(items []string) error {
+		members := make([]Z, 0, len(items)/2)
+		for i := 0; i+1 < len(items); i += 2 {
+			score, err := strconv.ParseFloat(items[i+1], 64)
+			if err != nil {
+				return err
+			}
+			members = append(members, Z{Member: items[i], Score: score})
+		}
+		return cb(members)
+	})
+}
+
+// ScanChan
+// @Description: 与Scan相同，通过channel返回每批key
+// @param ctx 不再读取时取消ctx，否则遍历协程会阻塞
+// @param optionFuncs
+// @return <-chan []string 遍历结束后关闭
+// @return <-chan error batches关闭后返回遍历的结果，nil表示遍历完成
+func ScanChan(ctx context.Context, optionFuncs ...SetScanOptionFunc) (<-chan []string, <-chan error) {
+	return scanChan(ctx, func(cb func([]string) error) error {
+		return Scan(ctx, cb, optionFuncs...)
+	})
+}
+
+// HScanChan 与HScan相同，通过channel返回每批域和值
+func HScanChan(ctx context.Context, key string, optionFuncs ...SetScanOptionFunc) (<-chan map[string]string, <-chan error) {
+	return scanChan(ctx, func(cb func(map[string]string) error) error {
+		return HScan(ctx, key, cb, optionFuncs...)
+	})
+}
+
+// SScanChan 与SScan相同，通过channel返回每批成员
+func SScanChan(ctx context.Context, key string, optionFuncs ...SetScanOptionFunc) (<-chan []string, <-chan error) {
+	return scanChan(ctx, func(cb func([]string) error) error {
+		return SScan(ctx, key, cb, optionFuncs...)
+	})
+}
+
+// ZScanChan 与ZScan相同，通过channel返回每批成员和分数
+func ZScanChan(ctx context.Context, key string, optionFuncs ...SetScanOptionFunc) (<-chan []Z, <-chan error) {
+	return scanChan(ctx, func(cb func([]Z) error) error {
+		return ZScan(ctx, key, cb, optionFuncs...)
+	})
+}
+
+// ScanDelete
+// @Description: 遍历匹配的key，每批在pipeline中用UNLINK异步删除，用于替代一次性的清理脚本
+// @param ctx
+// @param optionFuncs 必须指定Match，Count为每批删除的数量提示
+// @return deleted 删除的key数量
+// @return err
+func ScanDelete(ctx context.Context, optionFuncs ...SetScanOptionFunc) (deleted int64, err error) {
+	if newScanOption(optionFuncs).Match == "" {
+		return 0, ErrScanDeleteNoMatch
+	}
+	err = Scan(ctx, func(keys []string) error {
+		// 每个key单独UNLINK，集群模式下不同slot的key不能在一个命令中删除
+		replies, pErr := Pipelined(ctx, func(ctx context.Context) {
+			for _, key := range keys {
+				Unlink(ctx, key)
+			}
+		})
+		for _, r := range replies {
+			n, _ := r.Int64()
+			deleted += n
+		}
+		return pErr
+	}, optionFuncs...)
+	return
+}
+
+// scanKey 遍历单个key的HSCAN、SSCAN、ZSCAN
+func scanKey(ctx context.Context, cmd, key string, option ScanOption, cb func(items []string) error) error {
+	option.Type = ""
+	c, _ := getPoolInstance(ctx).GetContext(ctx)
+	defer c.Close()
+	return stopScan(scanCursor(ctx, c, cmd, []interface{}{key}, option, cb))
+}
+
+// scanCursor 从游标0开始遍历，直到redis返回游标0
+func scanCursor(ctx context.Context, c redis.Conn, cmd string, prefix []interface{}, option ScanOption, cb func(items []string) error) error {
+	cursor := "0"
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		args := redis.Args(prefix).Add(cursor)
+		if option.Match != "" {
+			args = args.Add("match", option.Match)
+		}
+		if option.Count > 0 {
+			args = args.Add("count", option.Count)
+		}
+		if option.Type != "" {
+			args = args.Add("type", option.Type)
+		}
+		// [下一个游标, [元素...]]
+		values, err := redis.Values(redis.DoContext(c, ctx, cmd, args...))
+		if err != nil {
+			return err
+		}
+		if len(values) != 2 {
+			return ErrNil
+		}
+		if cursor, err = redis.String(values[0], nil); err != nil {
+			return err
+		}
+		items, err := redis.Strings(values[1], nil)
+		if err != nil {
+			return err
+		}
+		if len(items) > 0 {
+			if err = cb(items); err != nil {
+				return err
+			}
+		}
+		if cursor == "0" {
+			return nil
+		}
+	}
+}
+
+func stopScan(err error) error {
+	if err == ErrScanStop {
+		return nil
+	}
+	return err
+}
+
+// scanChan 在协程中遍历，把每批结果发送到channel
+func scanChan[T any](ctx context.Context, scan func(cb func(T) error) error) (<-chan T, <-chan error) {
+	batches := make(chan T)
+	errc := make(chan error, 1)
+	go func() {
+		defer close(errc)
+		err := scan(func(batch T) error {
+			select {
+			case batches <- batch:
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		})
+		close(batches)
+		errc <- err
+	}()
+	return batches, errc
+}
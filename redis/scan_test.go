@@ -0,0 +1,118 @@
+package redis
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestScan(t *testing.T) {
+	ctx := context.Background()
+	prefix := "test_scan:" + strconv.FormatInt(time.Now().UnixNano(), 10) + ":"
+	for i := 0; i < 25; i++ {
+		Set(ctx, prefix+strconv.Itoa(i), i, 60)
+	}
+	hashKey := prefix + "hash"
+	for i := 0; i < 5; i++ {
+		HSet(ctx, hashKey, "f"+strconv.Itoa(i), i)
+		SAdd(ctx, prefix+"set", "m"+strconv.Itoa(i))
+		ZAdd(ctx, prefix+"zset", Z{Score: float64(i), Member: "m" + strconv.Itoa(i)})
+	}
+	defer Del(ctx, hashKey, prefix+"set", prefix+"zset")
+
+	match := func(option ScanOption) ScanOption {
+		option.Match = prefix + "*"
+		option.Count = 10
+		return option
+	}
+	seen := make(map[string]bool)
+	if err := Scan(ctx, func(keys []string) error {
+		for _, key := range keys {
+			seen[key] = true
+		}
+		return nil
+	}, match); err != nil {
+		t.Fatal(err)
+	}
+	if len(seen) != 28 {
+		t.Errorf("应该遍历到28个key，实际%d", len(seen))
+	}
+
+	var hashKeys []string
+	Scan(ctx, func(keys []string) error {
+		hashKeys = append(hashKeys, keys...)
+		return nil
+	}, match, func(option ScanOption) ScanOption {
+		option.Type = "hash"
+		return option
+	})
+	if len(hashKeys) != 1 || hashKeys[0] != hashKey {
+		t.Errorf("按类型遍历错误: %v", hashKeys)
+	}
+
+	// 提前结束
+	batches := 0
+	if err := Scan(ctx, func(keys []string) error {
+		batches++
+		return ErrScanStop
+	}, match); err != nil || batches != 1 {
+		t.Errorf("ErrScanStop应该结束遍历并返回nil，err %v batches %d", err, batches)
+	}
+
+	fields := make(map[string]string)
+	HScan(ctx, hashKey, func(batch map[string]string) error {
+		for k, v := range batch {
+			fields[k] = v
+		}
+		return nil
+	})
+	if len(fields) != 5 || fields["f3"] != "3" {
+		t.Errorf("HScan结果错误: %v", fields)
+	}
+	var members []string
+	SScan(ctx, prefix+"set", func(batch []string) error {
+		members = append(members, batch...)
+		return nil
+	}, func(option ScanOption) ScanOption {
+		option.Match = "m[0-2]"
+		return option
+	})
+	if len(members) != 3 {
+		t.Errorf("SScan结果错误: %v", members)
+	}
+	zs, errc := ZScanChan(ctx, prefix+"zset")
+	var score float64
+	for batch := range zs {
+		for _, z := range batch {
+			score += z.Score
+		}
+	}
+	if err := <-errc; err != nil || score != 10 {
+		t.Errorf("ZScanChan结果错误，score %v err %v", score, err)
+	}
+
+	// ctx已取消时停止
+	cctx, cancel := context.WithCancel(ctx)
+	cancel()
+	keys, errc := ScanChan(cctx, match)
+	for range keys {
+	}
+	if err := <-errc; err != context.Canceled {
+		t.Errorf("取消ctx应该返回context.Canceled，实际%v", err)
+	}
+
+	if _, err := ScanDelete(ctx); err != ErrScanDeleteNoMatch {
+		t.Errorf("没有Match应该返回ErrScanDeleteNoMatch，实际%v", err)
+	}
+	deleted, err := ScanDelete(ctx, func(option ScanOption) ScanOption {
+		option.Match = prefix + "[0-9]*"
+		return option
+	})
+	if err != nil || deleted != 25 {
+		t.Errorf("应该删除25个key，实际%d err %v", deleted, err)
+	}
+	if n, _ := Exists(ctx, prefix+"0").Int(); n != 0 {
+		t.Error("key应该已被删除")
+	}
+}
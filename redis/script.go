@@ -62,6 +62,79 @@ const (
 	* @eg: EvalScript(ScriptKeyValueEqualsUnlock, "key", "lock value")
 	 */
 	ScriptKeyValueEqualsUnlock = "valueEqualsUnlock"
+
+	/*
+	* 令牌桶，按redis服务器的毫秒时间补充令牌，令牌足够才扣减
+	* @eg: EvalScript(ScriptKeyTokenBucket, "key", 每秒生成令牌数, 桶容量, 本次需要的令牌数)
+	* @return int64 是否获取成功(0,1), int64 剩余令牌数, int64 令牌不足时需要等待的毫秒数
+	 */
+	ScriptKeyTokenBucket = "token_bucket"
+	/*
+	* 多key令牌桶，所有key的令牌都足够才同时扣减，与ScriptKeyTokenBucket的存储结构相同，使用redis服务器的时间
+	* @eg: EvalScript(ScriptKeyTokenBucketMulti, key数量, "key1", "key2", 本次需要的令牌数, key1每秒生成令牌数, key1桶容量, key2每秒生成令牌数, key2桶容量)
+	* @return int64 是否获取成功(0,1), int64 各key剩余令牌数的最小值, int64 令牌不足时需要等待的毫秒数
+	 */
+	ScriptKeyTokenBucketMulti = "token_bucket_multi"
+	/*
+	* 多key滑动窗口日志，zset记录窗口内每次请求的时间，所有key都没有超过限制才记录，使用redis服务器的时间
+	* @eg: EvalScript(ScriptKeySlidingWindowLog, key数量, "key1", "key2", 本次请求数, 唯一id, key1窗口内限制数, key1窗口毫秒数, key2窗口内限制数, key2窗口毫秒数)
+	* @return int64 是否允许(0,1), int64 各key剩余次数的最小值, int64 不允许时需要等待的毫秒数
+	 */
+	ScriptKeySlidingWindowLog = "sliding_window_log"
+	/*
+	* 多key滑动窗口计数器，按上一个固定窗口的计数加权估算滑动窗口内的请求数，所有key都没有超过限制才计数，使用redis服务器的时间
+	* @eg: EvalScript(ScriptKeySlidingWindowCounter, key数量, "key1", "key2", 本次请求数, key1窗口内限制数, key1窗口毫秒数, key2窗口内限制数, key2窗口毫秒数)
+	* @return int64 是否允许(0,1), int64 各key剩余次数的最小值, int64 不允许时需要等待的毫秒数(估算)
+	 */
+	ScriptKeySlidingWindowCounter = "sliding_window_counter"
+	/*
+	* 多key GCRA(通用信元速率算法)，只存储理论到达时间，所有key都允许才更新，使用redis服务器的时间
+	* @eg: EvalScript(ScriptKeyGCRA, key数量, "key1", "key2", 本次请求数, key1每次请求的间隔毫秒数, key1突发数量, key2每次请求的间隔毫秒数, key2突发数量)
+	* @return int64 是否允许(0,1), int64 各key剩余突发数量的最小值, int64 不允许时需要等待的毫秒数
+	 */
+	ScriptKeyGCRA = "gcra"
+	/*
+	* 可重入锁加锁，没有持有者时生成递增的fencing token，持有者相同时重入次数加一
+	* @eg: EvalScript(ScriptKeyMutexLock, "key", "fence key", 持有者token, 过期毫秒数)
+	* @return int64 是否加锁成功(0,1), int64 fencing token, int64 加锁失败时锁的剩余毫秒数
+	 */
+	ScriptKeyMutexLock = "mutex_lock"
+	/*
+	* 可重入锁解锁，持有者相同时重入次数减一，减到0时删除
+	* @eg: EvalScript(ScriptKeyMutexUnlock, "key", 持有者token)
+	* @return int64 剩余重入次数，-1表示不是持有者
+	 */
+	ScriptKeyMutexUnlock = "mutex_unlock"
+	/*
+	* 可重入锁续期，持有者相同才续期
+	* @eg: EvalScript(ScriptKeyMutexRenew, "key", 持有者token, 过期毫秒数)
+	* @return int64 是否续期成功(0,1)
+	 */
+	ScriptKeyMutexRenew = "mutex_renew"
+	/*
+	* 延迟队列添加任务，保存内容并按执行时间加入等待集合；任务在处理中时不添加，在死信集合中时移出并重置领取次数
+	* @eg: EvalScript(ScriptKeyDelayQueuePush, "等待集合key", "内容hash key", "处理中集合key", "死信集合key", "次数hash key", 任务id, 执行毫秒时间戳, 内容)
+	* @return int64 任务是否为新增(0,1)，-1表示任务在处理中
+	 */
+	ScriptKeyDelayQueuePush = "delay_queue_push"
+	/*
+	* 延迟队列领取任务，先把处理超时的任务放回等待集合(超过最大次数的放入死信集合)，再把到期的任务移入处理中集合、增加领取次数并记录领取凭证；使用redis服务器时间
+	* @eg: EvalScript(ScriptKeyDelayQueueClaim, "等待集合key", "处理中集合key", "次数hash key", "内容hash key", "死信集合key", "领取凭证hash key", 最多领取数量, 处理超时毫秒数, 最大领取次数, 领取凭证)
+	* @return array [任务id, 内容, 领取次数, ...]
+	 */
+	ScriptKeyDelayQueueClaim = "delay_queue_claim"
+	/*
+	* 延迟队列确认任务，领取凭证一致时从处理中集合移除并删除内容
+	* @eg: EvalScript(ScriptKeyDelayQueueAck, "处理中集合key", "次数hash key", "内容hash key", "领取凭证hash key", 任务id, 领取凭证)
+	* @return int64 是否确认成功(0,1)，0表示任务已超时被放回等待集合或已被重新领取
+	 */
+	ScriptKeyDelayQueueAck = "delay_queue_ack"
+	/*
+	* 延迟队列重试任务，领取凭证一致时从处理中集合放回等待集合，达到最大领取次数时放入死信集合；使用redis服务器时间
+	* @eg: EvalScript(ScriptKeyDelayQueueRetry, "处理中集合key", "等待集合key", "次数hash key", "死信集合key", "领取凭证hash key", 任务id, 延迟毫秒数, 最大领取次数, 领取凭证)
+	* @return int64 0已放回等待集合, 1已放入死信集合, -1任务不在处理中或已被重新领取
+	 */
+	ScriptKeyDelayQueueRetry = "delay_queue_retry"
 )
 
 var (
@@ -171,6 +244,308 @@ else
 	return 0 
 end`,
 		},
+		// 令牌桶 eg: EvalScript('token_bucket', 'key', rate, burst, requested)
+		ScriptKeyTokenBucket: {
+			keyCount: 1,
+			script: `
+redis.replicate_commands(); 
+local rate, burst, requested = tonumber(ARGV[1]), tonumber(ARGV[2]), tonumber(ARGV[3]); 
+local t = redis.call('time'); 
+local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000); 
+local data = redis.call('hmget', KEYS[1], 'tokens', 'ts'); 
+local tokens, ts = tonumber(data[1]), tonumber(data[2]); 
+if tokens == nil then 
+	tokens, ts = burst, now; 
+end; 
+tokens = math.min(burst, tokens + math.max(0, now - ts) * rate / 1000); 
+local allowed, wait = 0, 0; 
+if tokens >= requested then 
+	tokens = tokens - requested; 
+	allowed = 1; 
+else 
+	wait = math.ceil((requested - tokens) * 1000 / rate); 
+end; 
+redis.call('hset', KEYS[1], 'tokens', tokens, 'ts', math.max(now, ts)); 
+redis.call('pexpire', KEYS[1], math.ceil(burst * 1000 / rate) + 1000); 
+return {allowed, math.floor(tokens), wait};`,
+		},
+		// 多key令牌桶 eg: EvalScript('token_bucket_multi', 2, 'key1', 'key2', requested, rate1, burst1, rate2, burst2)
+		ScriptKeyTokenBucketMulti: {
+			keyCount: -1, // key数量由调用方传入
+			script: `
+redis.replicate_commands();
+local t = redis.call('time');
+local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000);
+local requested = tonumber(ARGV[1]);
+local allowed, wait, free, states = 1, 0, nil, {};
+for i, key in ipairs(KEYS) do
+	local rate, burst = tonumber(ARGV[i*2]), tonumber(ARGV[i*2+1]);
+	local data = redis.call('hmget', key, 'tokens', 'ts');
+	local tokens, ts = tonumber(data[1]), tonumber(data[2]);
+	if tokens == nil then
+		tokens, ts = burst, now;
+	end;
+	tokens = math.min(burst, tokens + math.max(0, now - ts) * rate / 1000);
+	if tokens < requested then
+		allowed = 0;
+		wait = math.max(wait, math.ceil((requested - tokens) * 1000 / rate));
+	end;
+	if free == nil or tokens < free then
+		free = tokens;
+	end;
+	states[i] = {tokens, math.max(now, ts), math.ceil(burst * 1000 / rate) + 1000};
+end;
+if allowed == 0 then
+	return {0, math.floor(free), wait};
+end;
+for i, key in ipairs(KEYS) do
+	redis.call('hset', key, 'tokens', states[i][1] - requested, 'ts', states[i][2]);
+	redis.call('pexpire', key, states[i][3]);
+end;
+return {1, math.floor(free - requested), 0};`,
+		},
+		// 多key滑动窗口日志 eg: EvalScript('sliding_window_log', 2, 'key1', 'key2', requested, unique_id, limit1, period_ms1, limit2, period_ms2)
+		ScriptKeySlidingWindowLog: {
+			keyCount: -1,
+			script: `
+redis.replicate_commands();
+local t = redis.call('time');
+local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000);
+local requested, id = tonumber(ARGV[1]), ARGV[2];
+local allowed, wait, free = 1, 0, nil;
+for i, key in ipairs(KEYS) do
+	local limit, period = tonumber(ARGV[i*2+1]), tonumber(ARGV[i*2+2]);
+	redis.call('zremrangebyscore', key, '-inf', now - period);
+	local count = redis.call('zcard', key);
+	local left = limit - count;
+	if left < requested then
+		allowed = 0;
+		-- 第requested-left个最早的记录过期后才有足够的配额，限制在已有记录的范围内(降低了limit时left为负数)
+		local index = math.max(0, math.min(requested - left - 1, count - 1));
+		local oldest = redis.call('zrange', key, index, index, 'withscores');
+		if oldest[2] then
+			wait = math.max(wait, math.ceil(tonumber(oldest[2]) + period - now));
+		else
+			wait = math.max(wait, period);
+		end;
+	end;
+	if free == nil or left < free then
+		free = left;
+	end;
+end;
+if allowed == 0 then
+	return {0, math.max(0, free), wait};
+end;
+local members = {};
+for j = 1, requested do
+	members[j*2-1] = now;
+	members[j*2] = id .. ':' .. j;
+end;
+for i, key in ipairs(KEYS) do
+	redis.call('zadd', key, unpack(members));
+	redis.call('pexpire', key, ARGV[i*2+2]);
+end;
+return {1, free - requested, 0};`,
+		},
+		// 多key滑动窗口计数器 eg: EvalScript('sliding_window_counter', 2, 'key1', 'key2', requested, limit1, period_ms1, limit2, period_ms2)
+		ScriptKeySlidingWindowCounter: {
+			keyCount: -1,
+			script: `
+redis.replicate_commands();
+local t = redis.call('time');
+local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000);
+local requested = tonumber(ARGV[1]);
+local allowed, wait, free, states = 1, 0, nil, {};
+for i, key in ipairs(KEYS) do
+	local limit, period = tonumber(ARGV[i*2]), tonumber(ARGV[i*2+1]);
+	local window = math.floor(now / period);
+	local elapsed = now - window * period;
+	local data = redis.call('hmget', key, 'window', 'cur', 'prev');
+	local w, cur, prev = tonumber(data[1]), tonumber(data[2]) or 0, tonumber(data[3]) or 0;
+	if w ~= window then
+		if w == window - 1 then
+			prev = cur;
+		else
+			prev = 0;
+		end;
+		cur = 0;
+	end;
+	local left = limit - cur - prev * (period - elapsed) / period;
+	if left < requested then
+		allowed = 0;
+		local need = limit - cur - requested;
+		if need >= 0 and prev > 0 then
+			wait = math.max(wait, math.ceil(period * (1 - need / prev) - elapsed));
+		else
+			wait = math.max(wait, period - elapsed);
+		end;
+	end;
+	if free == nil or left < free then
+		free = left;
+	end;
+	states[i] = {window, cur, prev, period * 2};
+end;
+if allowed == 0 then
+	return {0, math.max(0, math.floor(free)), wait};
+end;
+for i, key in ipairs(KEYS) do
+	redis.call('hset', key, 'window', states[i][1], 'cur', states[i][2] + requested, 'prev', states[i][3]);
+	redis.call('pexpire', key, states[i][4]);
+end;
+return {1, math.floor(free - requested), 0};`,
+		},
+		// 多key GCRA eg: EvalScript('gcra', 2, 'key1', 'key2', requested, interval_ms1, burst1, interval_ms2, burst2)
+		ScriptKeyGCRA: {
+			keyCount: -1,
+			script: `
+redis.replicate_commands();
+local t = redis.call('time');
+local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000);
+local requested = tonumber(ARGV[1]);
+local allowed, wait, free, states = 1, 0, nil, {};
+for i, key in ipairs(KEYS) do
+	local interval, burst = tonumber(ARGV[i*2]), tonumber(ARGV[i*2+1]);
+	local tat = math.max(tonumber(redis.call('get', key)) or now, now);
+	local left = (now - tat) / interval + burst;
+	if left < requested then
+		allowed = 0;
+		wait = math.max(wait, math.ceil((requested - left) * interval));
+	end;
+	if free == nil or left < free then
+		free = left;
+	end;
+	states[i] = tat + requested * interval;
+end;
+if allowed == 0 then
+	return {0, math.max(0, math.floor(free)), wait};
+end;
+for i, key in ipairs(KEYS) do
+	redis.call('set', key, states[i], 'px', math.ceil(states[i] - now));
+end;
+return {1, math.floor(free - requested), 0};`,
+		},
+		// 可重入锁加锁 eg: EvalScript('mutex_lock', 'key', 'fence key', owner, expire_ms)
+		ScriptKeyMutexLock: {
+			keyCount: 2,
+			script: `
+local owner = redis.call('hget', KEYS[1], 'owner'); 
+if not owner then 
+	local fence = redis.call('incr', KEYS[2]); 
+	redis.call('hset', KEYS[1], 'owner', ARGV[1], 'count', 1, 'fence', fence); 
+	redis.call('pexpire', KEYS[1], ARGV[2]); 
+	return {1, fence, 0}; 
+end; 
+if owner == ARGV[1] then 
+	redis.call('hincrby', KEYS[1], 'count', 1); 
+	redis.call('pexpire', KEYS[1], ARGV[2]); 
+	return {1, tonumber(redis.call('hget', KEYS[1], 'fence')), 0}; 
+end; 
+return {0, 0, redis.call('pttl', KEYS[1])};`,
+		},
+		// 可重入锁解锁 eg: EvalScript('mutex_unlock', 'key', owner)
+		ScriptKeyMutexUnlock: {
+			keyCount: 1,
+			script: `
+if redis.call('hget', KEYS[1], 'owner') ~= ARGV[1] then 
+	return -1; 
+end; 
+local count = redis.call('hincrby', KEYS[1], 'count', -1); 
+if count > 0 then 
+	return count; 
+end; 
+redis.call('del', KEYS[1]); 
+return 0;`,
+		},
+		// 可重入锁续期 eg: EvalScript('mutex_renew', 'key', owner, expire_ms)
+		ScriptKeyMutexRenew: {
+			keyCount: 1,
+			script: `
+if redis.call('hget', KEYS[1], 'owner') == ARGV[1] then 
+	return redis.call('pexpire', KEYS[1], ARGV[2]); 
+end; 
+return 0;`,
+		},
+		// 延迟队列添加任务 eg: EvalScript('delay_queue_push', 'delayed', 'payload', 'processing', 'dead', 'attempts', id, run_at_ms, payload)
+		ScriptKeyDelayQueuePush: {
+			keyCount: 5,
+			script: `
+if redis.call('zscore', KEYS[3], ARGV[1]) then 
+	return -1; 
+end; 
+if redis.call('zrem', KEYS[4], ARGV[1]) == 1 then 
+	redis.call('hdel', KEYS[5], ARGV[1]); 
+end; 
+local added = redis.call('hset', KEYS[2], ARGV[1], ARGV[3]); 
+redis.call('zadd', KEYS[1], ARGV[2], ARGV[1]); 
+return added;`,
+		},
+		// 延迟队列领取任务 eg: EvalScript('delay_queue_claim', 'delayed', 'processing', 'attempts', 'payload', 'dead', 'claims', count, visibility_ms, max_attempts, token)
+		ScriptKeyDelayQueueClaim: {
+			keyCount: 6,
+			script: `
+redis.replicate_commands(); 
+local t = redis.call('time'); 
+local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000); 
+local count, visibility, max = tonumber(ARGV[1]), tonumber(ARGV[2]), tonumber(ARGV[3]); 
+local expired = redis.call('zrangebyscore', KEYS[2], '-inf', now, 'limit', 0, count); 
+for _, id in ipairs(expired) do 
+	redis.call('zrem', KEYS[2], id); 
+	redis.call('hdel', KEYS[6], id); 
+	local attempts = tonumber(redis.call('hget', KEYS[3], id)) or 0; 
+	if max > 0 and attempts >= max then 
+		redis.call('zadd', KEYS[5], now, id); 
+	else 
+		redis.call('zadd', KEYS[1], now, id); 
+	end; 
+end; 
+local res = {}; 
+local ids = redis.call('zrangebyscore', KEYS[1], '-inf', now, 'limit', 0, count); 
+for _, id in ipairs(ids) do 
+	redis.call('zrem', KEYS[1], id); 
+	local payload = redis.call('hget', KEYS[4], id); 
+	if payload then 
+		redis.call('zadd', KEYS[2], now + visibility, id); 
+		redis.call('hset', KEYS[6], id, ARGV[4]); 
+		res[#res+1] = id; 
+		res[#res+1] = payload; 
+		res[#res+1] = redis.call('hincrby', KEYS[3], id, 1); 
+	else 
+		redis.call('hdel', KEYS[3], id); 
+	end; 
+end; 
+return res;`,
+		},
+		// 延迟队列确认任务 eg: EvalScript('delay_queue_ack', 'processing', 'attempts', 'payload', 'claims', id, token)
+		ScriptKeyDelayQueueAck: {
+			keyCount: 4,
+			script: `
+if redis.call('hget', KEYS[4], ARGV[1]) ~= ARGV[2] or redis.call('zrem', KEYS[1], ARGV[1]) == 0 then 
+	return 0; 
+end; 
+redis.call('hdel', KEYS[2], ARGV[1]); 
+redis.call('hdel', KEYS[3], ARGV[1]); 
+redis.call('hdel', KEYS[4], ARGV[1]); 
+return 1;`,
+		},
+		// 延迟队列重试任务 eg: EvalScript('delay_queue_retry', 'processing', 'delayed', 'attempts', 'dead', 'claims', id, delay_ms, max_attempts, token)
+		ScriptKeyDelayQueueRetry: {
+			keyCount: 5,
+			script: `
+redis.replicate_commands(); 
+if redis.call('hget', KEYS[5], ARGV[1]) ~= ARGV[4] or redis.call('zrem', KEYS[1], ARGV[1]) == 0 then 
+	return -1; 
+end; 
+redis.call('hdel', KEYS[5], ARGV[1]); 
+local t = redis.call('time'); 
+local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000); 
+local attempts, max = tonumber(redis.call('hget', KEYS[3], ARGV[1])) or 0, tonumber(ARGV[3]); 
+if max > 0 and attempts >= max then 
+	redis.call('zadd', KEYS[4], now, ARGV[1]); 
+	return 1; 
+end; 
+redis.call('zadd', KEYS[2], now + tonumber(ARGV[2]), ARGV[1]); 
+return 0;`,
+		},
 	}
 )
 
@@ -237,6 +612,10 @@ Retry:
 }
 
 func (s *Script) DoContext(c redis.Conn, ctx context.Context, keysAndArgs ...interface{}) (interface{}, error) {
+	// pipeline中无法在NOSCRIPT时加载脚本，直接使用EVAL
+	if _, ok := c.(*pipelineConn); ok {
+		return redis.DoContext(c, ctx, "EVAL", s.args(s.src, keysAndArgs)...)
+	}
 	retryTimes := 1
 Retry:
 	v, err := redis.DoContext(c, ctx, "EVALSHA", s.args(s.rs.Hash(), keysAndArgs)...)
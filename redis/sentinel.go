@@ -0,0 +1,237 @@
+package redis
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/gomodule/redigo/redis"
+	"github.com/youchuangcd/gopkg"
+	"github.com/youchuangcd/gopkg/mylog"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrNoMaster 所有哨兵都无法提供master地址
+	ErrNoMaster = errors.New("redis: no master found by sentinels")
+	// errMasterChanged 连接的节点已经不是master，由连接池丢弃
+	errMasterChanged = errors.New("redis: master changed")
+)
+
+// sentinel 哨兵模式下维护当前master地址
+type sentinel struct {
+	config Config
+
+	mu   sync.RWMutex
+	addr string
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newSentinel(v Config) *sentinel {
+	return &sentinel{
+		config: v,
+		done:   make(chan struct{}),
+	}
+}
+
+// current 当前已知的master地址
+func (s *sentinel) current() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.addr
+}
+
+func (s *sentinel) setAddr(ctx context.Context, addr string) {
+	s.mu.Lock()
+	old := s.addr
+	s.addr = addr
+	s.mu.Unlock()
+	if old != "" && old != addr {
+		mylog.WithWarn(ctx, gopkg.LogRedis, map[string]interface{}{
+			"name":        s.config.Name,
+			"master_name": s.config.MasterName,
+			"old_addr":    old,
+			"new_addr":    addr,
+		}, "redis主从切换，使用新的master")
+	}
+}
+
+// dialSentinel 连接哨兵，readTimeout为0时不限制读取时间
+func (s *sentinel) dialSentinel(ctx context.Context, addr string, readTimeout time.Duration) (redis.Conn, error) {
+	return redis.DialContext(ctx, "tcp", addr,
+		redis.DialPassword(s.config.SentinelPassword),
+		redis.DialConnectTimeout(time.Duration(s.config.ConnectTimeout)*time.Millisecond),
+		redis.DialReadTimeout(readTimeout),
+		redis.DialWriteTimeout(time.Duration(s.config.WriteTimeout)*time.Millisecond))
+}
+
+// masterAddr 依次询问哨兵获取master地址
+func (s *sentinel) masterAddr(ctx context.Context) (string, error) {
+	lastErr := ErrNoMaster
+	for _, sentinelAddr := range s.config.Addrs {
+		c, err := s.dialSentinel(ctx, sentinelAddr, time.Duration(s.config.ReadTimeout)*time.Millisecond)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		res, err := redis.Strings(redis.DoContext(c, ctx, "SENTINEL", "get-master-addr-by-name", s.config.MasterName))
+		c.Close()
+		if err != nil || len(res) != 2 {
+			if err != nil && err != redis.ErrNil {
+				lastErr = err
+			}
+			continue
+		}
+		addr := net.JoinHostPort(res[0], res[1])
+		s.setAddr(ctx, addr)
+		return addr, nil
+	}
+	return "", lastErr
+}
+
+// dial 连接池创建连接，每次都向哨兵确认master地址
+func (s *sentinel) dial(ctx context.Context) (redis.Conn, error) {
+	addr, err := s.masterAddr(ctx)
+	if err != nil {
+		mylog.Error(ctx, gopkg.LogRedis, "[redis init] sentinel "+err.Error())
+		return nil, err
+	}
+	c, err := dialNode(ctx, s.config, addr)
+	if err != nil {
+		return nil, err
+	}
+	// 哨兵的信息可能落后于实际的切换，确认连接的节点是master
+	if role, rErr := redis.Values(redis.DoContext(c, ctx, "ROLE")); rErr == nil && len(role) > 0 {
+		if r, _ := redis.String(role[0], nil); r != "master" {
+			c.Close()
+			return nil, fmt.Errorf("redis: %s is not master, role %s", addr, r)
+		}
+	}
+	return &masterConn{Conn: c, sentinel: s, addr: addr}, nil
+}
+
+// testOnBorrow 丢弃连接到旧master的连接
+func (s *sentinel) testOnBorrow(c redis.Conn, _ time.Time) error {
+	if mc, ok := c.(*masterConn); ok && mc.addr != s.current() {
+		return errMasterChanged
+	}
+	return nil
+}
+
+// watch 订阅哨兵的+switch-master消息，及时更新master地址；断开后轮流连接其他哨兵
+func (s *sentinel) watch() {
+	for i := 0; len(s.config.Addrs) > 0; i++ {
+		select {
+		case <-s.done:
+			return
+		default:
+		}
+		s.subscribe(s.config.Addrs[i%len(s.config.Addrs)])
+		timer := time.NewTimer(time.Second)
+		select {
+		case <-s.done:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+func (s *sentinel) subscribe(sentinelAddr string) {
+	ctx := context.Background()
+	c, err := s.dialSentinel(ctx, sentinelAddr, 0)
+	if err != nil {
+		mylog.WithWarn(ctx, gopkg.LogRedis, map[string]interface{}{
+			"name":          s.config.Name,
+			"sentinel_addr": sentinelAddr,
+			"err":           err.Error(),
+		}, "连接redis哨兵失败")
+		return
+	}
+	defer c.Close()
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-s.done:
+			c.Close()
+		case <-stop:
+		}
+	}()
+
+	psc := redis.PubSubConn{Conn: c}
+	if err = psc.Subscribe("+switch-master"); err != nil {
+		return
+	}
+	// 断开期间可能错过了切换消息，订阅后重新获取一次
+	s.masterAddr(ctx)
+	for {
+		switch v := psc.Receive().(type) {
+		case redis.Message:
+			// <master name> <old ip> <old port> <new ip> <new port>
+			fields := strings.Fields(string(v.Data))
+			if len(fields) == 5 && fields[0] == s.config.MasterName {
+				s.setAddr(ctx, net.JoinHostPort(fields[3], fields[4]))
+			}
+		case error:
+			select {
+			case <-s.done:
+			default:
+				mylog.WithWarn(ctx, gopkg.LogRedis, map[string]interface{}{
+					"name":          s.config.Name,
+					"sentinel_addr": sentinelAddr,
+					"err":           v.Error(),
+				}, "redis哨兵订阅断开，重新连接")
+			}
+			return
+		}
+	}
+}
+
+func (s *sentinel) close() {
+	s.closeOnce.Do(func() {
+		close(s.done)
+	})
+}
+
+// masterConn 记录连接的master地址；收到READONLY说明该节点已降级为从节点，重新询问哨兵
+type masterConn struct {
+	redis.Conn
+	sentinel *sentinel
+	addr     string
+}
+
+func (c *masterConn) check(reply interface{}, err error) (interface{}, error) {
+	if e, ok := err.(redis.Error); ok && strings.HasPrefix(string(e), "READONLY") {
+		go c.sentinel.masterAddr(context.Background())
+	}
+	return reply, err
+}
+
+func (c *masterConn) Do(commandName string, args ...interface{}) (interface{}, error) {
+	return c.check(c.Conn.Do(commandName, args...))
+}
+
+func (c *masterConn) DoContext(ctx context.Context, commandName string, args ...interface{}) (interface{}, error) {
+	return c.check(redis.DoContext(c.Conn, ctx, commandName, args...))
+}
+
+func (c *masterConn) DoWithTimeout(timeout time.Duration, commandName string, args ...interface{}) (interface{}, error) {
+	return c.check(redis.DoWithTimeout(c.Conn, timeout, commandName, args...))
+}
+
+func (c *masterConn) Receive() (interface{}, error) {
+	return c.check(c.Conn.Receive())
+}
+
+func (c *masterConn) ReceiveContext(ctx context.Context) (interface{}, error) {
+	return c.check(redis.ReceiveContext(c.Conn, ctx))
+}
+
+func (c *masterConn) ReceiveWithTimeout(timeout time.Duration) (interface{}, error) {
+	return c.check(redis.ReceiveWithTimeout(c.Conn, timeout))
+}
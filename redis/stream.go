@@ -0,0 +1,255 @@
+package redis
+
+import (
+	"context"
+	"github.com/gomodule/redigo/redis"
+	"time"
+)
+
+// StreamMessage stream中的一条消息，消息已被删除时Values为nil
+type StreamMessage struct {
+	Id     string
+	Values map[string]string
+}
+
+// PendingMessage 已投递未确认的消息
+type PendingMessage struct {
+	Id       string
+	Consumer string
+	// Idle 距离最后一次投递的时间
+	Idle time.Duration
+	// Deliveries 投递次数
+	Deliveries int64
+}
+
+// XAdd
+// @Description: 添加消息，id由redis生成
+// @param ctx
+// @param stream
+// @param maxLen 大于0时近似裁剪到该长度(MAXLEN ~)
+// @param values
+// @return *Reply 消息id
+func XAdd(ctx context.Context, stream string, maxLen int64, values map[string]interface{}) *Reply {
+	c, _ := getPoolInstance(ctx).GetContext(ctx)
+	defer c.Close()
+	args := redis.Args{stream}
+	if maxLen > 0 {
+		args = args.Add("MAXLEN", "~", maxLen)
+	}
+	args = args.Add("*")
+	for k, v := range values {
+		args = args.Add(k, v)
+	}
+	return getReply(redis.DoContext(c, ctx, "xadd", args...))
+}
+
+// XLen 消息数量
+func XLen(ctx context.Context, stream string) *Reply {
+	c, _ := getPoolInstance(ctx).GetContext(ctx)
+	defer c.Close()
+	return getReply(redis.DoContext(c, ctx, "xlen", stream))
+}
+
+// XGroupCreate
+// @Description: 创建消费组，stream不存在时自动创建；消费组已存在时返回BUSYGROUP错误
+// @param ctx
+// @param stream
+// @param group
+// @param start 从哪个id之后开始消费，$表示只消费新消息，0表示从头消费
+// @return *Reply
+func XGroupCreate(ctx context.Context, stream, group, start string) *Reply {
+	c, _ := getPoolInstance(ctx).GetContext(ctx)
+	defer c.Close()
+	return getReply(redis.DoContext(c, ctx, "xgroup", "create", stream, group, start, "mkstream"))
+}
+
+// XReadGroup
+// @Description: 以消费组读取消息
+// @param ctx
+// @param group
+// @param consumer
+// @param stream
+// @param count 最多读取的数量
+// @param block 没有消息时阻塞等待的时间，0表示不阻塞
+// @param id >表示读取未投递过的消息，其他id表示读取自己已投递未确认的消息
+// @return []StreamMessage 没有消息时为空
+// @return error
+func XReadGroup(ctx context.Context, group, consumer, stream string, count int64, block time.Duration, id string) ([]StreamMessage, error) {
+	p := getPoolInstance(ctx)
+	c, _ := p.GetContext(ctx)
+	args := redis.Args{"group", group, consumer}
+	if count > 0 {
+		args = args.Add("count", count)
+	}
+	var (
+		reply interface{}
+		err   error
+	)
+	if block > 0 {
+		args = args.Add("block", block.Milliseconds(), "streams", stream, id)
+		// 阻塞命令的读取超时需要大于阻塞时间，DoContext会把读取超时限制在ReadTimeout内，所以在协程中执行并单独等待ctx；
+		// ctx结束时直接返回，连接在命令返回后归还，这期间读到的消息留在待确认列表，之后由consumeHistory或claim处理
+		type result struct {
+			reply interface{}
+			err   error
+		}
+		done := make(chan result, 1)
+		go func() {
+			defer c.Close()
+			r, e := redis.DoWithTimeout(c, block+time.Duration(p.config.ReadTimeout)*time.Millisecond, "xreadgroup", args...)
+			done <- result{r, e}
+		}()
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case r := <-done:
+			reply, err = r.reply, r.err
+		}
+	} else {
+		args = args.Add("streams", stream, id)
+		reply, err = redis.DoContext(c, ctx, "xreadgroup", args...)
+		c.Close()
+	}
+	streams, err := redis.Values(reply, err)
+	if err == ErrNil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, item := range streams {
+		// [stream, [消息...]]
+		fields, err := redis.Values(item, nil)
+		if err != nil || len(fields) != 2 {
+			continue
+		}
+		return parseStreamMessages(fields[1], nil)
+	}
+	return nil, nil
+}
+
+// XAck 确认消息
+func XAck(ctx context.Context, stream, group string, ids ...string) *Reply {
+	c, _ := getPoolInstance(ctx).GetContext(ctx)
+	defer c.Close()
+	return getReply(redis.DoContext(c, ctx, "xack", redis.Args{stream, group}.AddFlat(ids)...))
+}
+
+// XPending
+// @Description: 查询已投递未确认的消息
+// @param ctx
+// @param stream
+// @param group
+// @param start 开始id，-表示最小
+// @param end 结束id，+表示最大
+// @param count
+// @param consumer 只查询该消费者的消息
+// @return []PendingMessage
+// @return error
+func XPending(ctx context.Context, stream, group, start, end string, count int64, consumer ...string) ([]PendingMessage, error) {
+	c, _ := getPoolInstance(ctx).GetContext(ctx)
+	defer c.Close()
+	args := redis.Args{stream, group, start, end, count}
+	if len(consumer) > 0 {
+		args = args.Add(consumer[0])
+	}
+	items, err := redis.Values(redis.DoContext(c, ctx, "xpending", args...))
+	if err == ErrNil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	res := make([]PendingMessage, 0, len(items))
+	for _, item := range items {
+		// [id, consumer, idle毫秒, 投递次数]
+		fields, err := redis.Values(item, nil)
+		if err != nil || len(fields) != 4 {
+			continue
+		}
+		var (
+			pm   PendingMessage
+			idle int64
+		)
+		pm.Id, _ = redis.String(fields[0], nil)
+		pm.Consumer, _ = redis.String(fields[1], nil)
+		idle, _ = redis.Int64(fields[2], nil)
+		pm.Idle = time.Duration(idle) * time.Millisecond
+		pm.Deliveries, _ = redis.Int64(fields[3], nil)
+		res = append(res, pm)
+	}
+	return res, nil
+}
+
+// XClaim
+// @Description: 把空闲超过minIdle的消息转给consumer，投递次数加一
+// @param ctx
+// @param stream
+// @param group
+// @param consumer
+// @param minIdle
+// @param ids
+// @return []StreamMessage 转移成功的消息
+// @return error
+func XClaim(ctx context.Context, stream, group, consumer string, minIdle time.Duration, ids ...string) ([]StreamMessage, error) {
+	c, _ := getPoolInstance(ctx).GetContext(ctx)
+	defer c.Close()
+	args := redis.Args{stream, group, consumer, minIdle.Milliseconds()}.AddFlat(ids)
+	return parseStreamMessages(redis.DoContext(c, ctx, "xclaim", args...))
+}
+
+// XAutoClaim
+// @Description: 从start开始扫描，把空闲超过minIdle的消息转给consumer，需要redis 6.2以上
+// @param ctx
+// @param stream
+// @param group
+// @param consumer
+// @param minIdle
+// @param start
+// @param count
+// @return next 下次扫描的开始id，0-0表示扫描完成
+// @return msgs
+// @return err
+func XAutoClaim(ctx context.Context, stream, group, consumer string, minIdle time.Duration, start string, count int64) (next string, msgs []StreamMessage, err error) {
+	c, _ := getPoolInstance(ctx).GetContext(ctx)
+	defer c.Close()
+	values, err := redis.Values(redis.DoContext(c, ctx, "xautoclaim", stream, group, consumer, minIdle.Milliseconds(), start, "count", count))
+	if err != nil {
+		return
+	}
+	// [next, [消息...], redis7以上返回已删除的id]
+	if len(values) < 2 {
+		return "", nil, ErrNil
+	}
+	if next, err = redis.String(values[0], nil); err != nil {
+		return
+	}
+	msgs, err = parseStreamMessages(values[1], nil)
+	return
+}
+
+// parseStreamMessages 解析 [[id, [field, value, ...]], ...]
+func parseStreamMessages(reply interface{}, err error) ([]StreamMessage, error) {
+	items, err := redis.Values(reply, err)
+	if err != nil {
+		return nil, err
+	}
+	msgs := make([]StreamMessage, 0, len(items))
+	for _, item := range items {
+		fields, err := redis.Values(item, nil)
+		if err != nil || len(fields) != 2 {
+			continue
+		}
+		var msg StreamMessage
+		if msg.Id, err = redis.String(fields[0], nil); err != nil {
+			continue
+		}
+		if fields[1] != nil {
+			if msg.Values, err = redis.StringMap(fields[1], nil); err != nil {
+				return nil, err
+			}
+		}
+		msgs = append(msgs, msg)
+	}
+	return msgs, nil
+}
@@ -0,0 +1,394 @@
+package redis
+
+import (
+	"context"
+	"fmt"
+	"github.com/gomodule/redigo/redis"
+	"github.com/youchuangcd/gopkg"
+	"github.com/youchuangcd/gopkg/common/utils"
+	"github.com/youchuangcd/gopkg/mylog"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// DefaultStreamBlock 没有消息时阻塞等待的时间，ctx取消时立即返回
+	DefaultStreamBlock = 2 * time.Second
+	// DefaultStreamClaimIdle 消息超过该时间没有确认，认为消费者已失效，转给其他消费者
+	DefaultStreamClaimIdle = time.Minute
+	// DefaultStreamMaxDeliveries 投递次数达到该值仍未确认时移入死信stream
+	DefaultStreamMaxDeliveries int64 = 5
+)
+
+// StreamConsumerOption 消费者配置
+type StreamConsumerOption struct {
+	// Consumer 消费者名称，默认 主机名-进程id
+	Consumer string
+	// Start 创建消费组时从哪个id之后开始消费，默认$只消费新消息
+	Start string
+	// Block 没有消息时阻塞等待的时间
+	Block time.Duration
+	// ClaimIdle 未确认的消息空闲超过该时间后重新投递，处理失败的消息也在这之后重试
+	ClaimIdle time.Duration
+	// ClaimInterval 检查未确认消息的间隔，默认ClaimIdle的一半
+	ClaimInterval time.Duration
+	// ClaimBatch 每次检查未确认消息的数量
+	ClaimBatch int64
+	// MaxDeliveries 投递次数达到该值仍未确认时移入死信stream，0表示不限制
+	MaxDeliveries int64
+	// DeadLetterStream 死信stream，默认 stream名:dead
+	DeadLetterStream string
+}
+
+// SetStreamConsumerOptionFunc 设置消费者配置的方法
+type SetStreamConsumerOptionFunc func(option StreamConsumerOption) StreamConsumerOption
+
+// StreamConsumer 基于stream消费组的队列消费者
+type StreamConsumer struct {
+	stream string
+	group  string
+	option StreamConsumerOption
+
+	mu sync.Mutex
+	// inflight 已分发还没有处理完的消息，claim时跳过，避免处理时间超过ClaimIdle的消息被自己重复投递
+	inflight map[string]struct{}
+}
+
+// NewStreamConsumer
+// @Description: 创建stream消费者
+// @param stream
+// @param group 消费组，不存在时自动创建
+// @param optionFuncs
+// @return *StreamConsumer
+func NewStreamConsumer(stream, group string, optionFuncs ...SetStreamConsumerOptionFunc) *StreamConsumer {
+	hostname, _ := os.Hostname()
+	option := StreamConsumerOption{
+		Consumer:      hostname + "-" + strconv.Itoa(os.Getpid()),
+		Start:         "$",
+		Block:         DefaultStreamBlock,
+		ClaimIdle:     DefaultStreamClaimIdle,
+		ClaimBatch:    100,
+		MaxDeliveries: DefaultStreamMaxDeliveries,
+	}
+	for _, optionFunc := range optionFuncs {
+		option = optionFunc(option)
+	}
+	if option.ClaimInterval <= 0 {
+		option.ClaimInterval = option.ClaimIdle / 2
+	}
+	if option.DeadLetterStream == "" {
+		option.DeadLetterStream = stream + ":dead"
+	}
+	return &StreamConsumer{stream: stream, group: group, option: option, inflight: make(map[string]struct{})}
+}
+
+// Consume
+// @Description: 消费消息直到ctx取消，等待处理中的消息完成后返回；cb返回nil时确认消息，返回错误时在ClaimIdle之后重新投递
+// @receiver s
+// @param ctx 同时用于选择redis实例
+// @param cb
+// @param goPoolSize 并发处理的协程数
+// @return error 创建消费组或协程池失败
+func (s *StreamConsumer) Consume(ctx context.Context, cb func(ctx context.Context, msg StreamMessage) error, goPoolSize int) error {
+	if goPoolSize < 1 {
+		goPoolSize = 1
+	}
+	if err := s.createGroup(ctx); err != nil {
+		return err
+	}
+	pool, err := utils.NewPool(goPoolSize)
+	if err != nil {
+		return err
+	}
+	defer pool.Release()
+
+	var (
+		wg  sync.WaitGroup
+		sem = make(chan struct{}, goPoolSize)
+		// 确认消息不受ctx取消的影响，避免退出时处理完的消息被重新投递
+		ackCtx = valueOnlyContext{ctx}
+	)
+	defer wg.Wait()
+	dispatch := func(msg StreamMessage) {
+		if !s.markInflight(msg.Id) {
+			return
+		}
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			s.unmarkInflight(msg.Id)
+			return
+		}
+		wg.Add(1)
+		task := func() {
+			defer func() {
+				s.unmarkInflight(msg.Id)
+				<-sem
+				wg.Done()
+			}()
+			s.handle(ctx, ackCtx, cb, msg)
+		}
+		if sErr := pool.Submit(task); sErr != nil {
+			s.unmarkInflight(msg.Id)
+			<-sem
+			wg.Done()
+			mylog.WithError(ctx, gopkg.LogRedis, map[string]interface{}{
+				"stream": s.stream,
+				"id":     msg.Id,
+				"err":    sErr.Error(),
+			}, "stream消费者提交消息到协程池失败")
+		}
+	}
+
+	// 先处理上次退出前已读取未确认的消息
+	s.consumeHistory(ctx, ackCtx, dispatch)
+	var lastClaim time.Time
+	for ctx.Err() == nil {
+		if time.Since(lastClaim) >= s.option.ClaimInterval {
+			s.claim(ctx, ackCtx, dispatch)
+			lastClaim = time.Now()
+		}
+		msgs, rErr := XReadGroup(ctx, s.group, s.option.Consumer, s.stream, int64(goPoolSize), s.option.Block, ">")
+		if rErr != nil {
+			if ctx.Err() != nil {
+				break
+			}
+			s.logError(ctx, rErr, "stream消费者读取消息失败")
+			if e, ok := rErr.(redis.Error); ok && strings.HasPrefix(string(e), "NOGROUP") {
+				// stream被删除后重新创建消费组
+				s.createGroup(ctx)
+			}
+			s.sleep(ctx, time.Second)
+			continue
+		}
+		for _, msg := range msgs {
+			dispatch(msg)
+		}
+	}
+	return nil
+}
+
+func (s *StreamConsumer) createGroup(ctx context.Context) error {
+	err := XGroupCreate(ctx, s.stream, s.group, s.option.Start).Error()
+	if e, ok := err.(redis.Error); ok && strings.HasPrefix(string(e), "BUSYGROUP") {
+		return nil
+	}
+	return err
+}
+
+// consumeHistory 分页读取自己已投递未确认的消息
+func (s *StreamConsumer) consumeHistory(ctx, ackCtx context.Context, dispatch func(msg StreamMessage)) {
+	start := "0"
+	for ctx.Err() == nil {
+		msgs, err := XReadGroup(ctx, s.group, s.option.Consumer, s.stream, s.option.ClaimBatch, 0, start)
+		if err != nil {
+			s.logError(ctx, err, "stream消费者读取未确认的消息失败")
+			return
+		}
+		if len(msgs) == 0 {
+			return
+		}
+		for _, msg := range msgs {
+			if msg.Values == nil {
+				// 消息已被删除
+				XAck(ackCtx, s.stream, s.group, msg.Id)
+				continue
+			}
+			dispatch(msg)
+		}
+		start = msgs[len(msgs)-1].Id
+	}
+}
+
+// claim 把空闲超过ClaimIdle的消息转给自己处理，投递次数过多的移入死信stream；
+// 按id分页查询未确认的消息，前面的消息都还在处理中时继续往后找，直到找到ClaimBatch条或查完
+func (s *StreamConsumer) claim(ctx, ackCtx context.Context, dispatch func(msg StreamMessage)) {
+	var (
+		ids        []string
+		dead       []string
+		deliveries = make(map[string]int64)
+	)
+	for start := "-"; int64(len(ids)+len(dead)) < s.option.ClaimBatch && ctx.Err() == nil; {
+		pending, err := XPending(ctx, s.stream, s.group, start, "+", s.option.ClaimBatch)
+		if err != nil {
+			s.logError(ctx, err, "stream消费者查询未确认的消息失败")
+			break
+		}
+		for _, p := range pending {
+			// 自己正在处理的消息不转移，处理完会确认或等下次超时
+			if p.Idle < s.option.ClaimIdle || s.isInflight(p.Id) {
+				continue
+			}
+			if s.option.MaxDeliveries > 0 && p.Deliveries >= s.option.MaxDeliveries {
+				dead = append(dead, p.Id)
+				deliveries[p.Id] = p.Deliveries
+			} else {
+				ids = append(ids, p.Id)
+			}
+		}
+		if int64(len(pending)) < s.option.ClaimBatch {
+			break
+		}
+		if start, err = nextStreamId(pending[len(pending)-1].Id); err != nil {
+			break
+		}
+	}
+	if len(dead) > 0 {
+		s.deadLetter(ctx, ackCtx, dead, deliveries)
+	}
+	if len(ids) == 0 {
+		return
+	}
+	msgs, err := XClaim(ctx, s.stream, s.group, s.option.Consumer, s.option.ClaimIdle, ids...)
+	if err != nil {
+		s.logError(ctx, err, "stream消费者转移未确认的消息失败")
+		return
+	}
+	for _, msg := range msgs {
+		if msg.Values == nil {
+			XAck(ackCtx, s.stream, s.group, msg.Id)
+			continue
+		}
+		dispatch(msg)
+	}
+}
+
+// nextStreamId 紧跟在id之后的消息id，用于分页查询；兼容不支持排他区间的redis版本
+func nextStreamId(id string) (string, error) {
+	msPart, seqPart, ok := strings.Cut(id, "-")
+	if !ok {
+		return "", fmt.Errorf("redis: invalid stream id %s", id)
+	}
+	ms, err := strconv.ParseUint(msPart, 10, 64)
+	if err != nil {
+		return "", fmt.Errorf("redis: invalid stream id %s", id)
+	}
+	seq, err := strconv.ParseUint(seqPart, 10, 64)
+	if err != nil {
+		return "", fmt.Errorf("redis: invalid stream id %s", id)
+	}
+	if seq == math.MaxUint64 {
+		return strconv.FormatUint(ms+1, 10) + "-0", nil
+	}
+	return msPart + "-" + strconv.FormatUint(seq+1, 10), nil
+}
+
+// deadLetter 先转给自己防止被其他消费者同时处理，写入死信stream后确认
+func (s *StreamConsumer) deadLetter(ctx, ackCtx context.Context, ids []string, deliveries map[string]int64) {
+	msgs, err := XClaim(ctx, s.stream, s.group, s.option.Consumer, s.option.ClaimIdle, ids...)
+	if err != nil {
+		s.logError(ctx, err, "stream消费者转移死信消息失败")
+		return
+	}
+	for _, msg := range msgs {
+		if msg.Values != nil {
+			values := make(map[string]interface{}, len(msg.Values)+3)
+			for k, v := range msg.Values {
+				values[k] = v
+			}
+			values["_source_id"] = msg.Id
+			values["_group"] = s.group
+			values["_deliveries"] = deliveries[msg.Id]
+			if err = XAdd(ackCtx, s.option.DeadLetterStream, 0, values).Error(); err != nil {
+				s.logError(ctx, err, "stream消费者写入死信stream失败")
+				continue
+			}
+			mylog.WithWarn(ctx, gopkg.LogRedis, map[string]interface{}{
+				"stream":      s.stream,
+				"group":       s.group,
+				"id":          msg.Id,
+				"deliveries":  deliveries[msg.Id],
+				"dead_stream": s.option.DeadLetterStream,
+			}, "stream消息投递次数过多，移入死信stream")
+		}
+		XAck(ackCtx, s.stream, s.group, msg.Id)
+	}
+}
+
+func (s *StreamConsumer) handle(ctx, ackCtx context.Context, cb func(ctx context.Context, msg StreamMessage) error, msg StreamMessage) {
+	err := func() (err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				err = fmt.Errorf("stream consumer panic: %v", r)
+			}
+		}()
+		return cb(ctx, msg)
+	}()
+	if err != nil {
+		// 不确认，ClaimIdle之后重新投递
+		mylog.WithError(ctx, gopkg.LogRedis, map[string]interface{}{
+			"stream":   s.stream,
+			"group":    s.group,
+			"consumer": s.option.Consumer,
+			"id":       msg.Id,
+			"err":      err.Error(),
+		}, "[StreamConsumer] Message Failed")
+		return
+	}
+	if err = XAck(ackCtx, s.stream, s.group, msg.Id).Error(); err != nil {
+		s.logError(ctx, err, "stream消费者确认消息失败")
+	}
+}
+
+// markInflight 标记消息正在处理，已在处理中时返回false
+func (s *StreamConsumer) markInflight(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.inflight[id]; ok {
+		return false
+	}
+	s.inflight[id] = struct{}{}
+	return true
+}
+
+func (s *StreamConsumer) unmarkInflight(id string) {
+	s.mu.Lock()
+	delete(s.inflight, id)
+	s.mu.Unlock()
+}
+
+func (s *StreamConsumer) isInflight(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.inflight[id]
+	return ok
+}
+
+func (s *StreamConsumer) logError(ctx context.Context, err error, msg string) {
+	mylog.WithError(ctx, gopkg.LogRedis, map[string]interface{}{
+		"stream":   s.stream,
+		"group":    s.group,
+		"consumer": s.option.Consumer,
+		"err":      err.Error(),
+	}, msg)
+}
+
+func (s *StreamConsumer) sleep(ctx context.Context, d time.Duration) {
+	timer := time.NewTimer(d)
+	select {
+	case <-ctx.Done():
+		timer.Stop()
+	case <-timer.C:
+	}
+}
+
+// valueOnlyContext 保留ctx中的值(如SwitchRedisByCtx选择的实例)，不继承取消和超时
+type valueOnlyContext struct {
+	context.Context
+}
+
+func (valueOnlyContext) Deadline() (deadline time.Time, ok bool) {
+	return
+}
+
+func (valueOnlyContext) Done() <-chan struct{} {
+	return nil
+}
+
+func (valueOnlyContext) Err() error {
+	return nil
+}
@@ -0,0 +1,172 @@
+package redis
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestStreamConsumer(t *testing.T) {
+	ctx := context.Background()
+	stream := "test_stream:" + strconv.FormatInt(time.Now().UnixNano(), 10)
+	dead := stream + ":dead"
+	defer Del(ctx, stream, dead)
+
+	consumer := NewStreamConsumer(stream, "g1", func(option StreamConsumerOption) StreamConsumerOption {
+		option.Consumer = "c1"
+		option.Start = "0"
+		option.Block = 50 * time.Millisecond
+		option.ClaimIdle = 100 * time.Millisecond
+		option.ClaimInterval = 20 * time.Millisecond
+		option.MaxDeliveries = 2
+		return option
+	})
+	for i := 0; i < 5; i++ {
+		values := map[string]interface{}{"n": i}
+		if i == 2 {
+			values["fail"] = 1
+		}
+		if err := XAdd(ctx, stream, 0, values).Error(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var (
+		mu       sync.Mutex
+		done     = make(map[string]bool)
+		failures int
+	)
+	cctx, cancel := context.WithCancel(ctx)
+	exited := make(chan error)
+	go func() {
+		exited <- consumer.Consume(cctx, func(ctx context.Context, msg StreamMessage) error {
+			mu.Lock()
+			defer mu.Unlock()
+			if msg.Values["fail"] != "" {
+				failures++
+				return errors.New("处理失败")
+			}
+			done[msg.Values["n"]] = true
+			return nil
+		}, 3)
+	}()
+
+	deadline := time.Now().Add(3 * time.Second)
+	for time.Now().Before(deadline) {
+		if n, _ := XLen(ctx, dead).Int64(); n == 1 {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	cancel()
+	if err := <-exited; err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(done) != 4 || failures != 2 {
+		t.Errorf("成功 %d 失败 %d", len(done), failures)
+	}
+	pending, err := XPending(ctx, stream, "g1", "-", "+", 10)
+	if err != nil || len(pending) != 0 {
+		t.Errorf("所有消息都应该已确认 %v %v", pending, err)
+	}
+	if XGroupCreate(ctx, dead, "dead", "0").Error() != nil {
+		t.Fatal("创建死信消费组失败")
+	}
+	if msgs, err := XReadGroup(ctx, "dead", "c1", dead, 10, 0, ">"); err != nil || len(msgs) != 1 {
+		t.Fatalf("死信消息 %v %v", msgs, err)
+	} else if msgs[0].Values["n"] != "2" || msgs[0].Values["_deliveries"] != "2" {
+		t.Errorf("死信消息内容 %v", msgs[0].Values)
+	}
+}
+
+func TestStreamConsumerSlowHandler(t *testing.T) {
+	ctx := context.Background()
+	stream := "test_stream_slow:" + strconv.FormatInt(time.Now().UnixNano(), 10)
+	defer Del(ctx, stream, stream+":dead")
+
+	consumer := NewStreamConsumer(stream, "g1", func(option StreamConsumerOption) StreamConsumerOption {
+		option.Consumer = "c1"
+		option.Start = "0"
+		option.Block = 20 * time.Millisecond
+		option.ClaimIdle = 50 * time.Millisecond
+		option.ClaimInterval = 10 * time.Millisecond
+		return option
+	})
+	XAdd(ctx, stream, 0, map[string]interface{}{"n": 1})
+
+	var calls int32
+	cctx, cancel := context.WithCancel(ctx)
+	exited := make(chan error)
+	go func() {
+		exited <- consumer.Consume(cctx, func(ctx context.Context, msg StreamMessage) error {
+			atomic.AddInt32(&calls, 1)
+			// 处理时间超过ClaimIdle
+			time.Sleep(200 * time.Millisecond)
+			return nil
+		}, 2)
+	}()
+	time.Sleep(300 * time.Millisecond)
+	cancel()
+	if err := <-exited; err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Errorf("自己正在处理的消息不应该被重复投递，处理%d次", n)
+	}
+
+	// 阻塞读取在ctx结束时立即返回
+	rctx, rcancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer rcancel()
+	start := time.Now()
+	if _, err := XReadGroup(rctx, "g1", "c1", stream, 1, time.Second, ">"); err != context.DeadlineExceeded {
+		t.Errorf("ctx结束应该返回DeadlineExceeded，实际%v", err)
+	}
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Errorf("ctx结束后应该立即停止阻塞读取，耗时%s", d)
+	}
+}
+
+func TestStreamConsumerClaimPaging(t *testing.T) {
+	ctx := context.Background()
+	stream := "test_stream_claim:" + strconv.FormatInt(time.Now().UnixNano(), 10)
+	defer Del(ctx, stream, stream+":dead")
+
+	consumer := NewStreamConsumer(stream, "g1", func(option StreamConsumerOption) StreamConsumerOption {
+		option.Consumer = "c1"
+		option.Start = "0"
+		option.ClaimIdle = 50 * time.Millisecond
+		option.ClaimBatch = 2
+		return option
+	})
+	if err := consumer.createGroup(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		XAdd(ctx, stream, 0, map[string]interface{}{"n": i})
+	}
+	msgs, err := XReadGroup(ctx, "g1", "other", stream, 5, 0, ">")
+	if err != nil || len(msgs) != 5 {
+		t.Fatalf("读取消息 %d %v", len(msgs), err)
+	}
+	time.Sleep(60 * time.Millisecond)
+	// 前3条还在其他消费者处理中，空闲时间重置
+	XClaim(ctx, stream, "g1", "other", 0, msgs[0].Id, msgs[1].Id, msgs[2].Id)
+
+	var claimed []string
+	consumer.claim(ctx, valueOnlyContext{ctx}, func(msg StreamMessage) {
+		claimed = append(claimed, msg.Id)
+	})
+	if len(claimed) != 2 || claimed[0] != msgs[3].Id || claimed[1] != msgs[4].Id {
+		t.Errorf("应该跳过处理中的消息转移后面空闲的消息 %v", claimed)
+	}
+	if id, _ := nextStreamId("1-18446744073709551615"); id != "2-0" {
+		t.Errorf("nextStreamId %s", id)
+	}
+}